@@ -0,0 +1,247 @@
+package lethe
+
+import (
+	"container/list"
+	"hash/fnv"
+	"lethe/bloomfilter"
+	"sync"
+	"sync/atomic"
+)
+
+// The block cache keeps the blocks read from SST-files in memory, shared by all the readers of collection.
+//
+// A block is keyed by its file and offset, e.g. the entries of a page or the filters of a file,
+// and it is charged by its size in memory against the capacity of cache,
+// i.e. the decompressed size of a page (pageBlock.size) and the block size of filters.
+// SST-files are immutable and their names are never reused, so a cached block is never stale,
+// and the blocks of a removed file are evicted as the least recently used ones.
+//
+// The cache is sharded on key to reduce the contention of lock,
+// each shard is a LRU list with an equal part of the capacity.
+
+const blockCacheNumShard = 16
+
+type blockCacheKey struct {
+	name   string
+	offset int64
+}
+
+type blockCacheItem struct {
+	key    blockCacheKey
+	value  interface{}
+	charge int64
+}
+
+type blockCacheShard struct {
+	sync.Mutex
+
+	capacity int64
+	usage    int64
+
+	// the most recently used item is at the front
+	lru   *list.List
+	items map[blockCacheKey]*list.Element
+}
+
+type blockCache struct {
+	shards []*blockCacheShard
+
+	hits   int64
+	misses int64
+}
+
+// newBlockCache returns a cache of capacity bytes, nil if capacity is not positive.
+func newBlockCache(capacity int64) *blockCache {
+	if capacity <= 0 {
+		return nil
+	}
+
+	c := &blockCache{}
+	for i := 0; i < blockCacheNumShard; i++ {
+		c.shards = append(c.shards, &blockCacheShard{
+			capacity: (capacity + blockCacheNumShard - 1) / blockCacheNumShard,
+			lru:      list.New(),
+			items:    map[blockCacheKey]*list.Element{},
+		})
+	}
+
+	return c
+}
+
+func (c *blockCache) shard(key blockCacheKey) *blockCacheShard {
+	h := fnv.New32a()
+	h.Write([]byte(key.name))
+	return c.shards[(h.Sum32()^uint32(key.offset))%blockCacheNumShard]
+}
+
+// get returns the cached block of key, and counts the hit or miss.
+func (c *blockCache) get(key blockCacheKey) (interface{}, bool) {
+	s := c.shard(key)
+
+	s.Lock()
+	elem, ok := s.items[key]
+	if ok {
+		s.lru.MoveToFront(elem)
+	}
+	s.Unlock()
+
+	if !ok {
+		atomic.AddInt64(&c.misses, 1)
+		return nil, false
+	}
+
+	atomic.AddInt64(&c.hits, 1)
+	return elem.Value.(*blockCacheItem).value, true
+}
+
+// insert caches the block of key, and evicts the least recently used blocks beyond capacity.
+// A block larger than the capacity of its shard is not cached.
+func (c *blockCache) insert(key blockCacheKey, value interface{}, charge int64) {
+	s := c.shard(key)
+
+	s.Lock()
+	defer s.Unlock()
+
+	if charge > s.capacity {
+		return
+	}
+
+	// filled by a concurrent reader meanwhile
+	if elem, ok := s.items[key]; ok {
+		s.lru.MoveToFront(elem)
+		return
+	}
+
+	s.items[key] = s.lru.PushFront(&blockCacheItem{key: key, value: value, charge: charge})
+	s.usage += charge
+
+	for s.usage > s.capacity {
+		item := s.lru.Remove(s.lru.Back()).(*blockCacheItem)
+		delete(s.items, item.key)
+		s.usage -= item.charge
+	}
+}
+
+// usage returns the number of bytes of cached blocks.
+func (c *blockCache) usage() int64 {
+	var sum int64 = 0
+	for _, s := range c.shards {
+		s.Lock()
+		sum += s.usage
+		s.Unlock()
+	}
+	return sum
+}
+
+// -----------------------------------------------------------------------------
+// page reader
+// -----------------------------------------------------------------------------
+
+// pageReader reads the pages and filters of SST-files through the block cache,
+// the blocks read are filled into the cache if fillCache.
+// The pages read are verified against their checksums if verifyChecksums or they are filled into the cache.
+// A zero pageReader reads from files directly.
+//
+// A cached page is shared by readers, so it must not be modified.
+type pageReader struct {
+	cache           *blockCache
+	fillCache       bool
+	verifyChecksums bool
+}
+
+// pageReader returns the reader of readOptions, a nil readOptions is DefaultReadOptions.
+func (lsm *collection) pageReader(readOptions *ReadOptions) pageReader {
+	if readOptions == nil {
+		readOptions = &DefaultReadOptions
+	}
+	return pageReader{cache: lsm.cache, fillCache: !readOptions.DontFillCache, verifyChecksums: !readOptions.SkipChecksums}
+}
+
+// loadPage loads page p of file.
+func (r pageReader) loadPage(file *sstFile, p *page) (*pageBlock, error) {
+	if r.cache == nil {
+		return loadPage(file, p, r.verifyChecksums)
+	}
+
+	key := blockCacheKey{name: file.Name, offset: p.Offset}
+	if v, ok := r.cache.get(key); ok {
+		return v.(*pageBlock), nil
+	}
+
+	b, err := loadPage(file, p, r.verifyChecksums || r.fillCache)
+	if err != nil {
+		return nil, err
+	}
+	// the decompressed page is kept, which may be much larger than the page in file
+	if r.fillCache {
+		r.cache.insert(key, b, int64(b.size))
+	}
+
+	return b, nil
+}
+
+// loadEntries loads the entries of page p of file.
+func (r pageReader) loadEntries(file *sstFile, p *page) ([]entry, error) {
+	return r.seekEntries(file, p, nil, nil)
+}
+
+// seekEntries loads the entries of page p of file from the restart point before key, all the entries if key is nil.
+func (r pageReader) seekEntries(file *sstFile, p *page, key []byte, less func(s, t []byte) bool) ([]entry, error) {
+	b, err := r.loadPage(file, p)
+	if err != nil {
+		return nil, err
+	}
+
+	es, err := b.entriesFrom(key, less)
+	if err != nil {
+		return nil, file.corruption(p.Offset, err.Error())
+	}
+
+	return es, nil
+}
+
+// filters returns the bloom filters of file whose filter block is cached, [i][j] for page j of tile i.
+// It returns nil if the filters are kept in pages, or fail to load, so that no page is skipped.
+func (r pageReader) filters(file *sstFile) [][]*bloomfilter.BloomFilter {
+	if !file.filterCached || r.cache == nil {
+		return nil
+	}
+
+	key := blockCacheKey{name: file.Name, offset: file.filterBlock.offset}
+	if v, ok := r.cache.get(key); ok {
+		return v.([][]*bloomfilter.BloomFilter)
+	}
+
+	filters, err := loadFilters(file)
+	if err != nil {
+		return nil
+	}
+	if r.fillCache {
+		r.cache.insert(key, filters, file.filterBlock.size)
+	}
+
+	return filters
+}
+
+// bloomOf returns the bloom filter of page j of tile i of file, filters are returned by pageReader.filters.
+func bloomOf(file *sstFile, filters [][]*bloomfilter.BloomFilter, i, j int) *bloomfilter.BloomFilter {
+	if filters != nil {
+		return filters[i][j]
+	}
+	return file.Tiles[i].Pages[j].bloom
+}
+
+// cacheFilters moves the bloom filters of file from its pages to the block cache,
+// if CacheFilterBlocks is set.
+func (lsm *collection) cacheFilters(file *sstFile) {
+	if lsm.cache == nil || !lsm.options.CacheFilterBlocks {
+		return
+	}
+
+	for i := 0; i < len(file.Tiles); i++ {
+		for j := 0; j < len(file.Tiles[i].Pages); j++ {
+			file.Tiles[i].Pages[j].bloom = nil
+		}
+	}
+	file.filterCached = true
+}
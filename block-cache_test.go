@@ -0,0 +1,164 @@
+package lethe
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestBlockCacheLRU(t *testing.T) {
+
+	c := newBlockCache(blockCacheNumShard * 100)
+
+	// keys of the same shard
+	keys := []blockCacheKey{}
+	s := c.shard(blockCacheKey{name: "000001.sst"})
+	for off := int64(0); len(keys) < 4; off++ {
+		key := blockCacheKey{name: "000001.sst", offset: off}
+		if c.shard(key) == s {
+			keys = append(keys, key)
+		}
+	}
+
+	c.insert(keys[0], 0, 40)
+	c.insert(keys[1], 1, 40)
+	// keys[0] is used recently, so keys[1] is evicted
+	if _, ok := c.get(keys[0]); !ok {
+		t.Fatal("keys[0] is not cached")
+	}
+	c.insert(keys[2], 2, 40)
+
+	if _, ok := c.get(keys[1]); ok {
+		t.Fatal("keys[1] is not evicted")
+	}
+	if v, ok := c.get(keys[2]); !ok || v.(int) != 2 {
+		t.Fatal("keys[2] is not cached")
+	}
+
+	// larger than the shard
+	c.insert(keys[3], 3, 101)
+	if _, ok := c.get(keys[3]); ok {
+		t.Fatal("keys[3] is cached")
+	}
+
+	if c.usage() != 80 {
+		t.Fatalf("usage %d, expected 80", c.usage())
+	}
+	if c.hits != 2 || c.misses != 2 {
+		t.Fatalf("%d hits, %d misses", c.hits, c.misses)
+	}
+
+	if newBlockCache(0) != nil {
+		t.Fatal("cache of zero capacity")
+	}
+}
+
+func TestBlockCache(t *testing.T) {
+
+	options := DefaultCollectionOptions
+	options.MemTableSizeLimit = 16 << 10 // 16KB
+	options.BlockCacheSize = 1 << 20     // 1MB
+	options.CacheFilterBlocks = true
+
+	lsm, err := newCollection(&options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+
+	for i := 0; i < 3000; i++ {
+		key := []byte(fmt.Sprintf("key-%05d", i))
+		if err := lsm.Put(key, key, key, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	testWaitCompacted(t, lsm)
+
+	// the filters are moved to the cache
+	for _, lf := range lsm.levelFiles() {
+		if !lf.file.filterCached {
+			t.Fatalf("filters of SST-file [%s] are not cached", lf.file.Name)
+		}
+	}
+
+	// a scan without filling the cache
+	it, err := lsm.NewIterator(&ReadOptions{DontFillCache: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		n++
+	}
+	it.Close()
+	if n != 3000 {
+		t.Fatalf("scan %d keys, expected 3000", n)
+	}
+	if usage := lsm.cache.usage(); usage != 0 {
+		t.Fatalf("the scan fills %d bytes", usage)
+	}
+
+	get := func() {
+		for i := 0; i < 3000; i += 100 {
+			key := []byte(fmt.Sprintf("key-%05d", i))
+			value, err := lsm.Get(key, nil)
+			if err != nil || !bytes.Equal(value, key) {
+				t.Fatalf("key [%s] got [%s] %v", string(key), string(value), err)
+			}
+			// the value is a copy of the cached page
+			value[0] = 'x'
+		}
+		if _, err := lsm.Get([]byte("key-99999"), nil); err != ErrKeyNotFound {
+			t.Fatal(err)
+		}
+	}
+
+	get()
+	cs, _ := lsm.Stats()
+	fmt.Println(cs.BlockCacheHit, cs.BlockCacheMiss, cs.BlockCacheUsage)
+	if cs.BlockCacheUsage == 0 || cs.BlockCacheCapacity != options.BlockCacheSize {
+		t.Fatal("Get does not fill the cache")
+	}
+
+	// every page and filter is cached now
+	get()
+	cs2, _ := lsm.Stats()
+	if cs2.BlockCacheMiss != cs.BlockCacheMiss || cs2.BlockCacheHit <= cs.BlockCacheHit {
+		t.Fatalf("%d -> %d hits, %d -> %d misses", cs.BlockCacheHit, cs2.BlockCacheHit, cs.BlockCacheMiss, cs2.BlockCacheMiss)
+	}
+}
+
+func TestBlockCacheChargeDecompressed(t *testing.T) {
+
+	options := DefaultCollectionOptions
+	options.BlockCacheSize = 1 << 20 // 1MB
+	options.Compression = FlateCompression
+
+	lsm, err := newCollection(&options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+
+	// values are compressed well
+	es := []entry{}
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key-%05d", i))
+		es = append(es, entry{key: key, value: bytes.Repeat(key, 10), deleteKey: key, meta: keyMeta{seqNum: uint64(i), opType: opPut}})
+	}
+	file, err := lsm.buildSSTFile("file", 0, es, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &file.Tiles[0].Pages[0]
+	b, err := pageReader{cache: lsm.cache, fillCache: true}.loadPage(file, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fmt.Println("page size", p.Size, "decompressed", b.size)
+	if int64(b.size) <= p.Size || lsm.cache.usage() != int64(b.size) {
+		t.Fatalf("usage %d, page size %d, decompressed %d", lsm.cache.usage(), p.Size, b.size)
+	}
+}
@@ -1,5 +1,112 @@
 package bloomfilter
 
+import (
+	"errors"
+	"hash/fnv"
+)
+
 // BloomFilter is a bloom filter.
+//
+// The k probes of a key are derived from one 64-bit hash by double hashing,
+// i.e. g_i(key) = h1(key) + i * h2(key), where h1 and h2 are the low and high 32 bits of the hash.
 type BloomFilter struct {
+	bits []byte
+	k    int // the number of hash functions
+}
+
+const (
+	maxNumHash = 30
+)
+
+// ErrBadEncoding is returned when a serialized bloom filter is malformed.
+var ErrBadEncoding = errors.New("bloom-filter-bad-encoding")
+
+// New returns an empty bloom filter sized for numKeys keys with bitsPerKey bits per key.
+func New(numKeys int, bitsPerKey int) *BloomFilter {
+
+	if bitsPerKey < 1 {
+		bitsPerKey = 1
+	}
+
+	// k = ln(2) * m / n minimizes the false positive rate
+	k := bitsPerKey * 69 / 100
+	if k < 1 {
+		k = 1
+	}
+	if k > maxNumHash {
+		k = maxNumHash
+	}
+
+	// a small filter has a high false positive rate, so at least 64 bits are used
+	nbits := numKeys * bitsPerKey
+	if nbits < 64 {
+		nbits = 64
+	}
+
+	bf := &BloomFilter{}
+	bf.bits = make([]byte, (nbits+7)/8)
+	bf.k = k
+
+	return bf
+}
+
+func hash(key []byte) (h1, h2 uint32) {
+	h := fnv.New64a()
+	h.Write(key)
+	sum := h.Sum64()
+	return uint32(sum), uint32(sum >> 32)
+}
+
+// Add adds a key to the bloom filter.
+func (bf *BloomFilter) Add(key []byte) {
+	nbits := uint32(len(bf.bits) * 8)
+
+	h1, h2 := hash(key)
+	for i := 0; i < bf.k; i++ {
+		pos := (h1 + uint32(i)*h2) % nbits
+		bf.bits[pos/8] |= 1 << (pos % 8)
+	}
+}
+
+// MayContain returns false if the key is exactly not added to the bloom filter.
+func (bf *BloomFilter) MayContain(key []byte) bool {
+	nbits := uint32(len(bf.bits) * 8)
+
+	h1, h2 := hash(key)
+	for i := 0; i < bf.k; i++ {
+		pos := (h1 + uint32(i)*h2) % nbits
+		if bf.bits[pos/8]&(1<<(pos%8)) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Bytes returns the serialization of the bloom filter, i.e. [ bits | k(1) ].
+func (bf *BloomFilter) Bytes() []byte {
+	buf := make([]byte, len(bf.bits)+1)
+	copy(buf, bf.bits)
+	buf[len(bf.bits)] = byte(bf.k)
+	return buf
+}
+
+// Decode returns the bloom filter serialized by Bytes.
+// Note that the bloom filter occupies buf rather than copying it.
+func Decode(buf []byte) (*BloomFilter, error) {
+
+	if len(buf) < 2 {
+		return nil, ErrBadEncoding
+	}
+
+	k := int(buf[len(buf)-1])
+	if k < 1 || k > maxNumHash {
+		return nil, ErrBadEncoding
+	}
+
+	bf := &BloomFilter{}
+	bf.bits = buf[:len(buf)-1]
+	bf.k = k
+
+	return bf, nil
 }
@@ -25,3 +25,63 @@ func TestCopy2(t *testing.T) {
 	fmt.Println("src", src)
 	fmt.Println("dst", dst, dst == nil)
 }
+
+func TestNoFalseNegative(t *testing.T) {
+	num := 10000
+	bf := New(num, 10)
+
+	for i := 0; i < num; i++ {
+		bf.Add([]byte(fmt.Sprintf("key-%d", i)))
+	}
+
+	for i := 0; i < num; i++ {
+		if !bf.MayContain([]byte(fmt.Sprintf("key-%d", i))) {
+			t.Fatalf("false negative on key-%d", i)
+		}
+	}
+}
+
+func TestFalsePositiveRate(t *testing.T) {
+	num := 10000
+	bf := New(num, 10)
+
+	for i := 0; i < num; i++ {
+		bf.Add([]byte(fmt.Sprintf("key-%d", i)))
+	}
+
+	fp := 0
+	for i := 0; i < num; i++ {
+		if bf.MayContain([]byte(fmt.Sprintf("absent-%d", i))) {
+			fp++
+		}
+	}
+
+	// about 1% with 10 bits per key
+	rate := float64(fp) / float64(num)
+	fmt.Println("false positive rate", rate)
+	if rate > 0.03 {
+		t.Fail()
+	}
+}
+
+func TestEncodeDecode(t *testing.T) {
+	bf := New(100, 10)
+	for i := 0; i < 100; i++ {
+		bf.Add([]byte(fmt.Sprintf("key-%d", i)))
+	}
+
+	bf2, err := Decode(bf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100; i++ {
+		if !bf2.MayContain([]byte(fmt.Sprintf("key-%d", i))) {
+			t.Fatalf("false negative on key-%d", i)
+		}
+	}
+
+	if _, err := Decode([]byte{0x00}); err != ErrBadEncoding {
+		t.Fatal()
+	}
+}
@@ -0,0 +1,47 @@
+package lethe
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+)
+
+// Every page and metadata block of SST-file is followed by a trailer of the CRC32C of its bytes,
+// i.e. [ bytes | crc32c(4) ]. The size of page or block includes the trailer.
+
+const checksumLen = 4
+
+// appendChecksum appends the trailer of buf.
+func appendChecksum(buf []byte) []byte {
+	var trailer [checksumLen]byte
+	binary.LittleEndian.PutUint32(trailer[:], crc32.Checksum(buf, crc32cTable))
+	return append(buf, trailer[:]...)
+}
+
+// splitChecksum returns the bytes of buf without trailer, and whether they match the trailer.
+func splitChecksum(buf []byte) ([]byte, bool) {
+	if len(buf) < checksumLen {
+		return nil, false
+	}
+
+	n := len(buf) - checksumLen
+	return buf[:n], crc32.Checksum(buf[:n], crc32cTable) == binary.LittleEndian.Uint32(buf[n:])
+}
+
+// copyPage reads page p of file to be copied into a new file, with its trailer.
+// The page is verified against its trailer.
+func (file *sstFile) copyPage(p *page) ([]byte, error) {
+	buf := make([]byte, p.Size)
+	if err := file.readAt(buf, p.Offset); err != nil {
+		return nil, err
+	}
+
+	if _, ok := splitChecksum(buf); !ok {
+		return nil, file.corruption(p.Offset, "checksum mismatch")
+	}
+	return buf, nil
+}
+
+// corruption returns the error of corrupted data at offset of file.
+func (file *sstFile) corruption(offset int64, reason string) error {
+	return &CorruptionError{File: file.Name, Offset: offset, Reason: reason}
+}
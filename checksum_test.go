@@ -0,0 +1,113 @@
+package lethe
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestChecksumPage(t *testing.T) {
+
+	options := DefaultCollectionOptions
+	options.DirPath = t.TempDir()
+	options.CreateIfMissing = true
+	options.MemTableSizeLimit = 16 << 10 // 16KB
+	options.BlockCacheSize = 0
+
+	lsm, err := newCollection(&options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+
+	for i := 0; i < 3000; i++ {
+		key := []byte(fmt.Sprintf("key-%05d", i))
+		if err := lsm.Put(key, key, key, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	testWaitPersisted(t, lsm)
+	testWaitCompacted(t, lsm)
+
+	// flip a byte of a page on disk
+	file := lsm.levelFiles()[0].file
+	p := &file.Tiles[0].Pages[0]
+
+	f, err := os.OpenFile(path.Join(options.DirPath, file.Name), os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 1)
+	f.ReadAt(b, p.Offset+p.Size/2)
+	b[0] ^= 0xFF
+	if _, err := f.WriteAt(b, p.Offset+p.Size/2); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	_, err = lsm.Get(p.SortKeyMin, nil)
+	fmt.Println(err)
+
+	var ce *CorruptionError
+	if !errors.Is(err, ErrCorruption) || !errors.As(err, &ce) {
+		t.Fatalf("got %v, expected corruption", err)
+	}
+	if ce.File != file.Name || ce.Offset != p.Offset {
+		t.Fatalf("corruption at [%s] %d, expected [%s] %d", ce.File, ce.Offset, file.Name, p.Offset)
+	}
+
+	// the iterator fails on the page too
+	it, err := lsm.NewIterator(&ReadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+	}
+	if !errors.Is(it.Err(), ErrCorruption) {
+		t.Fatalf("got %v, expected corruption", it.Err())
+	}
+	it.Close()
+}
+
+func TestChecksumMetadata(t *testing.T) {
+
+	es := testRandEntries(64)
+
+	lsm := &collection{options: &DefaultCollectionOptions}
+	file := &sstFile{Name: "meta"}
+	file.fd = openMemSSTFileDesc(file.Name)
+	lsm.buildSSTFileMeta(file, es)
+	if err := lsm.packTilesIntoFile(file, nil, lsm.splitToTiles(es), NoCompression); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := file.fd.(*memSSTFileDesc).buf.Bytes()
+
+	// the index block follows the data pages
+	var off int64 = 0
+	for _, dt := range file.Tiles {
+		for _, p := range dt.Pages {
+			if p.Offset+p.Size > off {
+				off = p.Offset + p.Size
+			}
+		}
+	}
+	buf[off+1] ^= 0xFF
+
+	_, err := loadSSTFile(file.fd)
+	fmt.Println(err)
+
+	var ce *CorruptionError
+	if !errors.As(err, &ce) || ce.Offset != off {
+		t.Fatalf("got %v, expected corruption at %d", err, off)
+	}
+
+	// a truncated page
+	p := file.Tiles[0].Pages[0]
+	p.Size = int64(len(buf)) - p.Offset + 1
+	if _, err := loadEntries(file, &p, false); !errors.Is(err, ErrCorruption) {
+		t.Fatalf("got %v, expected corruption", err)
+	}
+}
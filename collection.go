@@ -3,6 +3,7 @@ package lethe
 import (
 	"context"
 	"log"
+	"os"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -11,39 +12,103 @@ import (
 // A collection implements the Collection interface.
 type collection struct {
 
-	// protect data field of collection
-	sync.Mutex
+	// the counters of levels checked by every write for write stalls, updated whenever files on levels change,
+	// the first fields to be 64-bit aligned for atomic operations
+	numLevel1File          int64
+	pendingCompactionBytes int64
+
+	// protect data field of collection, e.g. the structure of levels.
+	// Readers of levels hold the read lock, so that files replaced by compaction are not visible to them.
+	sync.RWMutex
 
 	// config
 	options *CollectionOptions
 
 	// status
-	stats *CollectionStats
+	stats *collectionStats
 
 	// sequentce number of operation on collection
 	seqNum uint64
 
+	// the next number of file under DirPath, e.g. log segments
+	nextFileNum uint64
+
 	// in-memory table
-	curMemTable      *memTable // `Level 0`
+	curMemTable *memTable // `Level 0`
+
+	// writeLock serializes writers, so that the order of sequence numbers,
+	// the order of write-ahead log and the order of memTable are the same
+	writeLock sync.Mutex
+
+	// write-ahead log, nil if DirPath is empty
+	wal *writeAheadLog
+
+	// log of changes of persisted levels, nil if DirPath is empty
+	manifest *manifest
 
 	// persisted levels
 	levels []*level // `Level 1` ~ `Level L-1`
 
-	// cancel func of all daemon goroutine, init in Start() and then used in Close()
+	// cache of pages read from SST-files, nil if BlockCacheSize is not positive
+	cache *blockCache
+
+	// cache of open SST-files, nil if DirPath is empty
+	tables *tableCache
+
+	// the builtin and custom codecs of compression
+	compressors compressors
+
+	// lock file of DirPath, which is held until Close, nil if DirPath is empty
+	dirLock *os.File
+
+	// cancel func of daemon goroutines except the persist daemon, init in newCollection() and then used in Close()
 	daemonCancel context.CancelFunc
+	// daemon goroutines except the persist daemon
+	daemonWG sync.WaitGroup
+	// closed when the persist daemon stops
+	persistDone chan struct{}
+
+	// methods of Collection hold the read lock, and Close sets closed with the write lock,
+	// so that no method is in progress after closed is set
+	closeLock sync.RWMutex
+	closed    bool
+	// set before Close takes closeLock, so that the writes stopped by write stalls in methods leave
+	closing int32
+
+	// writes stopped by write stalls wait on stallCond, which is signaled when persistence or compaction makes progress
+	stallLock sync.Mutex
+	stallCond *sync.Cond
 
 	// persistence
 	// immutable memTable queue
 	immutableQ *immutableQueue
 	// persist trigger
 	persistTrigger chan persistTask
+	// the error of persistence failing after retries, which fails the later writes
+	bgErrLock sync.Mutex
+	bgErr     error
 
 	// compaction
-	// compaction trigger
-	compactTrigger chan compactTask
+	// queue of compaction tasks run by workers
+	compactQ *compactQueue
+	// compactions hold the read lock, and secondary range deletes hold the write lock to exclude them
+	compactLock sync.RWMutex
+	// readers hold the read lock, and secondary range deletes hold the write lock
+	// until the entries are dropped from both memTables and files, so that no reader sees half of them
+	dropLock sync.RWMutex
+	// files being compacted, see pickCompaction
+	compactingLock sync.Mutex
+	compacting     map[*sstFile]bool
+	// serializes adding levels by compactions of the last level
+	addLevelLock sync.Mutex
+
+	// files pinned by readers, and the files retired while pinned which are removed once unpinned
+	fileRefLock   sync.Mutex
+	fileRefs      map[*sstFile]int
+	obsoleteFiles map[*sstFile]bool
 }
 
-func newCollection(options *CollectionOptions) *collection {
+func newCollection(options *CollectionOptions) (*collection, error) {
 	log.Println("new collection")
 
 	lsm := &collection{}
@@ -52,6 +117,18 @@ func newCollection(options *CollectionOptions) *collection {
 	lsm.options = options
 	log.Print(lsm.options)
 
+	var err error
+	if lsm.compressors, err = newCompressors(options); err != nil {
+		return nil, err
+	}
+
+	lsm.stats = &collectionStats{}
+	lsm.cache = newBlockCache(options.BlockCacheSize)
+	lsm.stallCond = sync.NewCond(&lsm.stallLock)
+
+	lsm.fileRefs = map[*sstFile]int{}
+	lsm.obsoleteFiles = map[*sstFile]bool{}
+
 	// create in-memory table, i.e. `Level 0`
 	lsm.curMemTable = newMemTable(lsm.options.SortKeyLess)
 	log.Printf("add an in-memory level-0 (limit %s)\n", beautifulNumByte(lsm.options.MemTableSizeLimit))
@@ -62,39 +139,206 @@ func newCollection(options *CollectionOptions) *collection {
 		lsm.addNewLevel()
 	}
 
+	// time stamp of sequence number
+	lsm.resetSeqNumNForNow()
+
+	if lsm.options.DirPath != "" {
+
+		lsm.tables = newTableCache(lsm.options.DirPath, lsm.options.MaxOpenFiles)
+
+		exists, err := lsm.openDir()
+		if err != nil {
+			return nil, err
+		}
+
+		// no other collection opens DirPath meanwhile
+		lsm.dirLock, err = lockDir(lsm.options.DirPath)
+		if err != nil {
+			return nil, err
+		}
+
+		// rebuild persisted levels from MANIFEST
+		if err := lsm.recoverManifest(exists); err != nil {
+			lsm.releaseFiles()
+			return nil, err
+		}
+
+		// recover mutations which are not persisted from write-ahead log
+		if err := lsm.recoverWAL(); err != nil {
+			lsm.releaseFiles()
+			return nil, err
+		}
+	}
+
 	daemonCtx, daemonCancel := context.WithCancel(context.Background())
 	lsm.daemonCancel = daemonCancel
 
 	// persist daemon
 	lsm.immutableQ = newImmutableQueue()
-	lsm.persistTrigger = make(chan persistTask, lsm.options.persistTriggerBufLen)
-	go lsm.persistDaemon(daemonCtx)
-
-	// compact daemon
-	lsm.compactTrigger = make(chan compactTask, lsm.options.compactTriggerBufLen)
-	go lsm.compactDaemon(daemonCtx)
+	// writes are stopped at MaxImmutableMemTables, and the TTL check may queue a few more
+	persistTriggerBufLen := lsm.options.persistTriggerBufLen
+	if lsm.options.MaxImmutableMemTables > 0 {
+		persistTriggerBufLen += lsm.options.MaxImmutableMemTables
+	}
+	lsm.persistTrigger = make(chan persistTask, persistTriggerBufLen)
+	lsm.persistDone = make(chan struct{})
+	go lsm.persistDaemon()
+
+	// compaction workers
+	lsm.compactQ = newCompactQueue()
+	lsm.compacting = map[*sstFile]bool{}
+	numCompactWorker := lsm.options.MaxBackgroundCompactions
+	if numCompactWorker < 1 {
+		numCompactWorker = 1
+	}
+	for i := 0; i < numCompactWorker; i++ {
+		lsm.startDaemon(daemonCtx, lsm.compactWorker)
+	}
 
 	// time stamp update daemon
-	lsm.resetSeqNumNForNow()
-	go lsm.timeStampUpdateDaemon(daemonCtx)
+	lsm.startDaemon(daemonCtx, lsm.timeStampUpdateDaemon)
+
+	// TTL check daemon
+	lsm.startDaemon(daemonCtx, lsm.ttlDaemon)
+
+	// WAL sync daemon
+	if lsm.wal != nil && lsm.options.WALSyncInterval > 0 {
+		lsm.startDaemon(daemonCtx, lsm.walSyncDaemon)
+	}
+
+	return lsm, nil
+}
 
-	return lsm
+// startDaemon runs a daemon goroutine which stops when ctx is canceled, and Close waits for it.
+func (lsm *collection) startDaemon(ctx context.Context, daemon func(ctx context.Context)) {
+	lsm.daemonWG.Add(1)
+	go func() {
+		defer lsm.daemonWG.Done()
+		daemon(ctx)
+	}()
 }
 
-// Close synchronously stops background goroutines.
+// enter is called at the beginning of every method of Collection, which returns ErrClosed if the collection is closed,
+// otherwise the method calls leave at the end.
+func (lsm *collection) enter() error {
+	lsm.closeLock.RLock()
+	if lsm.closed {
+		lsm.closeLock.RUnlock()
+		return ErrClosed
+	}
+	return nil
+}
+
+func (lsm *collection) leave() {
+	lsm.closeLock.RUnlock()
+}
+
+// Close waits for the methods in progress and the background work to finish, and then releases the resources.
+// The immutable memTables are persisted before Close returns, and so is the current memTable if FlushOnClose is set.
+// Every method of Collection returns ErrClosed afterwards.
 func (lsm *collection) Close() error {
+
+	atomic.StoreInt32(&lsm.closing, 1)
+	lsm.signalWriteStall()
+
+	lsm.closeLock.Lock()
+	if lsm.closed {
+		lsm.closeLock.Unlock()
+		return ErrClosed
+	}
+	lsm.closed = true
+	lsm.closeLock.Unlock()
+
 	log.Println("collection is closing ...")
 
-	// stop all daemon goroutine
+	var firstErr error
+	if lsm.options.FlushOnClose {
+		firstErr = lsm.flushCurMemTable()
+	}
+
+	// The TTL check daemon may queue immutable memTables, so it stops before the persist daemon.
+	// A compaction in progress is finished before the compaction daemon stops.
 	lsm.daemonCancel()
+	lsm.daemonWG.Wait()
+
+	close(lsm.persistTrigger)
+	<-lsm.persistDone
+
+	// the immutable memTables not persisted are replayed from the write-ahead log on the next open
+	if err := lsm.backgroundError(); err != nil && firstErr == nil {
+		firstErr = err
+	}
+
+	if err := lsm.releaseFiles(); err != nil && firstErr == nil {
+		firstErr = err
+	}
 
 	log.Println("collection is closed")
 
-	time.Sleep(time.Second * 1)
+	return firstErr
+}
+
+// flushCurMemTable queues the current memTable to be persisted if it is not empty.
+func (lsm *collection) flushCurMemTable() error {
+	lsm.writeLock.Lock()
+	defer lsm.writeLock.Unlock()
+
+	if reset, imt := lsm.curMemTable.resetIfNotEmpty(); reset {
+		return lsm.pushImmutable(imt)
+	}
 
 	return nil
 }
 
+// releaseFiles closes the write-ahead log, the MANIFEST and SST-files, and then unlocks DirPath.
+// The files retired while pinned are removed, since no reader of them is left.
+func (lsm *collection) releaseFiles() error {
+
+	var firstErr error
+	keep := func(err error) {
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	if lsm.wal != nil {
+		keep(lsm.wal.close())
+	}
+
+	if lsm.manifest != nil {
+		keep(lsm.manifest.close())
+	}
+
+	lsm.RLock()
+	for _, lv := range lsm.levels {
+		lv.Lock()
+		for _, f := range lv.Files {
+			keep(f.fd.Close())
+		}
+		lv.Unlock()
+	}
+	lsm.RUnlock()
+
+	lsm.fileRefLock.Lock()
+	obsoleteFiles := lsm.obsoleteFiles
+	lsm.obsoleteFiles = map[*sstFile]bool{}
+	lsm.fileRefLock.Unlock()
+
+	for f := range obsoleteFiles {
+		keep(lsm.removeSSTFileDesc(f.fd))
+	}
+
+	if lsm.tables != nil {
+		keep(lsm.tables.close())
+	}
+
+	if lsm.dirLock != nil {
+		keep(unlockDir(lsm.dirLock))
+	}
+
+	return firstErr
+}
+
 // time stamp update daemon
 func (lsm *collection) timeStampUpdateDaemon(ctx context.Context) {
 
@@ -120,8 +364,30 @@ func (lsm *collection) timeStampUpdateDaemon(ctx context.Context) {
 func (lsm *collection) resetSeqNumNForNow() {
 	// high 32: now Unix time stamp in seconds
 	// low  32: 0
-	seqNum := ((uint64(time.Now().Unix()) & 0xFFFFFFFF) << 32) | (0 & 0xFFFFFFFF)
-	atomic.StoreUint64(&lsm.seqNum, seqNum)
+	seqNum := ((uint64(lsm.now().Unix()) & 0xFFFFFFFF) << 32) | (0 & 0xFFFFFFFF)
+	lsm.advanceSeqNum(seqNum)
+}
+
+// now returns the current time of collection, which can be replaced in tests.
+func (lsm *collection) now() time.Time {
+	if lsm.options.clock != nil {
+		return lsm.options.clock()
+	}
+	return time.Now()
+}
+
+// advanceSeqNum atomically sets seqNum to the given value if it is greater,
+// sequence numbers never go backwards.
+func (lsm *collection) advanceSeqNum(seqNum uint64) {
+	for {
+		old := atomic.LoadUint64(&lsm.seqNum)
+		if seqNum <= old {
+			return
+		}
+		if atomic.CompareAndSwapUint64(&lsm.seqNum, old, seqNum) {
+			return
+		}
+	}
 }
 
 // getSeqNum atomically increates `lsm.seqNumInc` and returns the new value.
@@ -131,41 +397,75 @@ func (lsm *collection) getSeqNum() uint64 {
 	return atomic.AddUint64(&lsm.seqNum, 1)
 }
 
+// currentSeqNum returns the sequence number of the last operation.
+func (lsm *collection) currentSeqNum() uint64 {
+	return atomic.LoadUint64(&lsm.seqNum)
+}
+
+// newFileNum atomically returns a new unique number of file.
+func (lsm *collection) newFileNum() uint64 {
+	return atomic.AddUint64(&lsm.nextFileNum, 1) - 1
+}
+
 // Get retrieves a value by iterating over all the segments within
 // the collection, if the key is not found a nil val is returned.
 func (lsm *collection) Get(key []byte, readOptions *ReadOptions) ([]byte, error) {
 
+	if err := lsm.enter(); err != nil {
+		return nil, err
+	}
+	defer lsm.leave()
+
 	if len(key) > maxSortKeyBytesLen {
 		return nil, ErrSortKeyTooLarge
 	}
 
+	atomic.AddInt64(&lsm.stats.numGet, 1)
+
+	lsm.dropLock.RLock()
+	defer lsm.dropLock.RUnlock()
+
 	var (
 		found bool
 		value []byte
 		meta  keyMeta
+
+		// the greatest seqNum of range tombstones covering key, which are newer than or as new as the found entry
+		tombSeqNum uint64
 	)
 
 	// look up on current memTable
-	found, value, meta = lsm.curMemTable.Get(key)
+	found, value, meta = lsm.curMemTable.Get(key, &tombSeqNum)
 
 	// look up on immutable memTable queue
 	if !found {
-		found, value, meta = lsm.immutableQ.Get(key)
+		found, value, meta = lsm.immutableQ.Get(key, &tombSeqNum)
 	}
 
 	// loop up on persisted levels
 	if !found {
+		r := lsm.pageReader(readOptions)
+
+		lsm.RLock()
+
+		var err error
 
 		// index i : less(newer) <===> greater(older)
 		for i := 0; i < len(lsm.levels); i++ {
 
-			found, value, meta = lsm.getFromLevel(lsm.levels[i], key)
+			found, value, meta, err = lsm.getFromLevel(lsm.levels[i], key, &tombSeqNum, r)
 
-			if found {
+			if found || err != nil {
 				break
 			}
 			// else keep searching in next older level
 		}
+
+		lsm.RUnlock()
+
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	// key is not found through LSM
@@ -178,12 +478,74 @@ func (lsm *collection) Get(key []byte, readOptions *ReadOptions) ([]byte, error)
 		return nil, ErrKeyNotFound
 	}
 
+	// found the entity but deleted by a range tombstone
+	if meta.seqNum < tombSeqNum {
+		return nil, ErrKeyNotFound
+	}
+
 	return value, nil
 }
 
+// NewIterator returns an Iterator over the key-val entries of the collection.
+func (lsm *collection) NewIterator(readOptions *ReadOptions) (Iterator, error) {
+	if err := lsm.enter(); err != nil {
+		return nil, err
+	}
+	defer lsm.leave()
+
+	return lsm.newIterator(readOptions), nil
+}
+
+// newIterator returns an iterator on the current view of collection.
+func (lsm *collection) newIterator(readOptions *ReadOptions) *iterator {
+	v := lsm.newView()
+	defer v.release()
+
+	return v.newIterator(readOptions)
+}
+
+// Scan calls fn on the key-val entries whose sort key is in [low, high] in order,
+// until fn returns false or limit entries are scanned if limit is positive.
+// A nil low or high leaves the range unbounded on that side.
+func (lsm *collection) Scan(low, high []byte, limit int, fn func(key, value, deleteKey []byte) bool) error {
+
+	if err := lsm.enter(); err != nil {
+		return err
+	}
+	defer lsm.leave()
+
+	if len(low) > maxSortKeyBytesLen || len(high) > maxSortKeyBytesLen {
+		return ErrSortKeyTooLarge
+	}
+
+	readOptions := DefaultReadOptions
+	readOptions.LowerBound = low
+	readOptions.UpperBound = high
+
+	it := lsm.newIterator(&readOptions)
+	defer it.Close()
+
+	n := 0
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		if !fn(it.Key(), it.Value(), it.DeleteKey()) {
+			break
+		}
+		if n++; limit > 0 && n >= limit {
+			break
+		}
+	}
+
+	return it.Err()
+}
+
 // Put creates or updates an key-val entry in the Collection.
 func (lsm *collection) Put(key, value, deleteKey []byte, writeOptions *WriteOptions) error {
 
+	if err := lsm.enter(); err != nil {
+		return err
+	}
+	defer lsm.leave()
+
 	if len(key) > maxSortKeyBytesLen {
 		return ErrSortKeyTooLarge
 	}
@@ -194,59 +556,182 @@ func (lsm *collection) Put(key, value, deleteKey []byte, writeOptions *WriteOpti
 		return ErrValueTooLarge
 	}
 
-	meta := keyMeta{
-		seqNum: lsm.getSeqNum(), // atomic
-		opType: opPut,           // Put
+	e := entry{
+		key:       key,
+		value:     value,
+		deleteKey: deleteKey,
+		meta:      keyMeta{opType: opPut}, // Put
 	}
 
-	// put KV into memTable
-	if err := lsm.curMemTable.Put(key, value, deleteKey, meta); err != nil { // lsm.curMemTable lock
+	return lsm.write([]entry{e}, writeOptions)
+}
+
+// write assigns sequence numbers to entries, appends them to the write-ahead log
+// and then puts them into the current memTable.
+func (lsm *collection) write(es []entry, wo *WriteOptions) error {
+	if err := lsm.stallWrite(); err != nil {
 		return err
 	}
 
-	lsm.resetCurMemTableIfNecessary()
+	_, err := lsm.apply(es, wo)
+	return err
+}
 
-	return nil
+// apply writes entries atomically with contiguous sequence numbers:
+// they are logged as one record and applied to the current memTable under its lock,
+// and a view is taken with writers excluded, so a reader or a view sees all or none of them.
+// If there are secondary range deletes in es, they drop the entries from immutable memTables as well,
+// and apply returns the files written before es, from which the caller drops the entries.
+func (lsm *collection) apply(es []entry, wo *WriteOptions) ([]levelFile, error) {
+	lsm.writeLock.Lock()
+	defer lsm.writeLock.Unlock()
+
+	if err := lsm.backgroundError(); err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < len(es); i++ {
+		es[i].meta.seqNum = lsm.getSeqNum() // atomic
+	}
+
+	// log before apply
+	if lsm.wal != nil && (wo == nil || !wo.NoDurability) {
+		if err := lsm.wal.append(es, wo != nil && wo.Sync); err != nil {
+			return nil, err
+		}
+	}
+
+	dLess := lsm.options.DeleteKeyLess
+
+	numDropped, err := lsm.curMemTable.Apply(es, dLess) // lsm.curMemTable lock
+	if err != nil {
+		return nil, err
+	}
+	lsm.stats.countWrite(es)
+
+	drs := deleteKeyRangesOf(es)
+	if len(drs) == 0 {
+		return nil, lsm.resetCurMemTableIfNecessary()
+	}
+
+	// An immutable memTable is persisted with the queue locked,
+	// so it is either in the queue or in the files returned.
+	lsm.immutableQ.Lock()
+
+	// entries in immutable memTables are older than es
+	for _, imt := range lsm.immutableQ.imts {
+		for _, dr := range drs {
+			numDropped += imt.dropDeleteKeyRange(dr.low, dr.high, dLess)
+		}
+	}
+
+	lfs := lsm.levelFiles()
+
+	lsm.immutableQ.Unlock()
+
+	log.Printf("[delete] drop %d entries of %d delete key ranges from memTables\n", numDropped, len(drs))
+
+	return lfs, lsm.resetCurMemTableIfNecessary()
 }
 
-func (lsm *collection) resetCurMemTableIfNecessary() {
+// resetCurMemTableIfNecessary must be called with writeLock held.
+func (lsm *collection) resetCurMemTableIfNecessary() error {
 
 	// if the size of memTable meets the limit, then trigger a persist
 
 	if reset, imt := lsm.curMemTable.resetIfNecessary(lsm.options.MemTableSizeLimit); reset {
-		// add immutable memTable to queue
-		lsm.immutableQ.push(imt)
+		return lsm.pushImmutable(imt)
+	}
+
+	return nil
+}
+
+// pushImmutable queues a memTable which is reset just now to be persisted.
+// require: writeLock is held
+func (lsm *collection) pushImmutable(imt *immutableMemTable) error {
 
-		// one immutable triggers one persist task
-		lsm.persistTrigger <- persistTask{}
+	// the log segments backing the old memTable now back the immutable memTable
+	if lsm.wal != nil {
+		logNums, err := lsm.wal.rotate(lsm.newFileNum())
+		if err != nil {
+			return err
+		}
+		imt.logNums = logNums
 	}
+
+	// add immutable memTable to queue
+	lsm.immutableQ.push(imt)
+
+	// one immutable triggers one persist task
+	lsm.persistTrigger <- persistTask{}
+
+	return nil
 }
 
 // Del deletes a key-val entry from the Collection.
 func (lsm *collection) Del(key []byte, writeOptions *WriteOptions) error {
 
+	if err := lsm.enter(); err != nil {
+		return err
+	}
+	defer lsm.leave()
+
 	if len(key) > maxSortKeyBytesLen {
 		return ErrSortKeyTooLarge
 	}
 
-	meta := keyMeta{
-		seqNum: lsm.getSeqNum(), // atomic
-		opType: opDel,           // Del, tombstone
+	e := entry{
+		key:  key,
+		meta: keyMeta{opType: opDel}, // Del, tombstone
 	}
 
-	// put tombstone into memTable
-	if err := lsm.curMemTable.Put(key, nil, nil, meta); err != nil { // lsm.curMemTable lock
+	return lsm.write([]entry{e}, writeOptions)
+}
+
+// RangeDel deletes key-val entry ranged [lowKey, highKey]
+func (lsm *collection) RangeDel(lowKey, highKey []byte, writeOptions *WriteOptions) error {
+
+	if err := lsm.enter(); err != nil {
 		return err
 	}
+	defer lsm.leave()
+
+	if len(lowKey) > maxSortKeyBytesLen || len(highKey) > maxSortKeyBytesLen {
+		return ErrSortKeyTooLarge
+	}
 
-	lsm.resetCurMemTableIfNecessary()
+	// empty range
+	if lsm.options.SortKeyLess(highKey, lowKey) {
+		return nil
+	}
 
-	return nil
+	e := entry{
+		key:   lowKey,
+		value: highKey,
+		meta:  keyMeta{opType: opRangeDel}, // RangeDel, range tombstone
+	}
+
+	return lsm.write([]entry{e}, writeOptions)
 }
 
-// RangeDel deletes key-val entry ranged [lowKey, highKey]
-func (lsm *collection) RangeDel(lowKey, highKey []byte, writeOptions *WriteOptions) error {
-	return nil
+// DelByDeleteKeyRange deletes the key-val entries whose delete key is in the range [lowDKey, highDKey].
+func (lsm *collection) DelByDeleteKeyRange(lowDKey, highDKey []byte, writeOptions *WriteOptions) error {
+
+	if err := lsm.enter(); err != nil {
+		return err
+	}
+	defer lsm.leave()
+
+	if len(lowDKey) > maxDeleteKeyBytesLen || len(highDKey) > maxDeleteKeyBytesLen {
+		return ErrDeleteKeyTooLarge
+	}
+
+	// empty range
+	if lsm.options.DeleteKeyLess(highDKey, lowDKey) {
+		return nil
+	}
+
+	return lsm.delByDeleteKeyRange(lowDKey, highDKey, writeOptions)
 }
 
 // Options returns the current options.
@@ -254,10 +739,3 @@ func (lsm *collection) Options() CollectionOptions {
 	// TODO
 	return *lsm.options
 }
-
-// Stats returns stats for this collection.
-func (lsm *collection) Stats() (*CollectionStats, error) {
-	// TODO
-	cs := &CollectionStats{}
-	return cs, nil
-}
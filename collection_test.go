@@ -0,0 +1,98 @@
+package lethe
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestClose(t *testing.T) {
+
+	options := DefaultCollectionOptions
+	options.DirPath = t.TempDir()
+	options.CreateIfMissing = true
+	options.MemTableSizeLimit = 16 << 10 // 16KB
+	options.FlushOnClose = true
+
+	lsm, err := newCollection(&options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the directory is held by the collection
+	if _, err := newCollection(&options); err != ErrLocked {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2000; i++ {
+		key := []byte(fmt.Sprintf("key-%05d", i))
+		if err := lsm.Put(key, key, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	snap, _ := lsm.Snapshot()
+	b, _ := lsm.WriteBatch()
+	b.Put([]byte("key-99999"), nil, nil)
+
+	if err := lsm.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// both the immutable memTables and the current memTable are persisted
+	if n := lsm.immutableQ.size(); n != 0 {
+		t.Fatalf("%d immutable memTables are left", n)
+	}
+	if !lsm.curMemTable.Empty() {
+		t.Fatal("the current memTable is not flushed")
+	}
+
+	// every method returns ErrClosed
+	if err := lsm.Put([]byte("key"), nil, nil, nil); err != ErrClosed {
+		t.Fatal(err)
+	}
+	if err := lsm.Del([]byte("key"), nil); err != ErrClosed {
+		t.Fatal(err)
+	}
+	if _, err := lsm.Get([]byte("key-00001"), nil); err != ErrClosed {
+		t.Fatal(err)
+	}
+	if _, err := lsm.NewIterator(nil); err != ErrClosed {
+		t.Fatal(err)
+	}
+	if _, err := lsm.Snapshot(); err != ErrClosed {
+		t.Fatal(err)
+	}
+	if _, err := snap.Get([]byte("key-00001"), nil); err != ErrClosed {
+		t.Fatal(err)
+	}
+	if err := lsm.ExecuteWriteBatch(b, nil); err != ErrClosed {
+		t.Fatal(err)
+	}
+	if _, err := lsm.Stats(); err != ErrClosed {
+		t.Fatal(err)
+	}
+	if err := lsm.Close(); err != ErrClosed {
+		t.Fatal(err)
+	}
+	snap.Close()
+
+	// the directory is released, and nothing is replayed from write-ahead log
+	options.CreateIfMissing = false
+	lsm, err = newCollection(&options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+
+	if !lsm.curMemTable.Empty() {
+		t.Fatal("mutations are replayed from write-ahead log")
+	}
+
+	for i := 0; i < 2000; i++ {
+		key := []byte(fmt.Sprintf("key-%05d", i))
+		if value, err := lsm.Get(key, nil); err != nil || !bytes.Equal(value, key) {
+			t.Fatalf("key [%s] got [%s] %v", string(key), string(value), err)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package lethe
+
+import (
+	"context"
+	"log"
+	"sync"
+)
+
+// Compactions are run by MaxBackgroundCompactions workers concurrently.
+//
+// Two compactions never share a file, either as an input or as an overlap,
+// so the concurrent compactions merge disjoint key ranges of levels:
+// - the files on `Level 1` overlapping with each other are compacted together
+// - the files on a deeper level are disjoint, and the overlaps of inputs cover the key range of inputs
+// A compaction whose files are taken by others is skipped, and it is triggered again when they finish.
+
+// compactQueue is the queue of compaction tasks shared by workers.
+// A task is queued at most once, so no trigger is dropped and the queue is bounded by the number of levels.
+type compactQueue struct {
+	sync.Mutex
+
+	tasks  []compactTask
+	queued map[compactTask]bool
+
+	// a worker is notified when tasks are queued
+	ready chan struct{}
+}
+
+func newCompactQueue() *compactQueue {
+	return &compactQueue{
+		queued: map[compactTask]bool{},
+		ready:  make(chan struct{}, 1),
+	}
+}
+
+// push queues a task unless the same task is queued.
+// thread-safe
+func (q *compactQueue) push(task compactTask) {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.queued[task] {
+		return
+	}
+	q.queued[task] = true
+	q.tasks = append(q.tasks, task)
+
+	q.notify()
+}
+
+// pop takes the head of queue, and notifies another worker if tasks are left.
+// thread-safe
+func (q *compactQueue) pop() (task compactTask, ok bool) {
+	q.Lock()
+	defer q.Unlock()
+
+	if len(q.tasks) == 0 {
+		return task, false
+	}
+
+	task = q.tasks[0]
+	q.tasks = q.tasks[1:]
+	delete(q.queued, task)
+
+	if len(q.tasks) > 0 {
+		q.notify()
+	}
+
+	return task, true
+}
+
+// size returns the number of tasks queued.
+// thread-safe
+func (q *compactQueue) size() int {
+	q.Lock()
+	defer q.Unlock()
+
+	return len(q.tasks)
+}
+
+// notify must be called with the lock held.
+func (q *compactQueue) notify() {
+	select {
+	case q.ready <- struct{}{}:
+	default: // a worker has been notified
+	}
+}
+
+// compactWorker runs the queued compaction tasks until ctx is canceled,
+// a compaction in progress is finished before it stops.
+func (lsm *collection) compactWorker(ctx context.Context) {
+	for {
+		select {
+		case <-lsm.compactQ.ready:
+			{
+				for ctx.Err() == nil {
+					task, ok := lsm.compactQ.pop()
+					if !ok {
+						break
+					}
+					if err := lsm.compact(ctx, task); err != nil {
+						log.Printf("[compact] %v: %v\n", task, err)
+					}
+				}
+			}
+		case <-ctx.Done():
+			{
+				log.Println("stop [compaction worker]")
+				return
+			}
+		}
+	}
+}
+
+// -----------------------------------------------------------------------------
+// files being compacted
+// -----------------------------------------------------------------------------
+
+// markCompacting marks the files of c as being compacted.
+// require: compactingLock is held
+func (lsm *collection) markCompacting(c *compaction) {
+	for _, files := range [][]*sstFile{c.inputs, c.overlaps} {
+		for _, f := range files {
+			lsm.compacting[f] = true
+		}
+	}
+}
+
+// isCompacting returns whether any file of c is being compacted.
+// require: compactingLock is held
+func (lsm *collection) isCompacting(c *compaction) bool {
+	for _, files := range [][]*sstFile{c.inputs, c.overlaps} {
+		for _, f := range files {
+			if lsm.compacting[f] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// releaseCompaction unmarks the files of c, after they are replaced on levels or the compaction fails.
+func (lsm *collection) releaseCompaction(c *compaction) {
+	lsm.compactingLock.Lock()
+	defer lsm.compactingLock.Unlock()
+
+	for _, files := range [][]*sstFile{c.inputs, c.overlaps} {
+		for _, f := range files {
+			delete(lsm.compacting, f)
+		}
+	}
+}
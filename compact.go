@@ -1,9 +1,15 @@
 package lethe
 
 import (
+	"bytes"
+	"container/heap"
 	"context"
 	"errors"
+	"fmt"
 	"log"
+	"sort"
+	"sync"
+	"time"
 )
 
 const (
@@ -18,30 +24,23 @@ type compactTask struct {
 }
 
 func (task compactTask) String() string {
-	// TOOD
-	return "todo"
-}
-
-func (lsm *collection) compactDaemon(ctx context.Context) {
-	for {
-
-		select {
-		case task := <-lsm.compactTrigger:
-			{
-				// TODO
-				lsm.compact(ctx, task)
-			}
-		case <-ctx.Done():
-			{
-				log.Println("stop [compaction daemon]")
-				return
-			}
-		}
-
+	name := "unknown"
+	switch task.compactType {
+	case enumCompactTypeSO:
+		name = "SO"
+	case enumCompactTypeSD:
+		name = "SD"
+	case enumCompactTypeDD:
+		name = "DD"
 	}
+	return fmt.Sprintf("%s compaction on level-%d", name, task.levelIndex+1)
 }
 
 func (lsm *collection) compact(ctx context.Context, task compactTask) error {
+	// compactions run concurrently, and secondary range deletes exclude them
+	lsm.compactLock.RLock()
+	defer lsm.compactLock.RUnlock()
+
 	var err error = nil
 
 	switch task.compactType {
@@ -63,36 +62,741 @@ func (lsm *collection) compact(ctx context.Context, task compactTask) error {
 
 // compactSO uses Saturation-driven trigger and Overlap-driven file selection compaction policy.
 func (lsm *collection) compactSO(task compactTask) error {
-	// // assert( 0 <= task.levelIndex < len(lsm.levels) )
 
-	// // if the last level needs compaction, adds a new level to last
-	// if task.levelIndex == len(lsm.levels)-1 {
-	// 	lsm.addNewLevel()
-	// }
-
-	// curLevel := lsm.levels[task.levelIndex]
-	// nextLevel := lsm.levels[task.levelIndex+1]
-
-	// target, overlaps, isPresent := lsm.findMinOverlap(curLevel, nextLevel)
+	// the level may have been compacted by an earlier task
+	if !lsm.isLevelSaturated(task.levelIndex) {
+		return nil
+	}
 
-	// mergedFile := lsm.mergeSSTFile(overlaps..., target)
+	// if the last level needs compaction, adds a new level to last
+	if err := lsm.ensureNextLevel(task.levelIndex); err != nil {
+		return err
+	}
 
-	// lsm.replaceSSTFileOnLevel(curLevel, target, nil)
-	// lsm.replaceSSTFileOnLevel(nextLevel, overlaps, mergedFile)
+	c := lsm.pickCompaction(task.levelIndex, func(x, y *compaction) bool {
+		// pick a file with the smallest overlap with the next level
+		if x.overlapBytes != y.overlapBytes {
+			return x.overlapBytes < y.overlapBytes
+		}
+		// a tie is broken by picking the file with the most tombstones
+		return x.numDelete > y.numDelete
+	})
 
-	// // this is all compactSO...
+	if c == nil {
+		return nil
+	}
 
-	return nil
+	return lsm.runCompaction(task, c)
 }
 
 // compactSD uses Saturation-driven trigger and Delete-driven file selection compaction policy.
 func (lsm *collection) compactSD(task compactTask) error {
-	// TODO
-	return nil
+
+	// the level may have been compacted by an earlier task
+	if !lsm.isLevelSaturated(task.levelIndex) {
+		return nil
+	}
+
+	// if the last level needs compaction, adds a new level to last
+	if err := lsm.ensureNextLevel(task.levelIndex); err != nil {
+		return err
+	}
+
+	c := lsm.pickCompaction(task.levelIndex, func(x, y *compaction) bool {
+		// pick a file with the highest estimated number of invalidated entries
+		if x.numInvalidated != y.numInvalidated {
+			return x.numInvalidated > y.numInvalidated
+		}
+		// a tie is broken by picking the file that contains the oldest tombstone
+		return olderTomb(x.ageOldestTomb, y.ageOldestTomb)
+	})
+
+	if c == nil {
+		return nil
+	}
+
+	return lsm.runCompaction(task, c)
+}
+
+// olderTomb returns whether the tombstone of age x is older than that of age y,
+// where age 0 means no tombstone.
+func olderTomb(x, y uint32) bool {
+	if x == 0 {
+		return false
+	}
+	return y == 0 || x < y
 }
 
 // compactDD uses Delete-driven trigger and Delete-driven file selection compaction policy.
 func (lsm *collection) compactDD(task compactTask) error {
-	// TODO
+
+	_, deadlines := lsm.tombDeadlines(lsm.now())
+	if task.levelIndex >= len(deadlines) {
+		return nil
+	}
+
+	// the expired tombstones may have been compacted by an earlier task
+	if !olderTomb(lsm.levelOldestTomb(task.levelIndex), deadlines[task.levelIndex]) {
+		return nil
+	}
+
+	// tombstones on the last level are dropped by compacting it into a new level
+	if err := lsm.ensureNextLevel(task.levelIndex); err != nil {
+		return err
+	}
+
+	// pick a file that contains the oldest tombstone
+	c := lsm.pickCompaction(task.levelIndex, func(x, y *compaction) bool {
+		return olderTomb(x.ageOldestTomb, y.ageOldestTomb)
+	})
+
+	if c == nil {
+		return nil
+	}
+
+	return lsm.runCompaction(task, c)
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+// trigger
+// ----------------------------------------------------------------------------------------------------------------
+
+// isLevelSaturated returns whether the size of level exceeds its size limit.
+func (lsm *collection) isLevelSaturated(levelIndex int) bool {
+	lsm.RLock()
+	defer lsm.RUnlock()
+
+	if levelIndex >= len(lsm.levels) {
+		return false
+	}
+
+	lv := lsm.levels[levelIndex]
+
+	// the files on `Level 1` overlap with each other, so they are compacted before writes are stalled by them
+	if levelIndex == 0 {
+		trigger := lsm.options.Level1SlowdownWritesTrigger
+		if trigger <= 0 {
+			trigger = lsm.options.Level1StopWritesTrigger
+		}
+
+		lv.Lock()
+		numFile := len(lv.Files)
+		lv.Unlock()
+
+		if trigger > 0 && numFile >= trigger {
+			return true
+		}
+	}
+
+	return lv.size() > lv.SizeLimit
+}
+
+// maybeCompact triggers a saturation-driven compaction if the level is saturated.
+// It never blocks, a dropped task will be triggered again by the next change of the level.
+func (lsm *collection) maybeCompact(levelIndex int) {
+
+	if !lsm.isLevelSaturated(levelIndex) {
+		return
+	}
+
+	task := compactTask{
+		compactType: enumCompactTypeSO,
+		levelIndex:  levelIndex,
+	}
+	if lsm.options.CompactionPolicy == CompactionPolicySD {
+		task.compactType = enumCompactTypeSD
+	}
+
+	lsm.compactQ.push(task)
+}
+
+// maybeCompactLevels triggers compactions of all the saturated levels.
+func (lsm *collection) maybeCompactLevels() {
+	lsm.RLock()
+	numLevel := len(lsm.levels)
+	lsm.RUnlock()
+
+	for i := 0; i < numLevel; i++ {
+		lsm.maybeCompact(i)
+	}
+}
+
+// ttlDaemon periodically checks tombstones against the TTLs of levels.
+func (lsm *collection) ttlDaemon(ctx context.Context) {
+
+	ticker := time.NewTicker(lsm.options.ttlCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			{
+				if _, err := lsm.checkTTL(); err != nil {
+					log.Printf("[compact] check TTL: %v\n", err)
+				}
+			}
+		case <-ctx.Done():
+			{
+				log.Println("stop [TTL check daemon]")
+				return
+			}
+		}
+	}
+}
+
+// checkTTL triggers delete-driven compactions of levels which contain expired tombstones,
+// and persists the current memTable if it contains an expired tombstone.
+// It returns whether an expired tombstone is found.
+// The task of the level with the oldest tombstone is triggered first, a tie is broken by the smallest level.
+func (lsm *collection) checkTTL() (bool, error) {
+
+	memDeadline, deadlines := lsm.tombDeadlines(lsm.now())
+
+	expired := false
+
+	// `in-memory Level 0`
+	lsm.writeLock.Lock()
+	if reset, imt := lsm.curMemTable.resetIfTombExpired(memDeadline); reset {
+		expired = true
+		if err := lsm.pushImmutable(imt); err != nil {
+			lsm.writeLock.Unlock()
+			return expired, err
+		}
+	}
+	lsm.writeLock.Unlock()
+
+	// persisted levels
+	tasks := []compactTask{}
+	ages := []uint32{}
+
+	for i := 0; i < len(deadlines); i++ {
+		if oldest := lsm.levelOldestTomb(i); olderTomb(oldest, deadlines[i]) {
+			tasks = append(tasks, compactTask{compactType: enumCompactTypeDD, levelIndex: i})
+			ages = append(ages, oldest)
+		}
+	}
+
+	// tasks are sorted on level, so the stable sort keeps the smallest level first in a tie
+	sort.Stable(byTombAge{tasks, ages})
+
+	for _, task := range tasks {
+		expired = true
+		lsm.compactQ.push(task)
+	}
+
+	return expired, nil
+}
+
+type byTombAge struct {
+	tasks []compactTask
+	ages  []uint32
+}
+
+func (s byTombAge) Len() int           { return len(s.tasks) }
+func (s byTombAge) Less(i, j int) bool { return s.ages[i] < s.ages[j] }
+func (s byTombAge) Swap(i, j int) {
+	s.tasks[i], s.tasks[j] = s.tasks[j], s.tasks[i]
+	s.ages[i], s.ages[j] = s.ages[j], s.ages[i]
+}
+
+// ensureNextLevel adds a new level to the bottom of LSM if levelIndex is the last level.
+func (lsm *collection) ensureNextLevel(levelIndex int) error {
+	// concurrent compactions of the last level add one level
+	lsm.addLevelLock.Lock()
+	defer lsm.addLevelLock.Unlock()
+
+	lsm.RLock()
+	isLast := levelIndex == len(lsm.levels)-1
+	lsm.RUnlock()
+
+	if isLast {
+		return lsm.addNewLevel()
+	}
+
+	return nil
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+// file selection
+// ----------------------------------------------------------------------------------------------------------------
+
+// compaction merges inputs on a level and overlaps on the next level into the next level.
+type compaction struct {
+	levelIndex int
+
+	inputs   []*sstFile
+	overlaps []*sstFile
+
+	// the range of inputs on sort key
+	sortKeyMin []byte
+	sortKeyMax []byte
+
+	// statistics for file selection
+	overlapBytes   int64
+	numDelete      int
+	numInvalidated int
+	ageOldestTomb  uint32
+}
+
+// pickCompaction returns the best compaction of level in terms of better,
+// one candidate for each file of level, whose files are not being compacted by others.
+// The files of the compaction returned are marked as being compacted until releaseCompaction.
+// It returns nil if there is no such compaction.
+func (lsm *collection) pickCompaction(levelIndex int, better func(x, y *compaction) bool) *compaction {
+	// The other compactions replace their files before they release them,
+	// so the files not being compacted stay on levels meanwhile.
+	lsm.compactingLock.Lock()
+	defer lsm.compactingLock.Unlock()
+
+	lsm.RLock()
+	defer lsm.RUnlock()
+
+	lv := lsm.levels[levelIndex]
+	nextLevel := lsm.levels[levelIndex+1]
+
+	lv.Lock()
+	files := append([]*sstFile{}, lv.Files...)
+	lv.Unlock()
+
+	var best *compaction
+
+	for _, f := range files {
+		c := lsm.newCompaction(levelIndex, files, f, nextLevel)
+		if lsm.isCompacting(c) {
+			continue
+		}
+		if best == nil || better(c, best) {
+			best = c
+		}
+	}
+
+	if best != nil {
+		lsm.markCompacting(best)
+	}
+
+	return best
+}
+
+// newCompaction returns the compaction of target file on a level.
+func (lsm *collection) newCompaction(levelIndex int, files []*sstFile, target *sstFile, nextLevel *level) *compaction {
+
+	less := lsm.options.SortKeyLess
+
+	c := &compaction{}
+	c.levelIndex = levelIndex
+	c.inputs = []*sstFile{target}
+	c.sortKeyMin = target.SortKeyMin
+	c.sortKeyMax = target.SortKeyMax
+
+	// Files on `Level 1` are flushed memTables which overlap with each other.
+	// A key in older files would shadow the newer version moved to the next level,
+	// so all the files overlapping with inputs are compacted together.
+	if levelIndex == 0 {
+		for expanded := true; expanded; {
+			expanded = false
+
+			for _, f := range files {
+				if containsFile(c.inputs, f) || !isOverlapRange(less, c.sortKeyMin, c.sortKeyMax, f.SortKeyMin, f.SortKeyMax) {
+					continue
+				}
+
+				c.inputs = append(c.inputs, f)
+				if less(f.SortKeyMin, c.sortKeyMin) {
+					c.sortKeyMin = f.SortKeyMin
+				}
+				if less(c.sortKeyMax, f.SortKeyMax) {
+					c.sortKeyMax = f.SortKeyMax
+				}
+				expanded = true
+			}
+		}
+	}
+
+	c.overlaps = lsm.findOverlapRange(nextLevel, c.sortKeyMin, c.sortKeyMax)
+
+	for _, f := range c.inputs {
+		c.numDelete += f.NumDelete
+		c.numInvalidated += f.NumInvalidated
+		if olderTomb(f.AgeOldestTomb, c.ageOldestTomb) {
+			c.ageOldestTomb = f.AgeOldestTomb
+		}
+	}
+	for _, f := range c.overlaps {
+		c.overlapBytes += f.Size
+	}
+
+	return c
+}
+
+func containsFile(files []*sstFile, file *sstFile) bool {
+	for _, f := range files {
+		if f == file {
+			return true
+		}
+	}
+	return false
+}
+
+func isOverlapRange(less func(s, t []byte) bool, min1, max1, min2, max2 []byte) bool {
+	return !(less(max1, min2) || less(max2, min1))
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+// merge
+// ----------------------------------------------------------------------------------------------------------------
+
+// runCompaction merges the files of compaction and replaces them with the merged files,
+// and then releases the files of compaction.
+func (lsm *collection) runCompaction(task compactTask, c *compaction) error {
+
+	err := lsm.mergeCompaction(task, c)
+
+	// the files of compaction have been replaced on levels, or they are left as they are
+	lsm.releaseCompaction(c)
+
+	if err != nil {
+		return err
+	}
+
+	// the merged files may saturate the next level,
+	// and the compactions skipped for the files of compaction can run now
+	lsm.maybeCompactLevels()
+
+	return nil
+}
+
+// mergeCompaction merges the files of compaction by subcompactions, and replaces them with the merged files.
+func (lsm *collection) mergeCompaction(task compactTask, c *compaction) error {
+
+	log.Printf("[compact] %v, %d input files, %d overlap files\n", task, len(c.inputs), len(c.overlaps))
+
+	start := time.Now()
+
+	lsm.RLock()
+	isLastLevel := c.levelIndex+1 == len(lsm.levels)-1
+	lsm.RUnlock()
+
+	sources := [][]entry{}
+	rts := []rangeTombstone{}
+	for _, files := range [][]*sstFile{c.inputs, c.overlaps} {
+		for _, f := range files {
+			es, err := lsm.loadFileEntries(f)
+			if err != nil {
+				return err
+			}
+			sources = append(sources, es)
+			rts = append(rts, f.RangeDels...)
+		}
+	}
+
+	bounds := lsm.subcompactionBounds(c)
+
+	// subcompaction i merges the entries in [bounds[i-1], bounds[i]), where nil is unbounded
+	outputs := make([][]*sstFile, len(bounds)+1)
+	numMerged := make([]int, len(bounds)+1)
+	errs := make([]error, len(bounds)+1)
+
+	run := func(i int) {
+		var low, high []byte
+		if i > 0 {
+			low = bounds[i-1]
+		}
+		if i < len(bounds) {
+			high = bounds[i]
+		}
+		outputs[i], numMerged[i], errs[i] = lsm.runSubcompaction(c.levelIndex, sources, rts, low, high, isLastLevel)
+	}
+
+	if len(bounds) == 0 {
+		run(0)
+	} else {
+		var wg sync.WaitGroup
+		for i := 0; i <= len(bounds); i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				run(i)
+			}(i)
+		}
+		wg.Wait()
+	}
+
+	merged := []*sstFile{}
+	total := 0
+	var err error
+	for i := range outputs {
+		merged = append(merged, outputs[i]...)
+		total += numMerged[i]
+		if errs[i] != nil && err == nil {
+			err = errs[i]
+		}
+	}
+
+	if err == nil {
+		err = lsm.replaceFilesOnLevels(c.levelIndex, c.inputs, c.overlaps, merged)
+	}
+	if err != nil {
+		for _, f := range merged {
+			lsm.removeSSTFileDesc(f.fd)
+		}
+		return err
+	}
+
+	lsm.signalWriteStall()
+	lsm.stats.countCompaction(task, start, append(append([]*sstFile{}, c.inputs...), c.overlaps...), merged)
+
+	// no new reader can reach the replaced files now
+	for _, files := range [][]*sstFile{c.inputs, c.overlaps} {
+		for _, f := range files {
+			if err := lsm.retireSSTFile(f); err != nil {
+				log.Printf("[compact] remove SST-file [%s]: %v\n", f.Name, err)
+			}
+		}
+	}
+
+	log.Printf("[compact] %v done, %d entries into %d files by %d subcompactions\n", task, total, len(merged), len(bounds)+1)
+
 	return nil
 }
+
+// subcompactionBounds splits the key range of compaction into at most MaxSubcompactions ranges,
+// and returns the start keys of the ranges but the first, which are picked from the smallest keys of files.
+func (lsm *collection) subcompactionBounds(c *compaction) [][]byte {
+
+	n := lsm.options.MaxSubcompactions
+	if n <= 1 {
+		return nil
+	}
+
+	less := lsm.options.SortKeyLess
+
+	keys := [][]byte{}
+	for _, files := range [][]*sstFile{c.inputs, c.overlaps} {
+		for _, f := range files {
+			keys = append(keys, f.SortKeyMin)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return less(keys[i], keys[j]) })
+
+	// the smallest key starts the first range
+	candidates := [][]byte{}
+	for i := 1; i < len(keys); i++ {
+		if less(keys[i-1], keys[i]) {
+			candidates = append(candidates, keys[i])
+		}
+	}
+
+	if len(candidates) < n {
+		return candidates
+	}
+
+	// evenly spaced candidates
+	bounds := [][]byte{}
+	for i := 1; i < n; i++ {
+		bounds = append(bounds, candidates[i*len(candidates)/n])
+	}
+
+	return bounds
+}
+
+// runSubcompaction merges the entries of sources in [low, high), where nil is unbounded,
+// and builds the SST-files for the next level of levelIndex.
+// All the range tombstones of compaction delete the entries merged,
+// and each of them is clipped to [low, high) for the files built.
+func (lsm *collection) runSubcompaction(levelIndex int, sources [][]entry, rts []rangeTombstone, low, high []byte, isLastLevel bool) ([]*sstFile, int, error) {
+
+	less := lsm.options.SortKeyLess
+
+	subSources := make([][]entry, 0, len(sources))
+	for _, es := range sources {
+		i, j := 0, len(es)
+		if low != nil {
+			i = sort.Search(len(es), func(k int) bool { return !less(es[k].key, low) })
+		}
+		if high != nil {
+			j = sort.Search(len(es), func(k int) bool { return !less(es[k].key, high) })
+		}
+		if i < j {
+			subSources = append(subSources, es[i:j])
+		}
+	}
+
+	merged := mergeEntries(subSources, less)
+
+	// the fences of inputs cover their range tombstones,
+	// so the older entries deleted by range tombstones are merged together.
+	merged = dropCoveredEntries(merged, rts, less)
+
+	// tombstones are dropped only when merging into the last level,
+	// because there is no older entry below the last level to be deleted.
+	subRTs := []rangeTombstone{}
+	if isLastLevel {
+		kept := merged[:0]
+		for i := 0; i < len(merged); i++ {
+			if merged[i].meta.opType != opDel {
+				kept = append(kept, merged[i])
+			}
+		}
+		merged = kept
+	} else {
+		for _, rt := range rts {
+			if (low == nil || !less(rt.End, low)) && (high == nil || less(rt.Start, high)) {
+				subRTs = append(subRTs, rt)
+			}
+		}
+	}
+
+	outputs, err := lsm.buildSSTFiles(levelIndex+1, merged, subRTs, low, high)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return outputs, len(merged), nil
+}
+
+// buildSSTFiles builds SST-files for the level of levelIndex from entries sorted on sort key and range tombstones,
+// each of which holds about MemTableSizeLimit bytes of entries.
+// Range tombstones are clipped to [low, high), where nil is unbounded,
+// and each file takes the part of them from its first key to the first key of next file,
+// so the fences of files cover their range tombstones without overlapping each other,
+// except the key shared by adjacent files, which is covered by the both of them.
+func (lsm *collection) buildSSTFiles(levelIndex int, es []entry, rts []rangeTombstone, low, high []byte) ([]*sstFile, error) {
+
+	less := lsm.options.SortKeyLess
+
+	// split entries
+	chunks := [][]entry{}
+	for start := 0; start < len(es); {
+
+		end := start
+		size := 0
+		for end < len(es) && size < lsm.options.MemTableSizeLimit {
+			size += persistFormatLen(&es[end])
+			end++
+		}
+
+		chunks = append(chunks, es[start:end])
+		start = end
+	}
+
+	// a file only of range tombstones
+	if len(chunks) == 0 && len(rts) > 0 {
+		chunks = append(chunks, nil)
+	}
+
+	// clip range tombstones
+	chunkRTs := make([][]rangeTombstone, len(chunks))
+	for i := 0; i < len(chunks); i++ {
+
+		// the range of chunk is [min, max), where nil is unbounded
+		min, max := low, high
+		if i > 0 {
+			min = chunks[i][0].key
+		}
+		if i < len(chunks)-1 {
+			max = chunks[i+1][0].key
+		}
+
+		for _, rt := range rts {
+			if (min != nil && less(rt.End, min)) || (max != nil && !less(rt.Start, max)) {
+				continue
+			}
+
+			clipped := rt
+			if min != nil && less(clipped.Start, min) {
+				clipped.Start = min
+			}
+			if max != nil && less(max, clipped.End) {
+				clipped.End = max
+			}
+			chunkRTs[i] = append(chunkRTs[i], clipped)
+		}
+	}
+
+	files := []*sstFile{}
+
+	for i := 0; i < len(chunks); i++ {
+
+		file, err := lsm.buildSSTFile(sstFileName(lsm.newFileNum()), levelIndex, chunks[i], chunkRTs[i])
+		if err != nil {
+			for _, f := range files {
+				lsm.removeSSTFileDesc(f.fd)
+			}
+			return nil, err
+		}
+
+		files = append(files, file)
+	}
+
+	return files, nil
+}
+
+// mergeSource is a cursor on entries sorted on sort key.
+type mergeSource struct {
+	es  []entry
+	pos int
+}
+
+type mergeHeap struct {
+	sources []*mergeSource
+	less    func(s, t []byte) bool
+}
+
+func (h *mergeHeap) Len() int { return len(h.sources) }
+
+func (h *mergeHeap) Less(i, j int) bool {
+	x, y := h.sources[i], h.sources[j]
+	kx, ky := x.es[x.pos].key, y.es[y.pos].key
+	if bytes.Equal(kx, ky) {
+		return x.es[x.pos].meta.seqNum > y.es[y.pos].meta.seqNum
+	}
+	return h.less(kx, ky)
+}
+
+func (h *mergeHeap) Swap(i, j int) { h.sources[i], h.sources[j] = h.sources[j], h.sources[i] }
+
+func (h *mergeHeap) Push(x interface{}) { h.sources = append(h.sources, x.(*mergeSource)) }
+
+func (h *mergeHeap) Pop() interface{} {
+	n := len(h.sources)
+	x := h.sources[n-1]
+	h.sources = h.sources[:n-1]
+	return x
+}
+
+// mergeEntries k-way merges sources sorted on sort key into entries sorted on sort key.
+// For the same key in several sources, only the entry with the greatest seqNum is kept.
+func mergeEntries(sources [][]entry, less func(s, t []byte) bool) []entry {
+
+	h := &mergeHeap{less: less}
+
+	total := 0
+	for _, es := range sources {
+		if len(es) > 0 {
+			h.sources = append(h.sources, &mergeSource{es: es})
+		}
+		total += len(es)
+	}
+	heap.Init(h)
+
+	merged := make([]entry, 0, total)
+
+	for h.Len() > 0 {
+		top := h.sources[0]
+		e := top.es[top.pos]
+
+		// the first one of the same key is the newest
+		if len(merged) == 0 || !bytes.Equal(merged[len(merged)-1].key, e.key) {
+			merged = append(merged, e)
+		}
+
+		top.pos++
+		if top.pos == len(top.es) {
+			heap.Pop(h)
+		} else {
+			heap.Fix(h, 0)
+		}
+	}
+
+	return merged
+}
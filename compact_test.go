@@ -0,0 +1,603 @@
+package lethe
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testWaitCompacted waits until every immutable memTable has been persisted
+// and no level except the last one is saturated.
+func testWaitCompacted(t *testing.T, lsm *collection) {
+	testWaitPersisted(t, lsm)
+
+	for i := 0; i < 3000; i++ {
+		lsm.compactLock.Lock()
+		lsm.compactLock.Unlock()
+
+		saturated := false
+		lsm.RLock()
+		numLevel := len(lsm.levels)
+		lsm.RUnlock()
+		for j := 0; j < numLevel-1; j++ {
+			if lsm.isLevelSaturated(j) {
+				saturated = true
+			}
+		}
+
+		if !saturated && lsm.compactQ.size() == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("levels are not compacted")
+}
+
+func TestMergeEntries(t *testing.T) {
+	newer := []entry{
+		{key: []byte("a"), value: []byte("a2"), meta: keyMeta{seqNum: 2, opType: opPut}},
+		{key: []byte("c"), meta: keyMeta{seqNum: 3, opType: opDel}},
+	}
+	older := []entry{
+		{key: []byte("a"), value: []byte("a1"), meta: keyMeta{seqNum: 1, opType: opPut}},
+		{key: []byte("b"), value: []byte("b1"), meta: keyMeta{seqNum: 1, opType: opPut}},
+		{key: []byte("c"), value: []byte("c1"), meta: keyMeta{seqNum: 1, opType: opPut}},
+	}
+
+	merged := mergeEntries([][]entry{older, newer}, DefaultCollectionOptions.SortKeyLess)
+
+	expected := []entry{newer[0], older[1], newer[1]}
+	if !testEntriesEqual(merged, expected) {
+		t.Fatalf("got %v", merged)
+	}
+}
+
+func TestCompactSO(t *testing.T) {
+
+	options := DefaultCollectionOptions
+	options.DirPath = t.TempDir()
+	options.CreateIfMissing = true
+	options.MemTableSizeLimit = 16 << 10 // 16KB
+	options.LevelSizeRatio = 4
+	options.NumInitialLevel = 3
+
+	lsm, err := newCollection(&options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+
+	model := map[string][]byte{}
+
+	for i := 0; i < 30000; i++ {
+		key := []byte(fmt.Sprintf("key-%05d", rand.Intn(5000)))
+
+		if rand.Intn(4) == 0 {
+			if err := lsm.Del(key, nil); err != nil {
+				t.Fatal(err)
+			}
+			delete(model, string(key))
+			continue
+		}
+
+		value := []byte(fmt.Sprintf("value-%d", i))
+		if err := lsm.Put(key, value, key, nil); err != nil {
+			t.Fatal(err)
+		}
+		model[string(key)] = value
+	}
+
+	testWaitCompacted(t, lsm)
+
+	fmt.Println("files on levels", testNumFiles(lsm))
+	if testNumFiles(lsm)[1] == 0 {
+		t.Fatal("nothing is compacted")
+	}
+
+	for i := 0; i < 5000; i++ {
+		key := []byte(fmt.Sprintf("key-%05d", i))
+		value, err := lsm.Get(key, nil)
+
+		expected, ok := model[string(key)]
+		if !ok {
+			if err != ErrKeyNotFound {
+				t.Fatalf("key [%s] expected deleted, got [%s] %v", string(key), string(value), err)
+			}
+			continue
+		}
+		if err != nil || !bytes.Equal(value, expected) {
+			t.Fatalf("key [%s] got [%s] %v, expected [%s]", string(key), string(value), err, string(expected))
+		}
+	}
+
+	// no tombstone on the last level
+	last := lsm.levels[len(lsm.levels)-1]
+	for _, f := range last.Files {
+		if f.NumDelete != 0 {
+			t.Fatalf("SST-file [%s] on the last level has %d tombstones", f.Name, f.NumDelete)
+		}
+	}
+}
+
+func TestEstimateInvalidated(t *testing.T) {
+
+	options := DefaultCollectionOptions
+	options.NumInitialLevel = 3
+
+	lsm, err := newCollection(&options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+
+	// keys on the lower level
+	older := []entry{}
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("key-%05d", i*2))
+		older = append(older, entry{key: key, value: key, deleteKey: key, meta: keyMeta{seqNum: uint64(i), opType: opPut}})
+	}
+	file, err := lsm.buildSSTFile("lower", 1, older, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lsm.levels[1].Files = append(lsm.levels[1].Files, file)
+
+	// tombstones of the existing keys, and of keys out of the fences
+	tombs := []entry{}
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key-%05d", i*2))
+		tombs = append(tombs, entry{key: key, deleteKey: key, meta: keyMeta{seqNum: uint64(2000 + i), opType: opDel}})
+	}
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("zzz-%05d", i))
+		tombs = append(tombs, entry{key: key, deleteKey: key, meta: keyMeta{seqNum: uint64(3000 + i), opType: opDel}})
+	}
+
+	b := lsm.estimateInvalidated(0, tombs, nil)
+	fmt.Println("estimated invalidated entries", b)
+	if b != 100 {
+		t.Fatalf("estimated %d invalidated entries, expected 100", b)
+	}
+
+	// nothing below the last level
+	if b := lsm.estimateInvalidated(1, tombs, nil); b != 0 {
+		t.Fatalf("estimated %d invalidated entries below the last level", b)
+	}
+}
+
+func TestCompactSD(t *testing.T) {
+
+	options := DefaultCollectionOptions
+	options.DirPath = t.TempDir()
+	options.CreateIfMissing = true
+	options.MemTableSizeLimit = 16 << 10 // 16KB
+	options.LevelSizeRatio = 4
+	options.NumInitialLevel = 3
+	options.CompactionPolicy = CompactionPolicySD
+
+	lsm, err := newCollection(&options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	model := map[string][]byte{}
+
+	for i := 0; i < 30000; i++ {
+		key := []byte(fmt.Sprintf("key-%05d", rand.Intn(5000)))
+
+		if rand.Intn(4) == 0 {
+			if err := lsm.Del(key, nil); err != nil {
+				t.Fatal(err)
+			}
+			delete(model, string(key))
+			continue
+		}
+
+		value := []byte(fmt.Sprintf("value-%d", i))
+		if err := lsm.Put(key, value, key, nil); err != nil {
+			t.Fatal(err)
+		}
+		model[string(key)] = value
+	}
+
+	testWaitCompacted(t, lsm)
+
+	fmt.Println("files on levels", testNumFiles(lsm))
+	if testNumFiles(lsm)[1] == 0 {
+		t.Fatal("nothing is compacted")
+	}
+
+	// the estimates are persisted with SST-files
+	numInvalidated := map[string]int{}
+	for _, lv := range lsm.levels {
+		for _, f := range lv.Files {
+			numInvalidated[f.Name] = f.NumInvalidated
+		}
+	}
+
+	lsm.Close()
+
+	options.CreateIfMissing = false
+	lsm, err = newCollection(&options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+
+	for _, lv := range lsm.levels {
+		for _, f := range lv.Files {
+			if b, ok := numInvalidated[f.Name]; ok && b != f.NumInvalidated {
+				t.Fatalf("SST-file [%s] reopened with %d invalidated entries, expected %d", f.Name, f.NumInvalidated, b)
+			}
+		}
+	}
+
+	for i := 0; i < 5000; i++ {
+		key := []byte(fmt.Sprintf("key-%05d", i))
+		value, err := lsm.Get(key, nil)
+
+		expected, ok := model[string(key)]
+		if !ok {
+			if err != ErrKeyNotFound {
+				t.Fatalf("key [%s] expected deleted, got [%s] %v", string(key), string(value), err)
+			}
+			continue
+		}
+		if err != nil || !bytes.Equal(value, expected) {
+			t.Fatalf("key [%s] got [%s] %v, expected [%s]", string(key), string(value), err, string(expected))
+		}
+	}
+}
+
+// testWaitTTL checks TTLs until no expired tombstone is found.
+func testWaitTTL(t *testing.T, lsm *collection) {
+	for i := 0; i < 3000; i++ {
+		// tombstones in immutable memTables are checked after they are persisted
+		testWaitPersisted(t, lsm)
+
+		expired, err := lsm.checkTTL()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !expired {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("expired tombstones are not compacted")
+}
+
+func TestCompactDD(t *testing.T) {
+
+	var clockLock sync.Mutex
+	now := time.Now()
+
+	options := DefaultCollectionOptions
+	options.MemTableSizeLimit = 16 << 10 // 16KB
+	options.LevelSizeRatio = 4
+	options.NumInitialLevel = 4
+	options.DeletePersistThreshold = time.Hour
+	options.clock = func() time.Time {
+		clockLock.Lock()
+		defer clockLock.Unlock()
+		return now
+	}
+
+	lsm, err := newCollection(&options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+
+	// too few writes to saturate any level, so only TTLs push tombstones down
+	for i := 0; i < 3000; i++ {
+		key := []byte(fmt.Sprintf("key-%05d", i))
+		if err := lsm.Put(key, key, key, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 3000; i += 3 {
+		key := []byte(fmt.Sprintf("key-%05d", i))
+		if err := lsm.Del(key, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	step := 5 * time.Minute
+
+	for elapsed := step; elapsed <= options.DeletePersistThreshold+step; elapsed += step {
+
+		clockLock.Lock()
+		now = now.Add(step)
+		clockLock.Unlock()
+
+		testWaitTTL(t, lsm)
+
+		numDelete := 0
+		for _, lv := range lsm.levels {
+			lv.Lock()
+			for _, f := range lv.Files {
+				numDelete += f.NumDelete
+			}
+			lv.Unlock()
+		}
+		lsm.curMemTable.Lock()
+		if lsm.curMemTable.ageOldestTomb != 0 {
+			numDelete++
+		}
+		lsm.curMemTable.Unlock()
+
+		fmt.Printf("%v elapsed, files on levels %v, %d tombstones\n", elapsed, testNumFiles(lsm), numDelete)
+
+		// every tombstone is persisted to the last level within DeletePersistThreshold
+		if elapsed > options.DeletePersistThreshold && numDelete != 0 {
+			t.Fatalf("%d tombstones are left after %v", numDelete, elapsed)
+		}
+	}
+
+	for i := 0; i < 3000; i++ {
+		key := []byte(fmt.Sprintf("key-%05d", i))
+		value, err := lsm.Get(key, nil)
+
+		if i%3 == 0 {
+			if err != ErrKeyNotFound {
+				t.Fatalf("key [%s] expected deleted, got [%s] %v", string(key), string(value), err)
+			}
+			continue
+		}
+		if err != nil || !bytes.Equal(value, key) {
+			t.Fatalf("key [%s] got [%s] %v", string(key), string(value), err)
+		}
+	}
+}
+
+func TestCompactQueue(t *testing.T) {
+
+	q := newCompactQueue()
+
+	so1 := compactTask{compactType: enumCompactTypeSO, levelIndex: 0}
+	dd1 := compactTask{compactType: enumCompactTypeDD, levelIndex: 0}
+
+	// a task is queued at most once
+	q.push(so1)
+	q.push(dd1)
+	q.push(so1)
+	if q.size() != 2 {
+		t.Fatal(q.size())
+	}
+
+	if task, ok := q.pop(); !ok || task != so1 {
+		t.Fatal(task, ok)
+	}
+	// queued again once popped
+	q.push(so1)
+	if task, ok := q.pop(); !ok || task != dd1 {
+		t.Fatal(task, ok)
+	}
+	if task, ok := q.pop(); !ok || task != so1 {
+		t.Fatal(task, ok)
+	}
+	if _, ok := q.pop(); ok {
+		t.Fatal("queue is not empty")
+	}
+}
+
+func TestSubcompactionBounds(t *testing.T) {
+
+	options := DefaultCollectionOptions
+
+	lsm := &collection{options: &options}
+
+	c := &compaction{}
+	for _, key := range []string{"c", "a", "e"} {
+		c.inputs = append(c.inputs, &sstFile{SortKeyMin: []byte(key)})
+	}
+	for _, key := range []string{"b", "a", "d", "f"} {
+		c.overlaps = append(c.overlaps, &sstFile{SortKeyMin: []byte(key)})
+	}
+
+	for _, tc := range []struct {
+		n      int
+		bounds string
+	}{
+		{1, ""},
+		{3, "ce"},
+		{10, "bcdef"},
+	} {
+		options.MaxSubcompactions = tc.n
+
+		bounds := ""
+		for _, b := range lsm.subcompactionBounds(c) {
+			bounds += string(b)
+		}
+		if bounds != tc.bounds {
+			t.Fatalf("%d subcompactions, got bounds [%s], expected [%s]", tc.n, bounds, tc.bounds)
+		}
+	}
+}
+
+func TestParallelCompaction(t *testing.T) {
+
+	options := DefaultCollectionOptions
+	options.DirPath = t.TempDir()
+	options.CreateIfMissing = true
+	options.MemTableSizeLimit = 8 << 10 // 8KB
+	options.LevelSizeRatio = 4
+	options.NumInitialLevel = 3
+	options.MaxBackgroundCompactions = 4
+	options.MaxSubcompactions = 4
+
+	lsm, err := newCollection(&options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// writers on disjoint keys
+	numWriter := 4
+	models := make([]map[string][]byte, numWriter)
+
+	var wg sync.WaitGroup
+	for w := 0; w < numWriter; w++ {
+		models[w] = map[string][]byte{}
+		wg.Add(1)
+
+		go func(w int) {
+			defer wg.Done()
+
+			r := rand.New(rand.NewSource(int64(w)))
+			for i := 0; i < 10000; i++ {
+				key := []byte(fmt.Sprintf("key-%05d", r.Intn(2000)*numWriter+w))
+
+				if r.Intn(4) == 0 {
+					if err := lsm.Del(key, nil); err != nil {
+						t.Error(err)
+						return
+					}
+					delete(models[w], string(key))
+					continue
+				}
+
+				value := []byte(fmt.Sprintf("value-%d", i))
+				if err := lsm.Put(key, value, key, nil); err != nil {
+					t.Error(err)
+					return
+				}
+				models[w][string(key)] = value
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	testWaitCompacted(t, lsm)
+
+	fmt.Println("files on levels", testNumFiles(lsm))
+
+	lsm.compactingLock.Lock()
+	if n := len(lsm.compacting); n != 0 {
+		t.Fatalf("%d files are left being compacted", n)
+	}
+	lsm.compactingLock.Unlock()
+
+	// files on the levels below `Level 1` are disjoint
+	less := options.SortKeyLess
+	for i := 1; i < len(lsm.levels); i++ {
+		lsm.levels[i].Lock()
+		files := append([]*sstFile{}, lsm.levels[i].Files...)
+		lsm.levels[i].Unlock()
+		sort.Slice(files, func(x, y int) bool { return less(files[x].SortKeyMin, files[y].SortKeyMin) })
+		for j := 1; j < len(files); j++ {
+			if !less(files[j-1].SortKeyMax, files[j].SortKeyMin) {
+				t.Fatalf("SST-files [%s] and [%s] overlap on level-%d", files[j-1].Name, files[j].Name, i+1)
+			}
+		}
+	}
+
+	check := func() {
+		for w := 0; w < numWriter; w++ {
+			for i := 0; i < 2000; i++ {
+				key := []byte(fmt.Sprintf("key-%05d", i*numWriter+w))
+				value, err := lsm.Get(key, nil)
+
+				expected, ok := models[w][string(key)]
+				if !ok {
+					if err != ErrKeyNotFound {
+						t.Fatalf("key [%s] expected deleted, got [%s] %v", string(key), string(value), err)
+					}
+					continue
+				}
+				if err != nil || !bytes.Equal(value, expected) {
+					t.Fatalf("key [%s] got [%s] %v, expected [%s]", string(key), string(value), err, string(expected))
+				}
+			}
+		}
+	}
+
+	check()
+
+	// the replacements of concurrent compactions are recorded in MANIFEST
+	lsm.Close()
+	options.CreateIfMissing = false
+	lsm, err = newCollection(&options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+
+	check()
+}
+
+func TestCompactRangeDelFences(t *testing.T) {
+
+	options := DefaultCollectionOptions
+	options.MemTableSizeLimit = 8 << 10 // 8KB
+	options.LevelSizeRatio = 4
+	options.NumInitialLevel = 4
+
+	lsm, err := newCollection(&options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+
+	for i := 0; i < 4000; i++ {
+		key := []byte(fmt.Sprintf("key-%05d", i))
+		if err := lsm.Put(key, key, key, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a range delete wider than any file, followed by newer entries in its range
+	if err := lsm.RangeDel([]byte("key-00000"), []byte("key-03999"), nil); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4000; i += 2 {
+		key := []byte(fmt.Sprintf("key-%05d", i))
+		if err := lsm.Put(key, key, key, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testWaitCompacted(t, lsm)
+
+	fmt.Println("files on levels", testNumFiles(lsm))
+
+	// the fences of files on the levels below `Level 1` share at most the key at which a range tombstone is clipped
+	less := options.SortKeyLess
+	numRangeDel := 0
+	for i := 1; i < len(lsm.levels); i++ {
+		lsm.levels[i].Lock()
+		files := append([]*sstFile{}, lsm.levels[i].Files...)
+		lsm.levels[i].Unlock()
+		sort.Slice(files, func(x, y int) bool { return less(files[x].SortKeyMin, files[y].SortKeyMin) })
+		for j := 0; j < len(files); j++ {
+			numRangeDel += len(files[j].RangeDels)
+			if j > 0 && less(files[j].SortKeyMin, files[j-1].SortKeyMax) {
+				t.Fatalf("SST-files [%s] [%s, %s] and [%s] [%s, %s] overlap on level-%d",
+					files[j-1].Name, files[j-1].SortKeyMin, files[j-1].SortKeyMax,
+					files[j].Name, files[j].SortKeyMin, files[j].SortKeyMax, i+1)
+			}
+		}
+	}
+	if numRangeDel == 0 {
+		t.Fatal("no range tombstone is compacted below `Level 1`")
+	}
+
+	for i := 0; i < 4000; i++ {
+		key := []byte(fmt.Sprintf("key-%05d", i))
+		value, err := lsm.Get(key, nil)
+
+		if i%2 == 1 {
+			if err != ErrKeyNotFound {
+				t.Fatalf("key [%s] expected deleted, got [%s] %v", string(key), string(value), err)
+			}
+			continue
+		}
+		if err != nil || !bytes.Equal(value, key) {
+			t.Fatalf("key [%s] got [%s] %v", string(key), string(value), err)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package lethe
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+)
+
+// Pages are compressed one by one when they are written to SST-files,
+// and the codec of each page is recorded in the index block, so that a page is decoded by its own codec
+// regardless of the options, e.g. a page copied from another file or written before the options change.
+
+// flateCompressor is the builtin codec of FlateCompression.
+type flateCompressor struct{}
+
+func (flateCompressor) Compression() Compression { return FlateCompression }
+
+func (flateCompressor) Compress(src []byte) ([]byte, error) {
+	return compressWith(src, func(w io.Writer) (io.WriteCloser, error) {
+		return flate.NewWriter(w, flate.DefaultCompression)
+	})
+}
+
+func (flateCompressor) Decompress(src []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(src))
+	defer r.Close()
+
+	return ioutil.ReadAll(r)
+}
+
+// zlibCompressor is the builtin codec of ZlibCompression.
+type zlibCompressor struct{}
+
+func (zlibCompressor) Compression() Compression { return ZlibCompression }
+
+func (zlibCompressor) Compress(src []byte) ([]byte, error) {
+	return compressWith(src, func(w io.Writer) (io.WriteCloser, error) {
+		return zlib.NewWriter(w), nil
+	})
+}
+
+func (zlibCompressor) Decompress(src []byte) ([]byte, error) {
+	r, err := zlib.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return ioutil.ReadAll(r)
+}
+
+func compressWith(src []byte, newWriter func(w io.Writer) (io.WriteCloser, error)) ([]byte, error) {
+	var buf bytes.Buffer
+
+	w, err := newWriter(&buf)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// -----------------------------------------------------------------------------
+
+// compressors are the codecs of compression by id, NoCompression is not included.
+type compressors map[Compression]Compressor
+
+// builtinCompressors are the codecs used when a SST-file is read without the options of collection.
+var builtinCompressors = compressors{
+	FlateCompression: flateCompressor{},
+	ZlibCompression:  zlibCompressor{},
+}
+
+// newCompressors returns the builtin codecs and the custom ones of options,
+// and checks the codecs used by options are registered.
+func newCompressors(options *CollectionOptions) (compressors, error) {
+
+	cs := compressors{}
+	for c, compressor := range builtinCompressors {
+		cs[c] = compressor
+	}
+
+	for _, compressor := range options.Compressors {
+		c := compressor.Compression()
+		if _, ok := cs[c]; ok || c == NoCompression {
+			return nil, ErrUnknownCompression
+		}
+		cs[c] = compressor
+	}
+
+	used := append([]Compression{options.Compression}, options.LevelCompressions...)
+	for _, c := range used {
+		if _, ok := cs[c]; !ok && c != NoCompression {
+			return nil, ErrUnknownCompression
+		}
+	}
+
+	return cs, nil
+}
+
+// compress compresses the encoded page buf with the codec c,
+// and returns buf uncompressed if the codec does not make it smaller.
+func (cs compressors) compress(c Compression, buf []byte) ([]byte, Compression, error) {
+
+	if c == NoCompression {
+		return buf, NoCompression, nil
+	}
+
+	compressor, ok := cs[c]
+	if !ok {
+		return nil, NoCompression, ErrUnknownCompression
+	}
+
+	compressed, err := compressor.Compress(buf)
+	if err != nil {
+		return nil, NoCompression, err
+	}
+	if len(compressed) >= len(buf) {
+		return buf, NoCompression, nil
+	}
+
+	return compressed, c, nil
+}
+
+// decompress decompresses the page buf compressed with the codec c.
+// A nil compressors only decodes the builtin codecs.
+func (cs compressors) decompress(c Compression, buf []byte) ([]byte, error) {
+
+	if c == NoCompression {
+		return buf, nil
+	}
+
+	if cs == nil {
+		cs = builtinCompressors
+	}
+	compressor, ok := cs[c]
+	if !ok {
+		return nil, ErrUnknownCompression
+	}
+
+	return compressor.Decompress(buf)
+}
+
+// compressionOf returns the codec of pages on the level of levelIndex.
+func (lsm *collection) compressionOf(levelIndex int) Compression {
+	if levelIndex >= 0 && levelIndex < len(lsm.options.LevelCompressions) {
+		return lsm.options.LevelCompressions[levelIndex]
+	}
+	return lsm.options.Compression
+}
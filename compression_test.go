@@ -0,0 +1,96 @@
+package lethe
+
+import (
+	"bytes"
+	"fmt"
+	"sync/atomic"
+	"testing"
+)
+
+// countCompressor is a custom codec on top of flate, which counts the pages compressed.
+type countCompressor struct {
+	flateCompressor
+	n int64
+}
+
+func (c *countCompressor) Compression() Compression { return 128 }
+
+func (c *countCompressor) Compress(src []byte) ([]byte, error) {
+	atomic.AddInt64(&c.n, 1)
+	return c.flateCompressor.Compress(src)
+}
+
+func TestCompression(t *testing.T) {
+
+	custom := &countCompressor{}
+
+	options := DefaultCollectionOptions
+	options.DirPath = t.TempDir()
+	options.CreateIfMissing = true
+	options.MemTableSizeLimit = 16 << 10 // 16KB
+	options.BlockCacheSize = 0
+	options.Compression = ZlibCompression
+	options.LevelCompressions = []Compression{NoCompression, 128}
+	options.Compressors = []Compressor{custom}
+
+	lsm, err := newCollection(&options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value := bytes.Repeat([]byte("value"), 20)
+	for i := 0; i < 5000; i++ {
+		key := []byte(fmt.Sprintf("key-%05d", i))
+		if err := lsm.Put(key, value, key, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	testWaitPersisted(t, lsm)
+	testWaitCompacted(t, lsm)
+	fmt.Println("files on levels", testNumFiles(lsm))
+
+	if atomic.LoadInt64(&custom.n) == 0 {
+		t.Fatal("the custom codec is not used")
+	}
+	for _, lf := range lsm.levelFiles() {
+		expected := lsm.compressionOf(lf.levelIndex)
+		for _, dt := range lf.file.Tiles {
+			for _, p := range dt.Pages {
+				if p.Compression != expected {
+					t.Fatalf("page of SST-file [%s] on level %d is compressed with %d, expected %d", lf.file.Name, lf.levelIndex, p.Compression, expected)
+				}
+			}
+		}
+	}
+
+	check := func() {
+		for i := 0; i < 5000; i += 7 {
+			key := []byte(fmt.Sprintf("key-%05d", i))
+			got, err := lsm.Get(key, nil)
+			if err != nil || !bytes.Equal(got, value) {
+				t.Fatalf("key [%s] got [%s] %v", string(key), string(got), err)
+			}
+		}
+	}
+
+	check()
+	lsm.Close()
+
+	// the codecs are recorded in SST-files
+	options.CreateIfMissing = false
+	options.Compression = NoCompression
+	options.LevelCompressions = nil
+	lsm, err = newCollection(&options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+
+	check()
+
+	bad := options
+	bad.Compression = 200
+	if _, err := newCollection(&bad); err != ErrUnknownCompression {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,23 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package lethe
+
+import (
+	"os"
+	"path"
+)
+
+// lockFileName is the file under DirPath locked by the collection opening it.
+const lockFileName = "LOCK"
+
+// lockDir only creates the lock file on the platforms without flock,
+// where DirPath is not protected from being opened by two collections.
+func lockDir(dirPath string) (*os.File, error) {
+	return os.OpenFile(path.Join(dirPath, lockFileName), os.O_RDWR|os.O_CREATE, 0644)
+}
+
+// unlockDir releases the lock taken by lockDir.
+func unlockDir(f *os.File) error {
+	return f.Close()
+}
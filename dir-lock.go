@@ -0,0 +1,44 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package lethe
+
+import (
+	"os"
+	"path"
+	"syscall"
+)
+
+// lockFileName is the file under DirPath locked by the collection opening it.
+const lockFileName = "LOCK"
+
+// lockDir takes an exclusive lock on DirPath, which is released by unlockDir or by the exit of process,
+// so a crash never leaves DirPath locked.
+func lockDir(dirPath string) (*os.File, error) {
+
+	f, err := os.OpenFile(path.Join(dirPath, lockFileName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, ErrLocked
+		}
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// unlockDir releases the lock taken by lockDir.
+func unlockDir(f *os.File) error {
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_UN); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
@@ -3,34 +3,51 @@ package lethe
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"io"
+	"log"
 	"os"
 	"path"
-	"sync"
 )
 
 // sstFileDesc is the interface for SST-file IO.
+//
+// A SST-file is written once through a writable sstFileDesc, which is synced and closed,
+// and then it is reopened through a read-only sstFileDesc.
 type sstFileDesc interface {
 	Name() string
 	io.ReaderAt // ReadAt(p []byte, off int64) (n int, err error)
 	io.Writer   // Write(p []byte) (n int, err error)
 	// io.WriterAt  // WriteAt(b []byte, off int64) (n int, err error)
 	io.Closer // Close() error
+
+	// Sync commits the written contents to stable storage.
+	Sync() error
+
+	// Size returns the number of bytes of SST-file.
+	Size() (int64, error)
 }
 
+var (
+	errReadOnlySSTFileDesc = errors.New("read-only SST-file")
+)
+
 // -----------------------------------------------------------------------------
 
 // memSSTFileDesc implements sstFileReader interface and sstFileWriter interface.
-// memSSTFileDesc is always used as a mock.
+// memSSTFileDesc is used as a mock in tests and by the ephemeral collection whose DirPath is empty.
 type memSSTFileDesc struct {
 	buf  bytes.Buffer
 	name string
 }
 
-// disk
-type diskSSTFileDesc os.File
+// read-only on disk
+type diskSSTFileDesc struct {
+	name string
+	file *os.File
+}
 
-// disk with IO buffer
+// disk with IO buffer, write only
 type diskBufSSTFileDesc struct {
 	name string
 	file *os.File
@@ -39,8 +56,6 @@ type diskBufSSTFileDesc struct {
 
 // -----------------------------------------------------------------------------
 
-var _memFds sync.Map
-
 // openMemSSTFileDesc returns a in-memory mock of sstFileDesc
 func openMemSSTFileDesc(name string) sstFileDesc {
 	fd := &memSSTFileDesc{}
@@ -49,8 +64,6 @@ func openMemSSTFileDesc(name string) sstFileDesc {
 
 	fd.name = name
 
-	_memFds.Store(name, fd)
-
 	return fd
 }
 
@@ -68,9 +81,6 @@ func (fd *memSSTFileDesc) ReadAt(p []byte, off int64) (n int, err error) {
 
 // Close is an io.Closer interface
 func (fd *memSSTFileDesc) Close() error {
-
-	_memFds.Delete(fd.name)
-
 	return nil
 }
 
@@ -81,39 +91,85 @@ func (fd *memSSTFileDesc) Write(p []byte) (n int, err error) {
 	return fd.buf.Write(p)
 }
 
+// Sync does nothing because the buffer is never persisted.
+func (fd *memSSTFileDesc) Sync() error {
+	return nil
+}
+
+func (fd *memSSTFileDesc) Size() (int64, error) {
+	return int64(fd.buf.Len()), nil
+}
+
 // -----------------------------------------------------------------------------
 
-func openDiskSSTFileDesc(dirPath, name string) sstFileDesc {
-	// TODO
+// openDiskSSTFileDesc opens an existing SST-file under dirPath for reading.
+func openDiskSSTFileDesc(dirPath, name string) (sstFileDesc, error) {
 
 	fpath := path.Join(dirPath, name)
 
-	f, err := os.OpenFile(fpath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	f, err := os.Open(fpath)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	return f
+	fd := &diskSSTFileDesc{}
+	fd.name = name
+	fd.file = f
+
+	return fd, nil
+}
+
+func (fd *diskSSTFileDesc) Name() string {
+	return fd.name
+}
+
+// ReadAt is an io.ReaderAt interface.
+func (fd *diskSSTFileDesc) ReadAt(p []byte, off int64) (n int, err error) {
+	return fd.file.ReadAt(p, off)
+}
+
+// Write is an io.Writer interface, which always fails on a read-only SST-file.
+func (fd *diskSSTFileDesc) Write(p []byte) (n int, err error) {
+	return 0, errReadOnlySSTFileDesc
+}
+
+// Close is an io.Closer interface
+func (fd *diskSSTFileDesc) Close() error {
+	return fd.file.Close()
+}
+
+// Sync does nothing because the SST-file is read-only.
+func (fd *diskSSTFileDesc) Sync() error {
+	return nil
+}
+
+func (fd *diskSSTFileDesc) Size() (int64, error) {
+	info, err := fd.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
 }
 
 // -----------------------------------------------------------------------------
 
-func openDiskBufSSTFileDesc(dirPath, name string) sstFileDesc {
+// createDiskBufSSTFileDesc creates a new SST-file under dirPath for writing.
+func createDiskBufSSTFileDesc(dirPath, name string) (sstFileDesc, error) {
 	fd := &diskBufSSTFileDesc{}
 
 	fd.name = name
 
 	fpath := path.Join(dirPath, name)
-	f, err := os.OpenFile(fpath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	f, err := os.OpenFile(fpath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	fd.file = f
 
 	fd.wbuf = bufio.NewWriterSize(f, 1<<20) // 1MB write buffer
 
-	return fd
+	return fd, nil
 }
 
 func (fd *diskBufSSTFileDesc) Name() string {
@@ -121,6 +177,7 @@ func (fd *diskBufSSTFileDesc) Name() string {
 }
 
 // ReadAt is an io.ReaderAt interface.
+// Note that the contents in write buffer are not visible until Sync.
 func (fd *diskBufSSTFileDesc) ReadAt(p []byte, off int64) (n int, err error) {
 	return fd.file.ReadAt(p, off)
 }
@@ -130,15 +187,179 @@ func (fd *diskBufSSTFileDesc) Write(p []byte) (n int, err error) {
 	return fd.wbuf.Write(p) // buffer write
 }
 
+// Sync flushes the write buffer and commits the file to disk.
+func (fd *diskBufSSTFileDesc) Sync() error {
+	if err := fd.wbuf.Flush(); err != nil {
+		return err
+	}
+	return fd.file.Sync()
+}
+
+// Size returns the number of bytes written, including the contents in write buffer.
+func (fd *diskBufSSTFileDesc) Size() (int64, error) {
+	info, err := fd.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size() + int64(fd.wbuf.Buffered()), nil
+}
+
 // Close is an io.Closer interface
 func (fd *diskBufSSTFileDesc) Close() error {
 
 	// sync flush
 	if fd.wbuf != nil {
 		if err := fd.wbuf.Flush(); err != nil {
+			fd.file.Close()
 			return err
 		}
 	}
 
 	return fd.file.Close()
 }
+
+// -----------------------------------------------------------------------------
+
+// syncDir commits the entries of a directory, e.g. created or renamed files, to disk.
+func syncDir(dirPath string) error {
+	d, err := os.Open(dirPath)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+// -----------------------------------------------------------------------------
+
+// createSSTFileDesc creates a writable SST-file.
+// If DirPath is empty, the collection is ephemeral and SST-files are kept in memory.
+func (lsm *collection) createSSTFileDesc(name string) (sstFileDesc, error) {
+	if lsm.options.DirPath == "" {
+		return openMemSSTFileDesc(name), nil
+	}
+	return createDiskBufSSTFileDesc(lsm.options.DirPath, name)
+}
+
+// finishSSTFileDesc syncs a written SST-file and returns it for reading,
+// which is reopened on demand through the table cache.
+func (lsm *collection) finishSSTFileDesc(fd sstFileDesc) (sstFileDesc, error) {
+
+	if lsm.options.DirPath == "" {
+		return fd, nil
+	}
+
+	if err := fd.Sync(); err != nil {
+		fd.Close()
+		return nil, err
+	}
+	size, err := fd.Size()
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	if err := fd.Close(); err != nil {
+		return nil, err
+	}
+
+	// make the new file entry durable
+	if err := syncDir(lsm.options.DirPath); err != nil {
+		return nil, err
+	}
+
+	return lsm.tables.openTableSSTFileDesc(fd.Name(), size), nil
+}
+
+// openSSTFile opens a persisted SST-file under DirPath by name through the table cache,
+// and loads its metadata.
+func (lsm *collection) openSSTFile(name string) (*sstFile, error) {
+
+	info, err := os.Stat(path.Join(lsm.options.DirPath, name))
+	if err != nil {
+		return nil, err
+	}
+
+	fd := lsm.tables.openTableSSTFileDesc(name, info.Size())
+
+	file, err := loadSSTFile(fd)
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	file.compressors = lsm.compressors
+
+	return file, nil
+}
+
+// removeSSTFileDesc closes fd and removes the SST-file from disk.
+// The file is removed even if it fails to close, e.g. it has been closed.
+func (lsm *collection) removeSSTFileDesc(fd sstFileDesc) error {
+
+	closeErr := fd.Close()
+
+	if lsm.options.DirPath != "" {
+		if err := os.Remove(path.Join(lsm.options.DirPath, fd.Name())); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return closeErr
+}
+
+// -----------------------------------------------------------------------------
+// pinned files
+// -----------------------------------------------------------------------------
+
+// pinFiles pins files so that they are not removed while being read out of the lock of levels,
+// e.g. by views and iterators.
+// require: files are on levels with the read lock of lsm held, or they are pinned
+func (lsm *collection) pinFiles(files []*sstFile) {
+	lsm.fileRefLock.Lock()
+	defer lsm.fileRefLock.Unlock()
+
+	for _, f := range files {
+		lsm.fileRefs[f]++
+	}
+}
+
+// unpinFiles unpins files, and removes the files retired while pinned.
+func (lsm *collection) unpinFiles(files []*sstFile) {
+
+	toRemove := []*sstFile{}
+
+	lsm.fileRefLock.Lock()
+	for _, f := range files {
+		lsm.fileRefs[f]--
+		if lsm.fileRefs[f] > 0 {
+			continue
+		}
+		delete(lsm.fileRefs, f)
+
+		if lsm.obsoleteFiles[f] {
+			delete(lsm.obsoleteFiles, f)
+			toRemove = append(toRemove, f)
+		}
+	}
+	lsm.fileRefLock.Unlock()
+
+	for _, f := range toRemove {
+		if err := lsm.removeSSTFileDesc(f.fd); err != nil {
+			log.Printf("remove SST-file [%s]: %v\n", f.Name, err)
+		}
+	}
+}
+
+// retireSSTFile removes a file which has been replaced on its level,
+// or defers it until the file is unpinned.
+func (lsm *collection) retireSSTFile(file *sstFile) error {
+	lsm.fileRefLock.Lock()
+	if lsm.fileRefs[file] > 0 {
+		lsm.obsoleteFiles[file] = true
+		lsm.fileRefLock.Unlock()
+		return nil
+	}
+	lsm.fileRefLock.Unlock()
+
+	return lsm.removeSSTFileDesc(file.fd)
+}
@@ -1,5 +1,3 @@
 module lethe
 
 go 1.15
-
-require github.com/google/uuid v1.1.5
@@ -0,0 +1,840 @@
+package lethe
+
+import (
+	"bytes"
+	"sort"
+)
+
+// An iterator merges all the components of a view of LSM, from the newest to the oldest:
+// - the memTables, whose versions written after the view are skipped
+// - the files on `Level 1`, which overlap with each other
+// - the files on each of `Level 2` ~ `Level L-1`, which are iterated one after another
+// For each key, the entry from the newest component shadows the older ones,
+// and it is hidden if it is a tombstone or it is deleted by a newer range tombstone.
+//
+// Pages within a delete tile are sorted on delete key, so a SST-file is iterated tile by tile,
+// and the pages of the current tile are merged on sort key.
+//
+// The files read by an iterator are pinned until it is closed,
+// so a file replaced by compaction meanwhile is removed after that.
+
+// internalIterator iterates entries sorted on sort key, one entry per key.
+type internalIterator interface {
+	// seek moves to the first entry whose key >= key
+	seek(key []byte)
+	// seekForPrev moves to the last entry whose key <= key
+	seekForPrev(key []byte)
+	seekToFirst()
+	seekToLast()
+	next()
+	prev()
+	valid() bool
+	entry() *entry
+	err() error
+}
+
+// -----------------------------------------------------------------------------
+// slice iterator
+// -----------------------------------------------------------------------------
+
+// sliceIterator iterates entries sorted on sort key in memory.
+type sliceIterator struct {
+	less func(s, t []byte) bool
+	es   []entry
+	pos  int
+}
+
+func newSliceIterator(es []entry, less func(s, t []byte) bool) *sliceIterator {
+	return &sliceIterator{less: less, es: es, pos: -1}
+}
+
+func (it *sliceIterator) seek(key []byte) {
+	it.pos = sort.Search(len(it.es), func(i int) bool { return !it.less(it.es[i].key, key) })
+}
+
+func (it *sliceIterator) seekForPrev(key []byte) {
+	it.pos = sort.Search(len(it.es), func(i int) bool { return it.less(key, it.es[i].key) }) - 1
+}
+
+func (it *sliceIterator) seekToFirst()  { it.pos = 0 }
+func (it *sliceIterator) seekToLast()   { it.pos = len(it.es) - 1 }
+func (it *sliceIterator) next()         { it.pos++ }
+func (it *sliceIterator) prev()         { it.pos-- }
+func (it *sliceIterator) valid() bool   { return it.pos >= 0 && it.pos < len(it.es) }
+func (it *sliceIterator) entry() *entry { return &it.es[it.pos] }
+func (it *sliceIterator) err() error    { return nil }
+
+// -----------------------------------------------------------------------------
+// bounds
+// -----------------------------------------------------------------------------
+
+// iterBounds limits iterators within [lower, upper] and to the keys with prefix, nil for unbounded.
+// The keys with prefix are supposed to be contiguous on sort key, e.g. in dictionary order.
+type iterBounds struct {
+	less func(s, t []byte) bool
+
+	lower  []byte
+	upper  []byte
+	prefix []byte
+}
+
+func newIterBounds(readOptions *ReadOptions, less func(s, t []byte) bool) *iterBounds {
+	b := &iterBounds{less: less}
+	if readOptions != nil {
+		b.lower = readOptions.LowerBound
+		b.upper = readOptions.UpperBound
+		b.prefix = readOptions.Prefix
+	}
+	return b
+}
+
+// beforeLower returns whether key is before all the keys within bounds.
+func (b *iterBounds) beforeLower(key []byte) bool {
+	if b.lower != nil && b.less(key, b.lower) {
+		return true
+	}
+	return b.prefix != nil && b.less(key, b.prefix)
+}
+
+// start returns the least key bounding the keys within bounds, nil if unbounded.
+func (b *iterBounds) start() []byte {
+	if b.prefix != nil && (b.lower == nil || b.less(b.lower, b.prefix)) {
+		return b.prefix
+	}
+	return b.lower
+}
+
+// afterUpper returns whether key is after all the keys within bounds.
+func (b *iterBounds) afterUpper(key []byte) bool {
+	if b.upper != nil && b.less(b.upper, key) {
+		return true
+	}
+	return b.prefix != nil && b.less(b.prefix, key) && !bytes.HasPrefix(key, b.prefix)
+}
+
+// overlaps returns whether the fences [min, max] overlap with bounds.
+func (b *iterBounds) overlaps(min, max []byte) bool {
+	return !b.afterUpper(min) && !b.beforeLower(max)
+}
+
+// trim returns the entries within bounds of es sorted on sort key.
+func (b *iterBounds) trim(es []entry) []entry {
+	i := sort.Search(len(es), func(i int) bool { return !b.beforeLower(es[i].key) })
+	j := sort.Search(len(es), func(j int) bool { return b.afterUpper(es[j].key) })
+	if j < i {
+		j = i
+	}
+	return es[i:j]
+}
+
+// -----------------------------------------------------------------------------
+// memTable iterator
+// -----------------------------------------------------------------------------
+
+// memTableIterator iterates the newest version of each key whose seqNum <= seqNum in a memTable within bounds.
+// The sortedMap is seeked to the bounds without copying, with the memTable locked on every move,
+// and the versions written after seqNum are skipped.
+type memTableIterator struct {
+	b      *iterBounds
+	mv     memTableView
+	seqNum uint64
+
+	it sortedMapIterator
+	e  entry
+	ok bool
+}
+
+func newMemTableIterator(mv memTableView, seqNum uint64, b *iterBounds) *memTableIterator {
+	return &memTableIterator{b: b, mv: mv, seqNum: seqNum, it: mv.sm.NewIterator()}
+}
+
+// load takes the entry at the version of sortedMap, the bytes of which are never modified.
+func (it *memTableIterator) load() {
+	if !it.ok {
+		return
+	}
+	entity := it.it.Entity()
+	it.e = entry{key: it.it.Key(), value: entity.value, deleteKey: entity.deleteKey, meta: entity.meta}
+}
+
+// firstVisible moves forward to the first visible version from the current version.
+// require: memTable is locked
+func (it *memTableIterator) firstVisible() {
+	for it.it.Valid() && it.it.Entity().meta.seqNum > it.seqNum {
+		it.it.Seek(it.it.Key(), it.seqNum)
+	}
+	it.ok = it.it.Valid() && !it.b.afterUpper(it.it.Key())
+	it.load()
+}
+
+// lastVisibleBefore moves to the visible version of the last key < key.
+// require: memTable is locked
+func (it *memTableIterator) lastVisibleBefore(key []byte) {
+	for {
+		if it.it.SeekLT(key); !it.it.Valid() || it.b.beforeLower(it.it.Key()) {
+			it.ok = false
+			return
+		}
+		key = it.it.Key()
+		if it.it.Seek(key, it.seqNum); it.it.Valid() && bytes.Equal(it.it.Key(), key) {
+			it.ok = true
+			it.load()
+			return
+		}
+	}
+}
+
+// lastVisible moves to the visible version of the last key <= key within bounds.
+// require: memTable is locked
+func (it *memTableIterator) lastVisible(key []byte) {
+	if it.it.Seek(key, it.seqNum); it.it.Valid() && bytes.Equal(it.it.Key(), key) {
+		it.ok = !it.b.beforeLower(key)
+		it.load()
+	} else {
+		it.lastVisibleBefore(key)
+	}
+
+	for it.ok && it.b.afterUpper(it.e.key) {
+		it.lastVisibleBefore(it.e.key)
+	}
+}
+
+func (it *memTableIterator) seek(key []byte) {
+	it.mv.mt.Lock()
+	defer it.mv.mt.Unlock()
+
+	if start := it.b.start(); start != nil && it.b.less(key, start) {
+		key = start
+	}
+	it.it.Seek(key, it.seqNum)
+	it.firstVisible()
+}
+
+func (it *memTableIterator) seekForPrev(key []byte) {
+	it.mv.mt.Lock()
+	defer it.mv.mt.Unlock()
+
+	it.lastVisible(key)
+}
+
+func (it *memTableIterator) seekToFirst() {
+	it.mv.mt.Lock()
+	defer it.mv.mt.Unlock()
+
+	if start := it.b.start(); start != nil {
+		it.it.Seek(start, it.seqNum)
+	} else {
+		it.it.SeekToFirst()
+	}
+	it.firstVisible()
+}
+
+func (it *memTableIterator) seekToLast() {
+	it.mv.mt.Lock()
+	defer it.mv.mt.Unlock()
+
+	if it.b.upper != nil {
+		it.lastVisible(it.b.upper)
+		return
+	}
+	if it.it.SeekToLast(); !it.it.Valid() {
+		it.ok = false
+		return
+	}
+	it.lastVisible(it.it.Key())
+}
+
+func (it *memTableIterator) next() {
+	it.mv.mt.Lock()
+	defer it.mv.mt.Unlock()
+
+	// skip the older versions of the current key
+	key := it.e.key
+	for it.it.Next(); it.it.Valid() && bytes.Equal(it.it.Key(), key); it.it.Next() {
+	}
+	it.firstVisible()
+}
+
+func (it *memTableIterator) prev() {
+	it.mv.mt.Lock()
+	defer it.mv.mt.Unlock()
+
+	it.lastVisibleBefore(it.e.key)
+}
+
+func (it *memTableIterator) valid() bool   { return it.ok }
+func (it *memTableIterator) entry() *entry { return &it.e }
+func (it *memTableIterator) err() error    { return nil }
+
+// -----------------------------------------------------------------------------
+// SST-file iterator
+// -----------------------------------------------------------------------------
+
+// sstFileIterator iterates the entries of a SST-file within bounds tile by tile.
+// The tiles and pages out of bounds are skipped via their fences without reading.
+type sstFileIterator struct {
+	b    *iterBounds
+	r    pageReader
+	file *sstFile
+
+	// the index of current delete tile
+	ti int
+	// the entries of current delete tile sorted on sort key
+	tile *sliceIterator
+
+	e error
+}
+
+func newSSTFileIterator(file *sstFile, b *iterBounds, r pageReader) *sstFileIterator {
+	return &sstFileIterator{b: b, r: r, file: file, ti: -1, tile: newSliceIterator(nil, b.less)}
+}
+
+// loadTile loads the delete tile of index ti, and merges its pages within bounds on sort key.
+// It returns false if it fails to load.
+func (it *sstFileIterator) loadTile(ti int) bool {
+	it.ti = ti
+	it.tile = newSliceIterator(nil, it.b.less)
+
+	if it.e != nil {
+		return false
+	}
+
+	dt := &it.file.Tiles[ti]
+	if !it.b.overlaps(dt.SortKeyMin, dt.SortKeyMax) {
+		return true
+	}
+
+	sources := make([][]entry, 0, len(dt.Pages))
+	for j := 0; j < len(dt.Pages); j++ {
+		p := &dt.Pages[j]
+		if !it.b.overlaps(p.SortKeyMin, p.SortKeyMax) {
+			continue
+		}
+
+		// the entries before the lower bound are mostly not decoded
+		es, err := it.r.seekEntries(it.file, p, it.b.start(), it.b.less)
+		if err != nil {
+			it.e = err
+			return false
+		}
+		sources = append(sources, it.b.trim(es))
+	}
+
+	// pages within a delete tile are sorted on delete key, and entries within every page are sorted on sort key
+	it.tile = newSliceIterator(mergeEntries(sources, it.b.less), it.b.less)
+
+	return true
+}
+
+// firstFrom moves to the first entry of the first non-empty tile from index ti.
+func (it *sstFileIterator) firstFrom(ti int) {
+	for ; ti < len(it.file.Tiles); ti++ {
+		// delete tiles within a file are sorted on sort key, so are the tiles after it out of bounds
+		if it.b.afterUpper(it.file.Tiles[ti].SortKeyMin) {
+			break
+		}
+		if !it.loadTile(ti) {
+			return
+		}
+		if it.tile.seekToFirst(); it.tile.valid() {
+			return
+		}
+	}
+	it.ti = len(it.file.Tiles)
+	it.tile = newSliceIterator(nil, it.b.less)
+}
+
+// lastFrom moves to the last entry of the last non-empty tile till index ti.
+func (it *sstFileIterator) lastFrom(ti int) {
+	for ; ti >= 0; ti-- {
+		if it.b.beforeLower(it.file.Tiles[ti].SortKeyMax) {
+			break
+		}
+		if !it.loadTile(ti) {
+			return
+		}
+		if it.tile.seekToLast(); it.tile.valid() {
+			return
+		}
+	}
+	it.ti = -1
+	it.tile = newSliceIterator(nil, it.b.less)
+}
+
+func (it *sstFileIterator) seek(key []byte) {
+	less := it.b.less
+
+	ti := sort.Search(len(it.file.Tiles), func(i int) bool {
+		return !less(it.file.Tiles[i].SortKeyMax, key)
+	})
+	if ti == len(it.file.Tiles) || !it.loadTile(ti) {
+		it.firstFrom(ti)
+		return
+	}
+	if it.tile.seek(key); !it.tile.valid() {
+		it.firstFrom(ti + 1)
+	}
+}
+
+func (it *sstFileIterator) seekForPrev(key []byte) {
+	less := it.b.less
+
+	ti := sort.Search(len(it.file.Tiles), func(i int) bool {
+		return less(key, it.file.Tiles[i].SortKeyMin)
+	}) - 1
+	if ti < 0 || !it.loadTile(ti) {
+		it.lastFrom(ti)
+		return
+	}
+	if it.tile.seekForPrev(key); !it.tile.valid() {
+		it.lastFrom(ti - 1)
+	}
+}
+
+func (it *sstFileIterator) seekToFirst() { it.firstFrom(0) }
+func (it *sstFileIterator) seekToLast()  { it.lastFrom(len(it.file.Tiles) - 1) }
+
+func (it *sstFileIterator) next() {
+	if it.tile.next(); !it.tile.valid() {
+		it.firstFrom(it.ti + 1)
+	}
+}
+
+func (it *sstFileIterator) prev() {
+	if it.tile.prev(); !it.tile.valid() {
+		it.lastFrom(it.ti - 1)
+	}
+}
+
+func (it *sstFileIterator) valid() bool   { return it.e == nil && it.tile.valid() }
+func (it *sstFileIterator) entry() *entry { return it.tile.entry() }
+func (it *sstFileIterator) err() error    { return it.e }
+
+// -----------------------------------------------------------------------------
+// level iterator
+// -----------------------------------------------------------------------------
+
+// levelIterator iterates the files on one of `Level 2` ~ `Level L-1` one after another.
+// The fences of files on such a level do not overlap, except that adjacent files may share a key
+// at which a range tombstone is clipped by compaction,
+// so the files are ordered on SortKeyMin, but the fences are only used to skip files.
+type levelIterator struct {
+	b     *iterBounds
+	r     pageReader
+	files []*sstFile
+
+	// the index of current file
+	fi   int
+	file *sstFileIterator
+}
+
+func newLevelIterator(files []*sstFile, b *iterBounds, r pageReader) *levelIterator {
+	sorted := append([]*sstFile{}, files...)
+	sort.Slice(sorted, func(i, j int) bool { return b.less(sorted[i].SortKeyMin, sorted[j].SortKeyMin) })
+
+	return &levelIterator{b: b, r: r, files: sorted, fi: -1}
+}
+
+// openFile moves to the file of index fi, and returns false if there is no such file.
+func (it *levelIterator) openFile(fi int) bool {
+	it.fi = fi
+	it.file = nil
+
+	if fi < 0 || fi >= len(it.files) {
+		return false
+	}
+
+	it.file = newSSTFileIterator(it.files[fi], it.b, it.r)
+	return true
+}
+
+// stopped returns whether the iterator is positioned or fails on the current file.
+func (it *levelIterator) stopped() bool {
+	return it.file.valid() || it.file.err() != nil
+}
+
+func (it *levelIterator) seek(key []byte) {
+	for fi := 0; it.openFile(fi); fi++ {
+		if it.b.less(it.files[fi].SortKeyMax, key) {
+			continue
+		}
+		if it.file.seek(key); it.stopped() {
+			return
+		}
+	}
+}
+
+func (it *levelIterator) seekForPrev(key []byte) {
+	for fi := len(it.files) - 1; it.openFile(fi); fi-- {
+		if it.b.less(key, it.files[fi].SortKeyMin) {
+			continue
+		}
+		if it.file.seekForPrev(key); it.stopped() {
+			return
+		}
+	}
+}
+
+// firstFrom moves to the first entry of the first non-empty file from index fi.
+func (it *levelIterator) firstFrom(fi int) {
+	for ; it.openFile(fi); fi++ {
+		if it.file.seekToFirst(); it.stopped() {
+			return
+		}
+	}
+}
+
+// lastFrom moves to the last entry of the last non-empty file till index fi.
+func (it *levelIterator) lastFrom(fi int) {
+	for ; it.openFile(fi); fi-- {
+		if it.file.seekToLast(); it.stopped() {
+			return
+		}
+	}
+}
+
+func (it *levelIterator) seekToFirst() { it.firstFrom(0) }
+func (it *levelIterator) seekToLast()  { it.lastFrom(len(it.files) - 1) }
+
+func (it *levelIterator) next() {
+	if it.file.next(); !it.stopped() {
+		it.firstFrom(it.fi + 1)
+	}
+}
+
+func (it *levelIterator) prev() {
+	if it.file.prev(); !it.stopped() {
+		it.lastFrom(it.fi - 1)
+	}
+}
+
+func (it *levelIterator) valid() bool   { return it.file != nil && it.file.valid() }
+func (it *levelIterator) entry() *entry { return it.file.entry() }
+
+func (it *levelIterator) err() error {
+	if it.file == nil {
+		return nil
+	}
+	return it.file.err()
+}
+
+// -----------------------------------------------------------------------------
+// merging iterator
+// -----------------------------------------------------------------------------
+
+// mergingIterator merges children from the newest to the oldest,
+// the entry of the newest child is taken for the same key.
+type mergingIterator struct {
+	less     func(s, t []byte) bool
+	children []internalIterator
+
+	// the index of child at current position, -1 if invalid
+	cur int
+	// whether all the children are positioned after the current key, otherwise before it
+	forward bool
+}
+
+func newMergingIterator(children []internalIterator, less func(s, t []byte) bool) *mergingIterator {
+	return &mergingIterator{less: less, children: children, cur: -1}
+}
+
+// findSmallest moves to the child with the smallest key, the newest one for the same key.
+func (it *mergingIterator) findSmallest() {
+	it.cur = -1
+	for i, c := range it.children {
+		if c.valid() && (it.cur < 0 || it.less(c.entry().key, it.children[it.cur].entry().key)) {
+			it.cur = i
+		}
+	}
+}
+
+// findLargest moves to the child with the largest key, the newest one for the same key.
+func (it *mergingIterator) findLargest() {
+	it.cur = -1
+	for i, c := range it.children {
+		if c.valid() && (it.cur < 0 || it.less(it.children[it.cur].entry().key, c.entry().key)) {
+			it.cur = i
+		}
+	}
+}
+
+func (it *mergingIterator) seek(key []byte) {
+	for _, c := range it.children {
+		c.seek(key)
+	}
+	it.forward = true
+	it.findSmallest()
+}
+
+func (it *mergingIterator) seekForPrev(key []byte) {
+	for _, c := range it.children {
+		c.seekForPrev(key)
+	}
+	it.forward = false
+	it.findLargest()
+}
+
+func (it *mergingIterator) seekToFirst() {
+	for _, c := range it.children {
+		c.seekToFirst()
+	}
+	it.forward = true
+	it.findSmallest()
+}
+
+func (it *mergingIterator) seekToLast() {
+	for _, c := range it.children {
+		c.seekToLast()
+	}
+	it.forward = false
+	it.findLargest()
+}
+
+func (it *mergingIterator) next() {
+	key := it.entry().key
+
+	// the other children are positioned before the current key after moving backward
+	if !it.forward {
+		for i, c := range it.children {
+			if i != it.cur {
+				c.seek(key)
+			}
+		}
+		it.forward = true
+	}
+
+	// skip the current key, including the older entries of it
+	for _, c := range it.children {
+		if c.valid() && bytes.Equal(c.entry().key, key) {
+			c.next()
+		}
+	}
+
+	it.findSmallest()
+}
+
+func (it *mergingIterator) prev() {
+	key := it.entry().key
+
+	// the other children are positioned after the current key after moving forward
+	if it.forward {
+		for i, c := range it.children {
+			if i != it.cur {
+				c.seekForPrev(key)
+			}
+		}
+		it.forward = false
+	}
+
+	for _, c := range it.children {
+		if c.valid() && bytes.Equal(c.entry().key, key) {
+			c.prev()
+		}
+	}
+
+	it.findLargest()
+}
+
+func (it *mergingIterator) valid() bool   { return it.cur >= 0 }
+func (it *mergingIterator) entry() *entry { return it.children[it.cur].entry() }
+
+func (it *mergingIterator) err() error {
+	for _, c := range it.children {
+		if err := c.err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// -----------------------------------------------------------------------------
+// iterator
+// -----------------------------------------------------------------------------
+
+// iterator implements the Iterator interface.
+type iterator struct {
+	lsm *collection
+
+	mi *mergingIterator
+
+	// range tombstones of all the components
+	rangeDels []rangeTombstone
+
+	// files pinned until closed
+	files  []*sstFile
+	closed bool
+}
+
+// newIterator creates an iterator on view within the bounds of readOptions.
+// The files out of bounds are skipped via their fences, the others are pinned until the iterator is closed.
+func (v *view) newIterator(readOptions *ReadOptions) *iterator {
+
+	lsm := v.lsm
+	less := lsm.options.SortKeyLess
+	b := newIterBounds(readOptions, less)
+	r := lsm.pageReader(readOptions)
+
+	it := &iterator{lsm: lsm}
+	children := []internalIterator{}
+
+	addRangeDels := func(rts []rangeTombstone) {
+		for _, rt := range rts {
+			if b.overlaps(rt.Start, rt.End) {
+				it.rangeDels = append(it.rangeDels, rt)
+			}
+		}
+	}
+
+	// memTables
+	for _, mv := range v.memTables {
+		children = append(children, newMemTableIterator(mv, v.seqNum, b))
+	}
+	addRangeDels(v.rangeDels)
+
+	// persisted levels
+	for i := 0; i < len(v.levels); i++ {
+		files := []*sstFile{}
+		for _, f := range v.levels[i] {
+			if b.overlaps(f.SortKeyMin, f.SortKeyMax) {
+				files = append(files, f)
+			}
+		}
+
+		// the files of view are pinned
+		lsm.pinFiles(files)
+		it.files = append(it.files, files...)
+
+		for _, f := range files {
+			addRangeDels(f.RangeDels)
+		}
+
+		if i > 0 {
+			children = append(children, newLevelIterator(files, b, r))
+			continue
+		}
+
+		// the files on `Level 1` overlap, the newest file is at the back
+		for j := len(files) - 1; j >= 0; j-- {
+			children = append(children, newSSTFileIterator(files[j], b, r))
+		}
+	}
+
+	it.mi = newMergingIterator(children, less)
+
+	return it
+}
+
+// hidden returns whether the entry is deleted by a tombstone or a newer range tombstone.
+func (it *iterator) hidden(e *entry) bool {
+	if e.meta.opType == opDel {
+		return true
+	}
+	return e.meta.seqNum < maxCoveringSeqNum(it.rangeDels, e.key, it.lsm.options.SortKeyLess)
+}
+
+func (it *iterator) skipForward() {
+	for it.mi.valid() && it.hidden(it.mi.entry()) {
+		it.mi.next()
+	}
+}
+
+func (it *iterator) skipBackward() {
+	for it.mi.valid() && it.hidden(it.mi.entry()) {
+		it.mi.prev()
+	}
+}
+
+// Seek moves to the first key >= key.
+func (it *iterator) Seek(key []byte) {
+	if it.closed {
+		return
+	}
+	it.mi.seek(key)
+	it.skipForward()
+}
+
+// SeekToFirst moves to the first key.
+func (it *iterator) SeekToFirst() {
+	if it.closed {
+		return
+	}
+	it.mi.seekToFirst()
+	it.skipForward()
+}
+
+// SeekToLast moves to the last key.
+func (it *iterator) SeekToLast() {
+	if it.closed {
+		return
+	}
+	it.mi.seekToLast()
+	it.skipBackward()
+}
+
+// Next moves to the next key.
+func (it *iterator) Next() {
+	if !it.Valid() {
+		return
+	}
+	it.mi.next()
+	it.skipForward()
+}
+
+// Prev moves to the previous key.
+func (it *iterator) Prev() {
+	if !it.Valid() {
+		return
+	}
+	it.mi.prev()
+	it.skipBackward()
+}
+
+// Valid returns whether the iterator is positioned at a key.
+func (it *iterator) Valid() bool {
+	return !it.closed && it.mi.valid() && it.mi.err() == nil
+}
+
+// Key returns the sort key at current position, nil if not valid.
+func (it *iterator) Key() []byte {
+	if !it.Valid() {
+		return nil
+	}
+	return it.mi.entry().key
+}
+
+// Value returns the value at current position, nil if not valid.
+func (it *iterator) Value() []byte {
+	if !it.Valid() {
+		return nil
+	}
+	return it.mi.entry().value
+}
+
+// DeleteKey returns the delete key at current position, nil if not valid.
+func (it *iterator) DeleteKey() []byte {
+	if !it.Valid() {
+		return nil
+	}
+	return it.mi.entry().deleteKey
+}
+
+// Err returns the error met by the iterator.
+func (it *iterator) Err() error {
+	if it.closed {
+		return nil
+	}
+	return it.mi.err()
+}
+
+// Close unpins the files read by the iterator.
+func (it *iterator) Close() error {
+	if it.closed {
+		return nil
+	}
+	it.closed = true
+
+	it.lsm.unpinFiles(it.files)
+	it.files = nil
+
+	return nil
+}
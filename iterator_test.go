@@ -0,0 +1,447 @@
+package lethe
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestMergingIterator(t *testing.T) {
+	less := DefaultCollectionOptions.SortKeyLess
+
+	newer := []entry{
+		{key: []byte("b"), value: []byte("b2"), meta: keyMeta{seqNum: 5, opType: opPut}},
+		{key: []byte("d"), meta: keyMeta{seqNum: 6, opType: opDel}},
+	}
+	older := []entry{
+		{key: []byte("a"), value: []byte("a1"), meta: keyMeta{seqNum: 1, opType: opPut}},
+		{key: []byte("b"), value: []byte("b1"), meta: keyMeta{seqNum: 2, opType: opPut}},
+		{key: []byte("c"), value: []byte("c1"), meta: keyMeta{seqNum: 3, opType: opPut}},
+		{key: []byte("d"), value: []byte("d1"), meta: keyMeta{seqNum: 4, opType: opPut}},
+	}
+
+	mi := newMergingIterator([]internalIterator{
+		newSliceIterator(newer, less),
+		newSliceIterator(older, less),
+	}, less)
+
+	got := []string{}
+	for mi.seekToFirst(); mi.valid(); mi.next() {
+		got = append(got, fmt.Sprintf("%s:%d", string(mi.entry().key), mi.entry().meta.seqNum))
+	}
+	fmt.Println(got)
+	if strings.Join(got, " ") != "a:1 b:5 c:3 d:6" {
+		t.Fatal(got)
+	}
+
+	// switch directions
+	mi.seek([]byte("b"))
+	mi.next()
+	mi.prev()
+	if !mi.valid() || mi.entry().meta.seqNum != 5 {
+		t.Fatal("expected the newest entry of b")
+	}
+	mi.prev()
+	mi.next()
+	if !mi.valid() || mi.entry().meta.seqNum != 5 {
+		t.Fatal("expected the newest entry of b")
+	}
+
+	mi.seekForPrev([]byte("bb"))
+	if !mi.valid() || string(mi.entry().key) != "b" {
+		t.Fatal("expected b")
+	}
+}
+
+func TestMemTableIterator(t *testing.T) {
+	less := DefaultCollectionOptions.SortKeyLess
+
+	mt := newMemTable(less)
+	put := func(key, value string, seqNum uint64) {
+		if err := mt.Put([]byte(key), []byte(value), nil, keyMeta{seqNum: seqNum, opType: opPut}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, key := range []string{"a", "b", "c", "d", "e"} {
+		put(key, key+"1", uint64(i+1))
+	}
+	mv := mt.view()
+
+	// the versions written after seqNum are skipped
+	put("b", "b2", 6)
+	put("bb", "bb2", 7)
+	put("d", "d2", 8)
+
+	it := newMemTableIterator(mv, 5, &iterBounds{less: less, lower: []byte("b"), upper: []byte("d")})
+
+	got := []string{}
+	for it.seekToFirst(); it.valid(); it.next() {
+		got = append(got, string(it.entry().value))
+	}
+	for it.seekToLast(); it.valid(); it.prev() {
+		got = append(got, string(it.entry().value))
+	}
+	fmt.Println(got)
+	if strings.Join(got, " ") != "b1 c1 d1 d1 c1 b1" {
+		t.Fatal(got)
+	}
+
+	if it.seekForPrev([]byte("cc")); !it.valid() || string(it.entry().value) != "c1" {
+		t.Fatal("expected c1")
+	}
+	if it.seek([]byte("a")); !it.valid() || string(it.entry().value) != "b1" {
+		t.Fatal("expected b1")
+	}
+
+	// the newest versions
+	it = newMemTableIterator(mt.view(), 8, &iterBounds{less: less})
+	got = got[:0]
+	for it.seekToFirst(); it.valid(); it.next() {
+		got = append(got, string(it.entry().value))
+	}
+	fmt.Println(got)
+	if strings.Join(got, " ") != "a1 b2 bb2 c1 d2 e1" {
+		t.Fatal(got)
+	}
+}
+
+func TestIterator(t *testing.T) {
+
+	options := DefaultCollectionOptions
+	options.DirPath = t.TempDir()
+	options.CreateIfMissing = true
+	options.MemTableSizeLimit = 16 << 10 // 16KB
+	options.StandardPageSize = 512
+	options.LevelSizeRatio = 4
+	options.NumInitialLevel = 3
+
+	lsm, err := newCollection(&options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+
+	expected := map[string]string{}
+
+	for _, i := range rand.Perm(6000) {
+		key := fmt.Sprintf("key-%05d", i)
+		if err := lsm.Put([]byte(key), []byte(key), []byte(fmt.Sprintf("dkey-%05d", i%100)), nil); err != nil {
+			t.Fatal(err)
+		}
+		expected[key] = key
+	}
+	for i := 0; i < 6000; i += 7 {
+		key := fmt.Sprintf("key-%05d", i)
+		if err := lsm.Put([]byte(key), []byte("new"), []byte(key), nil); err != nil {
+			t.Fatal(err)
+		}
+		expected[key] = "new"
+	}
+	for i := 0; i < 6000; i += 5 {
+		key := fmt.Sprintf("key-%05d", i)
+		if err := lsm.Del([]byte(key), nil); err != nil {
+			t.Fatal(err)
+		}
+		delete(expected, key)
+	}
+	if err := lsm.RangeDel([]byte("key-02000"), []byte("key-02099"), nil); err != nil {
+		t.Fatal(err)
+	}
+	for i := 2000; i < 2100; i++ {
+		delete(expected, fmt.Sprintf("key-%05d", i))
+	}
+
+	testWaitCompacted(t, lsm)
+	fmt.Println("files on levels", testNumFiles(lsm))
+
+	// entries left in memTables
+	for i := 6000; i < 6100; i++ {
+		key := fmt.Sprintf("key-%05d", i)
+		if err := lsm.Put([]byte(key), []byte(key), []byte(key), nil); err != nil {
+			t.Fatal(err)
+		}
+		expected[key] = key
+	}
+
+	keys := make([]string, 0, len(expected))
+	for k := range expected {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	it, err := lsm.NewIterator(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkAt := func(i int) {
+		if i < 0 || i >= len(keys) {
+			if it.Valid() {
+				t.Fatalf("expected invalid, got [%s]", string(it.Key()))
+			}
+			return
+		}
+		if !it.Valid() {
+			t.Fatalf("expected [%s], got invalid %v", keys[i], it.Err())
+		}
+		if string(it.Key()) != keys[i] || string(it.Value()) != expected[keys[i]] {
+			t.Fatalf("expected [%s]:[%s], got [%s]:[%s]", keys[i], expected[keys[i]], string(it.Key()), string(it.Value()))
+		}
+	}
+
+	checkAll := func() {
+		i := 0
+		for it.SeekToFirst(); it.Valid(); it.Next() {
+			checkAt(i)
+			i++
+		}
+		if i != len(keys) || it.Err() != nil {
+			t.Fatalf("iterated %d keys, expected %d, %v", i, len(keys), it.Err())
+		}
+
+		i = len(keys) - 1
+		for it.SeekToLast(); it.Valid(); it.Prev() {
+			checkAt(i)
+			i--
+		}
+		if i != -1 || it.Err() != nil {
+			t.Fatalf("%d keys are not iterated backward, %v", i+1, it.Err())
+		}
+	}
+
+	checkAll()
+
+	// seek and walk in both directions
+	for n := 0; n < 200; n++ {
+		target := fmt.Sprintf("key-%05d", rand.Intn(6200))
+		i := sort.SearchStrings(keys, target)
+
+		it.Seek([]byte(target))
+		checkAt(i)
+
+		for step := 0; step < 10 && it.Valid(); step++ {
+			if rand.Intn(2) == 0 {
+				it.Next()
+				i++
+			} else {
+				it.Prev()
+				i--
+			}
+			checkAt(i)
+		}
+	}
+
+	// the files read by the iterator are replaced meanwhile
+	for i := 0; i < 6000; i++ {
+		key := []byte(fmt.Sprintf("key-%05d", i))
+		if err := lsm.Put(key, []byte("newer"), key, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	testWaitCompacted(t, lsm)
+	fmt.Println("files on levels", testNumFiles(lsm))
+
+	checkAll()
+
+	if err := it.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the replaced files are removed once unpinned
+	numFiles := 0
+	for _, n := range testNumFiles(lsm) {
+		numFiles += n
+	}
+	dirEntries, err := os.ReadDir(options.DirPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	numSSTFiles := 0
+	for _, de := range dirEntries {
+		if path.Ext(de.Name()) == sstFileSuffix {
+			numSSTFiles++
+		}
+	}
+	if numSSTFiles != numFiles {
+		t.Fatalf("%d SST-files under DirPath, %d files on levels", numSSTFiles, numFiles)
+	}
+
+	// a new iterator sees the newer values
+	it, err = lsm.NewIterator(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+
+	it.Seek([]byte("key-00001"))
+	if !it.Valid() || !bytes.Equal(it.Value(), []byte("newer")) {
+		t.Fatalf("got [%s]:[%s]", string(it.Key()), string(it.Value()))
+	}
+}
+
+func TestSSTFileIteratorBounds(t *testing.T) {
+
+	options := DefaultCollectionOptions
+	options.StandardPageSize = 256
+	options.NumPagePerDeleteTile = 4
+
+	lsm, err := newCollection(&options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+
+	// delete keys are not correlated with sort keys
+	es := []entry{}
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("key-%05d", i))
+		deleteKey := []byte(fmt.Sprintf("dkey-%05d", (i*7919)%1000))
+		es = append(es, entry{key: key, value: key, deleteKey: deleteKey, meta: keyMeta{seqNum: uint64(i), opType: opPut}})
+	}
+	file, err := lsm.buildSSTFile("file", 0, es, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	numPage := 0
+	pages := map[int64]*page{}
+	for i := range file.Tiles {
+		for j := range file.Tiles[i].Pages {
+			p := &file.Tiles[i].Pages[j]
+			pages[p.Offset] = p
+			numPage++
+		}
+	}
+
+	for _, ro := range []*ReadOptions{
+		{LowerBound: []byte("key-00300"), UpperBound: []byte("key-00399")},
+		{Prefix: []byte("key-003")},
+	} {
+		fd := &readCountSSTFileDesc{sstFileDesc: file.fd, offsets: map[int64]bool{}}
+		f := *file
+		f.fd = fd
+
+		b := newIterBounds(ro, options.SortKeyLess)
+		it := newSSTFileIterator(&f, b, pageReader{})
+
+		n := 0
+		for it.seekToFirst(); it.valid(); it.next() {
+			if expected := fmt.Sprintf("key-%05d", 300+n); string(it.entry().key) != expected {
+				t.Fatalf("got [%s], expected [%s]", string(it.entry().key), expected)
+			}
+			n++
+		}
+		if n != 100 || it.err() != nil {
+			t.Fatalf("iterated %d entries, expected 100, %v", n, it.err())
+		}
+
+		// the pages out of bounds are never read
+		for off := range fd.offsets {
+			if p := pages[off]; p != nil && !b.overlaps(p.SortKeyMin, p.SortKeyMax) {
+				t.Fatalf("page at offset %d is out of bounds but read", off)
+			}
+		}
+		fmt.Printf("%d of %d pages are read\n", len(fd.offsets), numPage)
+
+		n = 0
+		for it.seekToLast(); it.valid(); it.prev() {
+			n++
+		}
+		if n != 100 {
+			t.Fatalf("iterated %d entries backward, expected 100", n)
+		}
+	}
+}
+
+func TestScan(t *testing.T) {
+
+	options := DefaultCollectionOptions
+	options.MemTableSizeLimit = 16 << 10 // 16KB
+	options.LevelSizeRatio = 4
+	options.NumInitialLevel = 3
+
+	lsm, err := newCollection(&options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+
+	for _, i := range rand.Perm(3000) {
+		key := []byte(fmt.Sprintf("key-%05d", i))
+		if err := lsm.Put(key, key, key, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 3000; i += 2 {
+		if err := lsm.Del([]byte(fmt.Sprintf("key-%05d", i)), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	testWaitCompacted(t, lsm)
+
+	scan := func(low, high []byte, limit int) []string {
+		keys := []string{}
+		err := lsm.Scan(low, high, limit, func(key, value, deleteKey []byte) bool {
+			if !bytes.Equal(key, value) || !bytes.Equal(key, deleteKey) {
+				t.Fatalf("key [%s] got [%s] [%s]", string(key), string(value), string(deleteKey))
+			}
+			keys = append(keys, string(key))
+			return true
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return keys
+	}
+
+	keys := scan([]byte("key-01000"), []byte("key-01099"), 0)
+	if len(keys) != 50 || keys[0] != "key-01001" || keys[49] != "key-01099" {
+		t.Fatal(len(keys), keys)
+	}
+
+	keys = scan([]byte("key-01000"), nil, 10)
+	if len(keys) != 10 || keys[9] != "key-01019" {
+		t.Fatal(keys)
+	}
+
+	if keys = scan(nil, nil, 0); len(keys) != 1500 {
+		t.Fatal(len(keys))
+	}
+
+	// stop early
+	n := 0
+	lsm.Scan(nil, nil, 0, func(key, value, deleteKey []byte) bool {
+		n++
+		return n < 3
+	})
+	if n != 3 {
+		t.Fatal(n)
+	}
+
+	// prefix in both directions
+	it, err := lsm.NewIterator(&ReadOptions{Prefix: []byte("key-0200")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+
+	got := []string{}
+	for it.SeekToLast(); it.Valid(); it.Prev() {
+		got = append(got, string(it.Key()))
+	}
+	if strings.Join(got, " ") != "key-02009 key-02007 key-02005 key-02003 key-02001" {
+		t.Fatal(got)
+	}
+
+	if it.Seek([]byte("key-00000")); !it.Valid() || string(it.Key()) != "key-02001" {
+		t.Fatal(string(it.Key()))
+	}
+	if it.Seek([]byte("key-02010")); it.Valid() {
+		t.Fatal(string(it.Key()))
+	}
+}
@@ -2,6 +2,8 @@ package lethe
 
 import (
 	"errors"
+	"fmt"
+	"os"
 	"time"
 )
 
@@ -24,10 +26,87 @@ var (
 	// ErrClosed is returned when the collection is already closed.
 	ErrClosed = errors.New("closed")
 
+	// ErrNotExists is returned when no collection exists under DirPath and CreateIfMissing is false.
+	ErrNotExists = errors.New("collection-not-exists")
+
+	// ErrExists is returned when a collection already exists under DirPath and ErrorIfExists is true.
+	ErrExists = errors.New("collection-exists")
+
+	// ErrLocked is returned when the collection under DirPath is opened by another Collection.
+	ErrLocked = errors.New("collection-locked")
+
+	// ErrInvalidBatch is returned when a Batch is not created by the Collection executing it.
+	ErrInvalidBatch = errors.New("invalid-batch")
+
+	// ErrUnknownCompression is returned when a codec of compression is not registered,
+	// or a custom Compressor reuses the id of another codec.
+	ErrUnknownCompression = errors.New("unknown-compression")
+
+	// ErrCorruption is returned when the data read from a file is corrupted, e.g. its checksum mismatches,
+	// which is wrapped by a *CorruptionError telling where it is.
+	ErrCorruption = errors.New("corruption")
+
 	// TODO
 	// define other errors
 )
 
+// CorruptionError is the error of corrupted data at Offset of File, errors.Is(err, ErrCorruption) holds for it.
+type CorruptionError struct {
+	File   string
+	Offset int64
+	Reason string
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("%v: file [%s] offset %d: %s", ErrCorruption, e.File, e.Offset, e.Reason)
+}
+
+func (e *CorruptionError) Unwrap() error {
+	return ErrCorruption
+}
+
+// CompactionPolicy decides which files of a saturated level are compacted into the next level.
+type CompactionPolicy int
+
+const (
+	// CompactionPolicySO picks the file with the smallest overlap with the next level,
+	// a tie is broken by picking the file with the most tombstones.
+	CompactionPolicySO CompactionPolicy = iota
+
+	// CompactionPolicySD picks the file with the highest estimated number of entries invalidated by its tombstones,
+	// a tie is broken by picking the file that contains the oldest tombstone.
+	CompactionPolicySD
+)
+
+// Compression is the id of a codec compressing the pages of SST-files, which is recorded with each page.
+type Compression uint8
+
+const (
+	// NoCompression keeps pages as they are.
+	NoCompression Compression = iota
+
+	// FlateCompression compresses pages in the DEFLATE format of compress/flate.
+	FlateCompression
+
+	// ZlibCompression compresses pages in the zlib format of compress/zlib.
+	ZlibCompression
+)
+
+// Compressor is a custom codec of compression, registered by CollectionOptions.Compressors.
+// A page is kept uncompressed if the Compressor does not make it smaller.
+type Compressor interface {
+
+	// Compression returns the id of codec, which must be distinct from the builtin ones,
+	// and stable because the SST-files written are only readable with the same codec.
+	Compression() Compression
+
+	// Compress returns the compressed bytes of src.
+	Compress(src []byte) ([]byte, error)
+
+	// Decompress returns the bytes decompressed from src.
+	Decompress(src []byte) ([]byte, error)
+}
+
 // CollectionOptions allows applications to specify config settings.
 type CollectionOptions struct {
 
@@ -45,11 +124,32 @@ type CollectionOptions struct {
 
 	// persist
 	// Path is the file path of the Collection directory.
+	// Every mutation is recorded in the write-ahead log under DirPath before it is applied,
+	// and the persisted levels are recorded in the MANIFEST under DirPath,
+	// so that a Collection created on the same DirPath reopens the data.
+	// SST-files are written to disk under DirPath as well.
+	// An empty DirPath makes the Collection ephemeral: SST-files are kept in memory,
+	// and there is no write-ahead log nor MANIFEST, so nothing survives Close.
 	DirPath string
 
 	// CreateIfMissing creates a new Collection if DirPath specified is not existed.
 	CreateIfMissing bool
 
+	// ErrorIfExists returns an error if a Collection already exists under DirPath.
+	ErrorIfExists bool
+
+	// FlushOnClose persists the current memTable on Close,
+	// otherwise its mutations are replayed from the write-ahead log when the Collection is reopened.
+	FlushOnClose bool
+
+	// WALSyncInterval is the interval of syncing the write-ahead log to disk,
+	// so a write without Sync is durable within the interval, and the writes meanwhile share one sync.
+	// A non-positive value disables the periodic sync.
+	WALSyncInterval time.Duration
+
+	// CompactionPolicy is the file selection policy of saturation-driven compaction.
+	CompactionPolicy CompactionPolicy
+
 	// DeletePersistThreshold, all tombstones are persisted within a delete persistence threshold.
 	// DeletePersistThreshold is denoted by D_th in paper 4.1 .
 	DeletePersistThreshold time.Duration
@@ -65,13 +165,76 @@ type CollectionOptions struct {
 	// An import tuning knob of LSM tree.
 	NumPagePerDeleteTile int
 
+	// BloomBitsPerKey is the number of bits per key of the bloom filter built for each page.
+	// A non-positive value disables bloom filters.
+	BloomBitsPerKey int
+
+	// BlockCacheSize is the capacity in bytes of the LRU cache of pages read from SST-files,
+	// which is shared by all the reads of collection. A non-positive value disables the cache.
+	BlockCacheSize int64
+
+	// CacheFilterBlocks keeps the bloom filters of SST-files in the block cache instead of in memory,
+	// which bounds their memory by BlockCacheSize at the cost of reading them again once evicted.
+	// The index of SST-file is always kept in memory, because the fences of pages are used
+	// without reading by compactions and secondary range deletes. It is ignored without the block cache.
+	CacheFilterBlocks bool
+
+	// Compression is the codec of pages of SST-files, which only applies to the files written later.
+	Compression Compression
+
+	// LevelCompressions are the codecs of pages on levels, LevelCompressions[i] for `Level i+1`,
+	// and the levels beyond use Compression, e.g. hot upper levels are kept uncompressed.
+	LevelCompressions []Compression
+
+	// Compressors are the custom codecs which can be used by Compression and LevelCompressions.
+	Compressors []Compressor
+
+	// MaxOpenFiles is the maximum number of SST-files kept open, the least recently used ones are closed
+	// and reopened on demand. A non-positive value keeps all the SST-files open.
+	MaxOpenFiles int
+
+	// MaxBackgroundCompactions is the number of workers running compactions concurrently, at least one.
+	MaxBackgroundCompactions int
+
+	// MaxSubcompactions is the maximum number of key ranges of a compaction which are merged concurrently.
+	MaxSubcompactions int
+
+	// write stalls
+	// Writes are stopped when one of the stop conditions below holds, until persistence or compaction makes progress,
+	// and they are slowed down when one of the slowdown conditions holds. A non-positive value disables the condition.
+
+	// MaxImmutableMemTables stops writes when as many immutable memTables wait to be persisted.
+	MaxImmutableMemTables int
+
+	// Level1SlowdownWritesTrigger slows down writes when `Level 1` has as many files,
+	// which also triggers the compaction of `Level 1`.
+	Level1SlowdownWritesTrigger int
+
+	// Level1StopWritesTrigger stops writes when `Level 1` has as many files.
+	Level1StopWritesTrigger int
+
+	// SoftPendingCompactionBytesLimit slows down writes when the estimated bytes to be compacted,
+	// i.e. the bytes of levels beyond their capacities, reach the limit.
+	SoftPendingCompactionBytesLimit int64
+
+	// HardPendingCompactionBytesLimit stops writes when the estimated bytes to be compacted reach the limit.
+	HardPendingCompactionBytesLimit int64
+
 	// ----------------------------------------------------------------------------
 
 	// Unexposed data filed
 	// buffer length of chan which is persistence trigger
 	persistTriggerBufLen int
-	// buffer length of chan which is comapction trigger
-	compactTriggerBufLen int
+	// delay before the first retry of a failed persistence, which doubles on each retry
+	persistRetryDelay time.Duration
+	// interval of checking tombstones against TTLs of levels
+	ttlCheckInterval time.Duration
+	// clock of collection, time.Now if nil
+	clock func() time.Time
+	// delay of each write slowed down by write stalls
+	writeSlowdownDelay time.Duration
+	// wraps the file of each log segment, e.g. to simulate crashes in tests, nil for *os.File
+	wrapLogFile func(f *os.File) logFile
 }
 
 // DefaultCollectionOptions are the default configuration options.
@@ -82,38 +245,164 @@ var DefaultCollectionOptions = CollectionOptions{
 	LevelSizeRatio:         10.0,                                                    // practical value
 	DirPath:                "",                                                      //
 	CreateIfMissing:        false,                                                   //
+	ErrorIfExists:          false,                                                   //
+	FlushOnClose:           false,                                                   //
+	WALSyncInterval:        0,                                                       // sync by Sync writes only
+	CompactionPolicy:       CompactionPolicySO,                                      // minimize merging cost
 	DeletePersistThreshold: 24 * time.Hour,                                          // one day
 	NumInitialLevel:        6,                                                       // practical value
 	StandardPageSize:       4 * 1024,                                                // 4KB
 	NumPagePerDeleteTile:   8,                                                       // practical value
+	BloomBitsPerKey:        10,                                                      // about 1% false positive rate
+	BlockCacheSize:         8 << 20,                                                 // 8MB
+	CacheFilterBlocks:      false,                                                   //
+	MaxOpenFiles:           1000,                                                    //
+	Compression:            NoCompression,                                           //
+
+	MaxBackgroundCompactions:        2,         //
+	MaxSubcompactions:               1,         //
+	MaxImmutableMemTables:           4,         //
+	Level1SlowdownWritesTrigger:     20,        //
+	Level1StopWritesTrigger:         36,        //
+	SoftPendingCompactionBytesLimit: 64 << 30,  // 64GB
+	HardPendingCompactionBytesLimit: 256 << 30, // 256GB
 
 	// -------------------------------------------
 
-	persistTriggerBufLen: 5, //
-	compactTriggerBufLen: 5, //
+	persistTriggerBufLen: 5,                      //
+	persistRetryDelay:    100 * time.Millisecond, //
+	ttlCheckInterval:     time.Minute,            //
+	writeSlowdownDelay:   time.Millisecond,       //
 }
 
 // CollectionStats shows a status of collection.
+// The counters are accumulated since the Collection is opened.
 type CollectionStats struct {
-	// TODO
-	// TotXXX
-	// CurXXX
+
+	// NumPut, NumGet, NumDel, NumRangeDel and NumDelByDeleteKeyRange are the numbers of operations,
+	// the mutations in a Batch are counted one by one.
+	NumPut                 int64
+	NumGet                 int64
+	NumDel                 int64
+	NumRangeDel            int64
+	NumDelByDeleteKeyRange int64
+
+	// BytesWritten is the number of bytes of keys and values written by users.
+	BytesWritten int64
+
+	// MemTableSize is the number of bytes of the current memTable.
+	MemTableSize int
+	// NumImmutableMemTable is the number of immutable memTables waiting to be persisted.
+	NumImmutableMemTable int
+
+	// Levels are the stats of persisted levels, Levels[0] is `Level 1`.
+	Levels []LevelStats
+
+	// NumFlush is the number of immutable memTables persisted as SST-files.
+	NumFlush int64
+	// FlushDuration is the total time spent on flushes.
+	FlushDuration time.Duration
+	// FlushBytes is the number of bytes of SST-files written by flushes.
+	FlushBytes int64
+
+	// NumCompaction is the number of compactions,
+	// of which NumDeleteDrivenCompaction are triggered by the tombstones expired against TTLs of levels.
+	NumCompaction             int64
+	NumDeleteDrivenCompaction int64
+	// CompactionDuration is the total time spent on compactions.
+	CompactionDuration time.Duration
+	// CompactionBytesRead is the number of bytes of SST-files merged by compactions.
+	CompactionBytesRead int64
+	// CompactionBytesWritten is the number of bytes of SST-files written by compactions,
+	// including the SST-files rewritten by secondary range deletes.
+	CompactionBytesWritten int64
+
+	// NumWriteSlowdown and NumWriteStop are the numbers of writes slowed down and stopped by write stalls,
+	// and WriteStallDuration is the total time for which they are stalled.
+	NumWriteSlowdown   int64
+	NumWriteStop       int64
+	WriteStallDuration time.Duration
+	// WriteStallReason is the reason why writes are stalled now, empty if they are not.
+	WriteStallReason string
+	// PendingCompactionBytes is the estimated number of bytes to be compacted until no level is saturated.
+	PendingCompactionBytes int64
+
+	// WriteAmplification is the number of bytes of SST-files written per byte written by users.
+	WriteAmplification float64
+	// ReadAmplification is the average number of pages read from SST-files per Get.
+	ReadAmplification float64
+	// SpaceAmplification is the number of bytes of all levels per byte of the last non-empty level.
+	SpaceAmplification float64
+
+	// BlockCacheHit and BlockCacheMiss are the numbers of lookups of pages and filters in the block cache,
+	// BlockCacheUsage is the number of bytes cached, and BlockCacheCapacity is BlockCacheSize.
+	BlockCacheHit      int64
+	BlockCacheMiss     int64
+	BlockCacheUsage    int64
+	BlockCacheCapacity int64
+}
+
+// LevelStats shows a status of persisted level.
+type LevelStats struct {
+	NumFile int
+	// Size is the number of bytes of files on level, and SizeLimit is the capacity of level.
+	Size      int64
+	SizeLimit int64
+	// NumEntry includes the point tombstones, i.e. NumDelete.
+	NumEntry    int
+	NumDelete   int
+	NumRangeDel int
+	// AgeOldestTomb is the age of the oldest tombstone on level, 0 if there is no tombstone.
+	AgeOldestTomb time.Duration
+	// TTL is the time-to-live of tombstones on level.
+	TTL time.Duration
 }
 
 // ReadOptions are provided to Read operation.
+// The zero value is the default, which is the same as nil ReadOptions.
 type ReadOptions struct {
-	// define some read options if necessary
+
+	// LowerBound limits an Iterator to the keys greater than or equal to it, nil for unbounded.
+	LowerBound []byte
+
+	// UpperBound limits an Iterator to the keys less than or equal to it, nil for unbounded.
+	UpperBound []byte
+
+	// Prefix limits an Iterator to the keys with the prefix, nil for unbounded.
+	// The keys with the same prefix must be contiguous in the order of sort key, e.g. dictionary order.
+	Prefix []byte
+
+	// DontFillCache keeps the pages read out of the block cache, which should be true for a big scan
+	// so that it does not evict the working set. The pages already cached are used either way.
+	DontFillCache bool
+
+	// SkipChecksums skips verifying the checksums of pages read from SST-files, otherwise a read fails
+	// with ErrCorruption on mismatch. The pages filled into the block cache and the pages read by compactions
+	// are always verified.
+	SkipChecksums bool
 }
 
+// DefaultReadOptions are the options of a read with nil ReadOptions, i.e. the zero value.
+var DefaultReadOptions = ReadOptions{}
+
 // WriteOptions are provided to Write operation.
 type WriteOptions struct {
-	// define some write options if necessary
+
+	// Sync makes a write durable on disk before it returns, by syncing the write-ahead log.
+	// Without Sync, a write survives a crash of the process but may be lost by a crash of the machine,
+	// unless the write-ahead log is synced meanwhile, see WALSyncInterval.
+	Sync bool
+
+	// NoDurability skips the write-ahead log, e.g. for a bulk load which can be redone,
+	// so a write is lost by a crash before its memTable is persisted. Sync is ignored with NoDurability.
+	NoDurability bool
 }
 
 // A Collection represents an ordered mapping of key-val entries.
 type Collection interface {
 
 	// Close synchronously stops background tasks and releases resources.
+	// Every method returns ErrClosed after Close.
 	Close() error
 
 	// Get retrieves a value from the collection for a given key
@@ -129,6 +418,18 @@ type Collection interface {
 	// RangeDel deletes the range [lowKey, highKey] on the sort key
 	RangeDel(lowKey, highKey []byte, writeOptions *WriteOptions) error
 
+	// DelByDeleteKeyRange deletes the key-val entries whose delete key is in the range [lowDKey, highDKey].
+	DelByDeleteKeyRange(lowDKey, highDKey []byte, writeOptions *WriteOptions) error
+
+	// NewIterator returns an Iterator over the key-val entries of the Collection in the order of sort key.
+	// The Iterator must be closed after use.
+	NewIterator(readOptions *ReadOptions) (Iterator, error)
+
+	// Scan calls fn on the key-val entries whose sort key is in [low, high] in the order of sort key,
+	// until fn returns false or limit entries are scanned if limit is positive.
+	// A nil low or high leaves the range unbounded on that side.
+	Scan(low, high []byte, limit int, fn func(key, value, deleteKey []byte) bool) error
+
 	// Options returns the options currently being used.
 	Options() CollectionOptions
 
@@ -136,24 +437,57 @@ type Collection interface {
 	// Note that stats might be updated asynchronously.
 	Stats() (*CollectionStats, error)
 
-	/*
-		// TODO
-		// advanced feature below:
+	// Snapshot returns a stable read-only Snapshot of the key-val entries.
+	// The Snapshot must be closed after use, since the files read by it are kept until then.
+	Snapshot() (Snapshot, error)
+
+	// WriteBatch returns a new WriteBatch instance.
+	WriteBatch() (Batch, error)
 
-		// Snapshot returns a stable ready-only Snapshot of the key-value entries.
-		Snapshot() (Snapshot, error)
+	// ExecuteWriteBatch atomically incorporates the provided Batch into
+	// the Collection.  The Batch instance should be Close()'ed and
+	// not reused after ExecuteBatch() returns.
+	ExecuteWriteBatch(b Batch, writeOptions *WriteOptions) error
+}
+
+// An Iterator iterates over the key-val entries of a Collection in the order of sort key.
+// Deleted entries are skipped, and the entries written after the Iterator is created are not seen.
+// The slices returned by Key, Value and DeleteKey must not be modified.
+type Iterator interface {
+	// Seek moves to the first key that is greater than or equal to key.
+	Seek(key []byte)
+
+	// SeekToFirst moves to the first key.
+	SeekToFirst()
+
+	// SeekToLast moves to the last key.
+	SeekToLast()
+
+	// Next moves to the next key.
+	Next()
+
+	// Prev moves to the previous key.
+	Prev()
+
+	// Valid returns whether the Iterator is positioned at a key.
+	Valid() bool
+
+	// Key returns the sort key at current position.
+	Key() []byte
+
+	// Value returns the value at current position.
+	Value() []byte
+
+	// DeleteKey returns the delete key at current position.
+	DeleteKey() []byte
 
-		// WriteBatch returns a new WriteBatch instance.
-		WriteBatch() (Batch, error)
+	// Err returns the error met by the Iterator, if any.
+	Err() error
 
-		// ExecuteWriteBatch atomically incorporates the provided Batch into
-		// the Collection.  The Batch instance should be Close()'ed and
-		// not reused after ExecuteBatch() returns.
-		ExecuteWriteBatch(b Batch, writeOptions WriteOptions) error
-	*/
+	// Close must be invoked to release resources.
+	Close() error
 }
 
-/*
 // A Snapshot is a stable view of a Collection for readers, isolated
 // from concurrent mutation activity.
 type Snapshot interface {
@@ -162,29 +496,38 @@ type Snapshot interface {
 
 	// Get retrieves a val from the Snapshot, and will return nil val
 	// if the entry does not exist in the Snapshot.
-	Get(key []byte, readOptions ReadOptions) ([]byte, error)
+	Get(key []byte, readOptions *ReadOptions) ([]byte, error)
+
+	// NewIterator returns an Iterator over the key-val entries of the Snapshot.
+	NewIterator(readOptions *ReadOptions) (Iterator, error)
 }
 
 // A Batch is a set of mutations that will be incorporated atomically
-// into a Collection.  NOTE: the keys in a Batch must be unique.
+// into a Collection, with the mutations applied in the order they are added.
+// A mutation is validated when it is added, so that an invalid one is rejected
+// before anything is applied.
 type Batch interface {
 	// Close must be invoked to release resources.
 	Close() error
 
-	// Put creates or updates an key-val entry in the Collection.  The
-	// key must be unique (not repeated) within the Batch.  Put()
-	// copies the key and val bytes into the Batch, so the memory
-	// bytes of the key and val may be reused by the caller.
-	Put(key, val []byte) error
-
-	// Del deletes a key-val entry from the Collection.  The key must
-	// be unique (not repeated) within the Batch.  Del copies the key
-	// bytes into the Batch, so the memory bytes of the key may be
-	// reused by the caller.  Del() on a non-existent key results in a
-	// nil error.
+	// Put creates or updates an key-val entry in the Collection.
+	// Put copies the key, val and delete key bytes into the Batch,
+	// so the memory bytes of them may be reused by the caller.
+	Put(key, val, dKey []byte) error
+
+	// Del deletes a key-val entry from the Collection.
+	// Del() on a non-existent key results in a nil error.
 	Del(key []byte) error
+
+	// RangeDel deletes the range [lowKey, highKey] on the sort key.
+	RangeDel(lowKey, highKey []byte) error
+
+	// DelByDeleteKeyRange deletes the key-val entries whose delete key is in the range [lowDKey, highDKey].
+	DelByDeleteKeyRange(lowDKey, highDKey []byte) error
+
+	// Len returns the number of mutations in the Batch.
+	Len() int
 }
-*/
 
 // ---------------------------------------------------------------------
 
@@ -192,7 +535,10 @@ type Batch interface {
 func NewCollection(options CollectionOptions) (Collection, error) {
 
 	// init collection
-	c := newCollection(&options)
+	c, err := newCollection(&options)
+	if err != nil {
+		return nil, err
+	}
 
 	return c, nil
 }
@@ -1,6 +1,7 @@
 package lethe
 
 import (
+	"fmt"
 	"log"
 	"math"
 	"sync"
@@ -19,7 +20,7 @@ import (
 
 type level struct {
 	// lock for level filed
-	sync.Mutex `json:"-"`
+	sync.Mutex
 
 	// ttl(time-to-live) is denoted by d_i in paper 4.1.2
 	ttl int64
@@ -29,7 +30,7 @@ type level struct {
 	// keep sorted on sort key
 	Files []*sstFile
 
-	SizeLimit int
+	SizeLimit int64
 }
 
 // addNewLevel adds a new level to the bottom of LSM and reset TTL for each level
@@ -42,9 +43,9 @@ func (lsm *collection) addNewLevel() error {
 	lv.Files = []*sstFile{}
 
 	if len(lsm.levels) == 0 { // level 1
-		lv.SizeLimit = lsm.options.LevelSizeRatio * lsm.options.MemTableSizeLimit
+		lv.SizeLimit = int64(lsm.options.LevelSizeRatio) * int64(lsm.options.MemTableSizeLimit)
 	} else { // level 2~(L-1)
-		lv.SizeLimit = lsm.options.LevelSizeRatio * lsm.levels[len(lsm.levels)-1].SizeLimit
+		lv.SizeLimit = int64(lsm.options.LevelSizeRatio) * lsm.levels[len(lsm.levels)-1].SizeLimit
 	}
 
 	// add a new level
@@ -53,9 +54,17 @@ func (lsm *collection) addNewLevel() error {
 	// recalculate TTL for each level
 	lsm.setLevelsTTL()
 
-	log.Printf("add a persistent level-%d (limit %s) and recalculate TTLs\n", len(lsm.levels), beautifulNumByte(lsm.levels[len(lsm.levels)-1].SizeLimit))
+	log.Printf("add a persistent level-%d (limit %s) and recalculate TTLs\n", len(lsm.levels), beautifulNumByte(int(lsm.levels[len(lsm.levels)-1].SizeLimit)))
 
-	return nil
+	edit := &versionEdit{
+		NumLevel:  len(lsm.levels),
+		LevelTTLs: make([]int64, len(lsm.levels)),
+	}
+	for i := 0; i < len(lsm.levels); i++ {
+		edit.LevelTTLs[i] = atomic.LoadInt64(&lsm.levels[i].ttl)
+	}
+
+	return lsm.logEdit(edit)
 }
 
 // ----------------------------------------------------------------------------------------------------------------
@@ -78,6 +87,53 @@ func (lsm *collection) setLevelsTTL() {
 	}
 }
 
+// tombDeadlines returns the deadlines of tombstones on the in-memory level 0 and on the persisted levels, Unix seconds.
+// A tombstone older than the deadline of its level has lived longer than the accumulated TTL d_0 + ... + d_i,
+// and it should be compacted to the next level.
+func (lsm *collection) tombDeadlines(now time.Time) (memTable uint32, levels []uint32) {
+	lsm.RLock()
+	defer lsm.RUnlock()
+
+	deadline := func(acc int64) uint32 {
+		return uint32(now.Add(-time.Duration(acc)).Unix())
+	}
+
+	// d_0 of `in-memory Level 0`
+	acc := computeTTL(lsm.options.DeletePersistThreshold, 0, lsm.options.LevelSizeRatio, 1+len(lsm.levels))
+	memTable = deadline(acc)
+
+	levels = make([]uint32, len(lsm.levels))
+	for i := 0; i < len(lsm.levels); i++ {
+		acc += atomic.LoadInt64(&lsm.levels[i].ttl)
+		levels[i] = deadline(acc)
+	}
+
+	return memTable, levels
+}
+
+// levelOldestTomb returns the age of oldest tomb on the level, 0 if there is no tomb.
+func (lsm *collection) levelOldestTomb(levelIndex int) uint32 {
+	lsm.RLock()
+	defer lsm.RUnlock()
+
+	if levelIndex >= len(lsm.levels) {
+		return 0
+	}
+
+	lv := lsm.levels[levelIndex]
+	lv.Lock()
+	defer lv.Unlock()
+
+	var oldest uint32 = 0
+	for _, f := range lv.Files {
+		if olderTomb(f.AgeOldestTomb, oldest) {
+			oldest = f.AgeOldestTomb
+		}
+	}
+
+	return oldest
+}
+
 // // computeTTL is a pure function computing the TTL of a level
 // In paper 4.1.2 Computing d_i
 // deletePersistThreshold is denoted by D_th
@@ -101,7 +157,8 @@ func computeTTL(deletePersistThreshold time.Duration, levelID int, levelSizeRati
 // ----------------------------------------------------------------------------------------------------------------
 
 // getFromLevel gets value by key from a level
-func (lsm *collection) getFromLevel(lv *level, key []byte) (found bool, value []byte, meta keyMeta) {
+// tombSeqNum is raised to the greatest seqNum of range tombstones covering key.
+func (lsm *collection) getFromLevel(lv *level, key []byte, tombSeqNum *uint64, r pageReader) (found bool, value []byte, meta keyMeta, err error) {
 	// Level lock
 	lv.Lock()
 	defer lv.Unlock()
@@ -111,14 +168,14 @@ func (lsm *collection) getFromLevel(lv *level, key []byte) (found bool, value []
 	// if key is not found in newer file, search in older file.
 	for i := len(lv.Files) - 1; i >= 0; i-- {
 
-		if found, value, meta = lsm.getFromSSTFile(lv.Files[i], key); found {
-			return true, value, meta
+		if found, value, meta, err = lsm.getFromSSTFile(lv.Files[i], key, tombSeqNum, r); found || err != nil {
+			return found, value, meta, err
 		}
 
 		// If key is not found, keep searching in next sstFile
 	}
 
-	return false, nil, meta
+	return false, nil, meta, nil
 }
 
 // -----------------------------------------------------------------------------
@@ -127,60 +184,144 @@ func (lsm *collection) getFromLevel(lv *level, key []byte) (found bool, value []
 // add a sstFile to level
 // ----------------------------------------------------------------------------------------------------------------
 
-// TODO
+// size returns the number of bytes of files on level
+func (lv *level) size() int64 {
+	lv.Lock()
+	defer lv.Unlock()
+
+	var sum int64 = 0
+	for _, f := range lv.Files {
+		sum += f.Size
+	}
+	return sum
+}
 
-func (lsm *collection) addFileToLevel(lv *level, file *sstFile) {
+// addFileToLevel adds the newest file to the back of level, then SO compaction if necessary
+func (lsm *collection) addFileToLevel(levelIndex int, file *sstFile) {
+	lsm.Lock()
+	lv := lsm.levels[levelIndex]
 	lv.Lock()
-	lv.Unlock()
 
 	lv.Files = append(lv.Files, file)
 
-	// sort
+	lv.Unlock()
+	lsm.updateWriteStallCounters()
+	lsm.Unlock()
 
-	// TODO
-	// SO compaction if necessary
+	lsm.maybeCompact(levelIndex)
 }
 
 // -----------------------------------------------------------------------------
 
-// replaceSSTFileOnLevel replace toRemove files with toInset files on the level
-func (lsm *collection) replaceFilesOnLevel(lv *level, toRemove []*sstFile, toInsert []*sstFile) error {
-	// Level Lock
+// removeFiles returns files without the files in toRemove
+func removeFiles(files []*sstFile, toRemove []*sstFile) []*sstFile {
+	newFiles := []*sstFile{}
+	for i := 0; i < len(files); i++ {
+		if !containsFile(toRemove, files[i]) {
+			newFiles = append(newFiles, files[i])
+		}
+	}
+	return newFiles
+}
+
+// replaceFilesOnLevels atomically removes inputs from a level, removes overlaps from the next level,
+// and adds outputs to the next level. Readers see either all the old files or all the new files.
+func (lsm *collection) replaceFilesOnLevels(levelIndex int, inputs, overlaps, outputs []*sstFile) error {
+	// LSM Lock excludes readers
+	lsm.Lock()
+	defer lsm.Unlock()
+	// after the level locks are released
+	defer lsm.updateWriteStallCounters()
+
+	lv := lsm.levels[levelIndex]
+	nextLevel := lsm.levels[levelIndex+1]
+
+	// Level Lock, in the order of level
 	lv.Lock()
 	defer lv.Unlock()
+	nextLevel.Lock()
+	defer nextLevel.Unlock()
 
-	if toRemove == nil {
-		// do nothing
-	} else {
-		newFiles := []*sstFile{}
-
-		inToRemove := func(file *sstFile) bool {
-			for i := 0; i < len(toRemove); i++ {
-				if file == toRemove[i] {
-					return true
-				}
-			}
-			return false
+	for _, f := range inputs {
+		if !containsFile(lv.Files, f) {
+			return fmt.Errorf("SST-file [%s] is not on level-%d", f.Name, levelIndex+1)
 		}
-
-		// remove files
-		for i := 0; i < len(lv.Files); i++ {
-			if !inToRemove(lv.Files[i]) {
-				newFiles = append(newFiles, lv.Files[i])
-			}
+	}
+	for _, f := range overlaps {
+		if !containsFile(nextLevel.Files, f) {
+			return fmt.Errorf("SST-file [%s] is not on level-%d", f.Name, levelIndex+2)
 		}
-		lv.Files = newFiles
 	}
 
-	// add the newest file to the back of level.files
-	lv.Files = append(lv.Files, toInsert...)
+	// record the replacement before it is visible
+	edit := &versionEdit{}
+	for _, f := range inputs {
+		edit.Removed = append(edit.Removed, fileEdit{Level: levelIndex, Name: f.Name})
+	}
+	for _, f := range overlaps {
+		edit.Removed = append(edit.Removed, fileEdit{Level: levelIndex + 1, Name: f.Name})
+	}
+	for _, f := range outputs {
+		edit.Added = append(edit.Added, fileEdit{Level: levelIndex + 1, Name: f.Name})
+	}
+	if err := lsm.logEdit(edit); err != nil {
+		return err
+	}
+
+	lv.Files = removeFiles(lv.Files, inputs)
+
+	// add the newest files to the back of level.files
+	nextLevel.Files = append(removeFiles(nextLevel.Files, overlaps), outputs...)
+
+	return nil
+}
+
+// replaceFileOnLevel replaces file on the level of levelIndex with newFile in place,
+// or removes it if newFile is nil.
+func (lsm *collection) replaceFileOnLevel(levelIndex int, file, newFile *sstFile) error {
+	// LSM Lock excludes readers
+	lsm.Lock()
+	defer lsm.Unlock()
+	// after the level lock is released
+	defer lsm.updateWriteStallCounters()
+
+	lv := lsm.levels[levelIndex]
+
+	// Level Lock
+	lv.Lock()
+	defer lv.Unlock()
+
+	i := 0
+	for i < len(lv.Files) && lv.Files[i] != file {
+		i++
+	}
+	if i == len(lv.Files) {
+		return fmt.Errorf("SST-file [%s] is not on level-%d", file.Name, levelIndex+1)
+	}
+
+	// record the replacement before it is visible
+	edit := &versionEdit{}
+	if newFile != nil {
+		edit.Added = []fileEdit{{Level: levelIndex, Name: newFile.Name, Old: file.Name}}
+	} else {
+		edit.Removed = []fileEdit{{Level: levelIndex, Name: file.Name}}
+	}
+	if err := lsm.logEdit(edit); err != nil {
+		return err
+	}
+
+	if newFile != nil {
+		lv.Files[i] = newFile
+	} else {
+		lv.Files = append(lv.Files[:i], lv.Files[i+1:]...)
+	}
 
 	return nil
 }
 
-// findOverlapFiles returns unsorted the files overlapping with target file.
-// If there is no file overlapping with target file, then returns nil.
-func (lsm *collection) findOverlapFiles(lv *level, target *sstFile) []*sstFile {
+// findOverlapRange returns unsorted the files overlapping with the range [sortKeyMin, sortKeyMax].
+// If there is no file overlapping with the range, then returns nil.
+func (lsm *collection) findOverlapRange(lv *level, sortKeyMin, sortKeyMax []byte) []*sstFile {
 	// Level Lock
 	lv.Lock()
 	defer lv.Unlock()
@@ -188,12 +329,9 @@ func (lsm *collection) findOverlapFiles(lv *level, target *sstFile) []*sstFile {
 	founds := []*sstFile{}
 
 	less := lsm.options.SortKeyLess
-	isOverlap := func(f *sstFile) bool {
-		return !(less(target.SortKeyMax, f.SortKeyMin) || less(f.SortKeyMax, target.SortKeyMin))
-	}
 
 	for i := 0; i < len(lv.Files); i++ {
-		if isOverlap(lv.Files[i]) {
+		if isOverlapRange(less, sortKeyMin, sortKeyMax, lv.Files[i].SortKeyMin, lv.Files[i].SortKeyMax) {
 			founds = append(founds, lv.Files[i])
 		}
 	}
@@ -0,0 +1,386 @@
+package lethe
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sync"
+	"sync/atomic"
+)
+
+// MANIFEST is a log of versionEdit records under DirPath.
+// Replaying all records from the first one rebuilds the persisted levels of a collection.
+//
+// When a collection is opened, the recovered state is written to a new MANIFEST as a single record,
+// which atomically replaces the old one, and then later edits are appended to it.
+
+const (
+	manifestFileName    = "MANIFEST"
+	manifestTmpFileName = "MANIFEST.tmp"
+
+	// manifestFormatVersion is the format version of versionEdit records
+	manifestFormatVersion = 1
+)
+
+// versionEdit is a change of the persisted levels.
+type versionEdit struct {
+	// Version is the format version of MANIFEST, which is only set in the first record.
+	Version int `json:"v,omitempty"`
+
+	// NextFileNum is the next number of file under DirPath.
+	NextFileNum uint64 `json:"n,omitempty"`
+
+	// NumLevel and LevelTTLs are set when persisted levels are added.
+	NumLevel  int     `json:"l,omitempty"`
+	LevelTTLs []int64 `json:"t,omitempty"`
+
+	// files added to or removed from levels
+	Added   []fileEdit `json:"a,omitempty"`
+	Removed []fileEdit `json:"r,omitempty"`
+}
+
+type fileEdit struct {
+	// Level is the index of lsm.levels, i.e. `Level 1` is 0.
+	Level int `json:"l"`
+
+	Name string `json:"n"`
+
+	// Old is set if the added file takes the place of an old file on the level,
+	// which keeps the order of files on `Level 1`.
+	Old string `json:"o,omitempty"`
+}
+
+type manifest struct {
+	sync.Mutex
+
+	dirPath string
+	f       *os.File
+}
+
+// -----------------------------------------------------------------------------
+
+// openDir checks the collection directory against CreateIfMissing and ErrorIfExists,
+// and returns whether a collection already exists under it.
+func (lsm *collection) openDir() (exists bool, err error) {
+
+	dirPath := lsm.options.DirPath
+
+	_, err = os.Stat(path.Join(dirPath, manifestFileName))
+
+	switch {
+	case err == nil:
+		if lsm.options.ErrorIfExists {
+			return true, ErrExists
+		}
+		return true, nil
+
+	case os.IsNotExist(err):
+		if !lsm.options.CreateIfMissing {
+			return false, ErrNotExists
+		}
+		if err := os.MkdirAll(dirPath, 0755); err != nil {
+			return false, err
+		}
+		return false, nil
+
+	default:
+		return false, err
+	}
+}
+
+// recoverManifest rebuilds the persisted levels from MANIFEST if the collection exists, removes the SST-files not on them,
+// and then starts a new MANIFEST from the current state.
+func (lsm *collection) recoverManifest(exists bool) error {
+
+	if exists {
+		if err := lsm.replayManifest(); err != nil {
+			return err
+		}
+	}
+
+	// SST-files may be left by a crash before the first MANIFEST is written,
+	// whose entries are still in the write-ahead log
+	if err := lsm.removeObsoleteSSTFiles(); err != nil {
+		return err
+	}
+
+	// the recalculated TTLs are recorded by the new MANIFEST
+	lsm.setLevelsTTL()
+	lsm.updateWriteStallCounters()
+
+	m, err := createManifest(lsm.options.DirPath, lsm.snapshotEdit())
+	if err != nil {
+		return err
+	}
+
+	lsm.manifest = m
+
+	return nil
+}
+
+func (lsm *collection) replayManifest() error {
+
+	f, err := os.Open(path.Join(lsm.options.DirPath, manifestFileName))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+
+	// edits are applied in order
+	for i := 0; ; i++ {
+
+		payload, err := readRecord(r)
+
+		if err == io.EOF {
+			break
+		}
+		if err == errTornRecord {
+			// the edit was not committed
+			log.Println("[manifest] torn record at the tail of MANIFEST")
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		var edit versionEdit
+		if err := json.Unmarshal(payload, &edit); err != nil {
+			return err
+		}
+
+		if i == 0 && (edit.Version == 0 || edit.Version > manifestFormatVersion) {
+			return fmt.Errorf("unsupported MANIFEST version %d", edit.Version)
+		}
+
+		if err := lsm.applyEdit(&edit); err != nil {
+			return err
+		}
+	}
+
+	// only the live files are opened, because the removed ones may have been deleted
+	numFile := 0
+	for _, lv := range lsm.levels {
+		for i, f := range lv.Files {
+			// the metadata of sstFile is loaded from the SST-file itself
+			file, err := lsm.openSSTFile(f.Name)
+			if err != nil {
+				return err
+			}
+			lsm.cacheFilters(file)
+			lv.Files[i] = file
+		}
+		numFile += len(lv.Files)
+	}
+	log.Printf("[manifest] recover %d persisted levels, %d SST-files\n", len(lsm.levels), numFile)
+
+	return nil
+}
+
+// applyEdit applies a replayed edit to the persisted levels.
+func (lsm *collection) applyEdit(edit *versionEdit) error {
+
+	if lsm.nextFileNum < edit.NextFileNum {
+		lsm.nextFileNum = edit.NextFileNum
+	}
+
+	for len(lsm.levels) < edit.NumLevel {
+		lsm.addNewLevel()
+	}
+	for i := 0; i < len(edit.LevelTTLs) && i < len(lsm.levels); i++ {
+		atomic.StoreInt64(&lsm.levels[i].ttl, edit.LevelTTLs[i])
+	}
+
+	for _, fe := range edit.Removed {
+		if fe.Level >= len(lsm.levels) {
+			return fmt.Errorf("MANIFEST removes [%s] from missing level %d", fe.Name, fe.Level)
+		}
+
+		lv := lsm.levels[fe.Level]
+		for i := 0; i < len(lv.Files); i++ {
+			if lv.Files[i].Name == fe.Name {
+				lv.Files = append(lv.Files[:i], lv.Files[i+1:]...)
+				break
+			}
+		}
+	}
+
+	for _, fe := range edit.Added {
+		if fe.Level >= len(lsm.levels) {
+			return fmt.Errorf("MANIFEST adds [%s] to missing level %d", fe.Name, fe.Level)
+		}
+
+		// the SST-file is opened after all edits are applied
+		file := &sstFile{Name: fe.Name}
+
+		lv := lsm.levels[fe.Level]
+
+		if fe.Old != "" {
+			i := 0
+			for i < len(lv.Files) && lv.Files[i].Name != fe.Old {
+				i++
+			}
+			if i == len(lv.Files) {
+				return fmt.Errorf("MANIFEST replaces missing [%s] on level %d", fe.Old, fe.Level)
+			}
+			lv.Files[i] = file
+			continue
+		}
+
+		// the newest file is at the back of level
+		lv.Files = append(lv.Files, file)
+	}
+
+	return nil
+}
+
+// removeObsoleteSSTFiles removes the SST-files which are not recorded by MANIFEST,
+// e.g. a file built just before a crash.
+func (lsm *collection) removeObsoleteSSTFiles() error {
+
+	live := map[string]bool{}
+	for _, lv := range lsm.levels {
+		for _, file := range lv.Files {
+			live[file.Name] = true
+		}
+	}
+
+	nums, err := listFileNums(lsm.options.DirPath, sstFileSuffix)
+	if err != nil {
+		return err
+	}
+
+	for _, num := range nums {
+
+		// file numbers are never reused
+		if lsm.nextFileNum <= num {
+			lsm.nextFileNum = num + 1
+		}
+
+		name := sstFileName(num)
+		if live[name] {
+			continue
+		}
+
+		log.Printf("[manifest] remove obsolete SST-file [%s]\n", name)
+		if err := os.Remove(path.Join(lsm.options.DirPath, name)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// snapshotEdit returns an edit which rebuilds the current persisted levels from scratch.
+func (lsm *collection) snapshotEdit() *versionEdit {
+	lsm.Lock()
+	defer lsm.Unlock()
+
+	edit := &versionEdit{
+		Version:     manifestFormatVersion,
+		NextFileNum: atomic.LoadUint64(&lsm.nextFileNum),
+		NumLevel:    len(lsm.levels),
+		LevelTTLs:   make([]int64, len(lsm.levels)),
+	}
+
+	for i, lv := range lsm.levels {
+		edit.LevelTTLs[i] = atomic.LoadInt64(&lv.ttl)
+
+		lv.Lock()
+		for _, file := range lv.Files {
+			edit.Added = append(edit.Added, fileEdit{Level: i, Name: file.Name})
+		}
+		lv.Unlock()
+	}
+
+	return edit
+}
+
+// logEdit durably appends an edit to MANIFEST.
+// It does nothing if DirPath is empty.
+func (lsm *collection) logEdit(edit *versionEdit) error {
+	if lsm.manifest == nil {
+		return nil
+	}
+
+	edit.NextFileNum = atomic.LoadUint64(&lsm.nextFileNum)
+
+	return lsm.manifest.append(edit)
+}
+
+// -----------------------------------------------------------------------------
+
+// createManifest writes snapshot as the first record of a new MANIFEST,
+// which replaces the old one by renaming.
+func createManifest(dirPath string, snapshot *versionEdit) (*manifest, error) {
+
+	tmpPath := path.Join(dirPath, manifestTmpFileName)
+
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &manifest{}
+	m.dirPath = dirPath
+	m.f = f
+
+	if err := m.append(snapshot); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if err := os.Rename(tmpPath, path.Join(dirPath, manifestFileName)); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	// make the rename durable, otherwise the old MANIFEST may reference the files removed since
+	if err := syncDir(dirPath); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// append writes an edit as one record and syncs it.
+// thread-safe
+func (m *manifest) append(edit *versionEdit) error {
+
+	payload, err := json.Marshal(edit)
+	if err != nil {
+		return err
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	if m.f == nil {
+		return errors.New("MANIFEST is closed")
+	}
+
+	if _, err := m.f.Write(encodeRecord(payload)); err != nil {
+		return err
+	}
+
+	return m.f.Sync()
+}
+
+// close closes MANIFEST.
+// thread-safe
+func (m *manifest) close() error {
+	m.Lock()
+	defer m.Unlock()
+
+	err := m.f.Close()
+	m.f = nil
+
+	return err
+}
@@ -0,0 +1,140 @@
+package lethe
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// testWaitPersisted waits until every immutable memTable has been persisted.
+func testWaitPersisted(t *testing.T, lsm *collection) {
+	for i := 0; i < 1000; i++ {
+		if lsm.immutableQ.size() == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("immutable memTables are not persisted")
+}
+
+func testNumFiles(lsm *collection) []int {
+	nums := make([]int, len(lsm.levels))
+	for i, lv := range lsm.levels {
+		lv.Lock()
+		nums[i] = len(lv.Files)
+		lv.Unlock()
+	}
+	return nums
+}
+
+func TestManifestReopen(t *testing.T) {
+
+	options := DefaultCollectionOptions
+	options.DirPath = t.TempDir()
+	options.CreateIfMissing = true
+	options.MemTableSizeLimit = 64 << 10 // 64KB
+
+	lsm, err := newCollection(&options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	num := 10000
+	for i := 0; i < num; i++ {
+		key := []byte(fmt.Sprintf("key-%d", i))
+		if err := lsm.Put(key, key, key, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testWaitPersisted(t, lsm)
+
+	numFiles := testNumFiles(lsm)
+	if numFiles[0] == 0 {
+		t.Fatal("no SST-file is persisted")
+	}
+
+	// SST-files are on disk
+	nums, err := listFileNums(options.DirPath, sstFileSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nums) != numFiles[0] {
+		t.Fatalf("got %d SST-files on disk, expected %d", len(nums), numFiles[0])
+	}
+
+	if err := lsm.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// reopen on the same directory
+	lsm, err = newCollection(&options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+
+	if fmt.Sprint(testNumFiles(lsm)) != fmt.Sprint(numFiles) {
+		t.Fatalf("got files %v, expected %v", testNumFiles(lsm), numFiles)
+	}
+
+	for i := 0; i < num; i++ {
+		key := []byte(fmt.Sprintf("key-%d", i))
+		value, err := lsm.Get(key, nil)
+		if err != nil || !bytes.Equal(value, key) {
+			t.Fatalf("key [%s] got [%s] %v", string(key), string(value), err)
+		}
+	}
+}
+
+func TestManifestOpenOptions(t *testing.T) {
+
+	options := DefaultCollectionOptions
+	options.DirPath = t.TempDir()
+
+	if _, err := newCollection(&options); err != ErrNotExists {
+		t.Fatalf("expected %v, got %v", ErrNotExists, err)
+	}
+
+	options.CreateIfMissing = true
+	lsm, err := newCollection(&options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lsm.Close()
+
+	options.ErrorIfExists = true
+	if _, err := newCollection(&options); err != ErrExists {
+		t.Fatalf("expected %v, got %v", ErrExists, err)
+	}
+}
+
+func TestManifestOrphanSSTFiles(t *testing.T) {
+
+	options := DefaultCollectionOptions
+	options.DirPath = t.TempDir()
+	options.CreateIfMissing = true
+
+	// a SST-file left by a crash before the first MANIFEST is written
+	orphan := path.Join(options.DirPath, sstFileName(7))
+	if err := ioutil.WriteFile(orphan, []byte("orphan"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	lsm, err := newCollection(&options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Fatal("the orphan SST-file is not removed", err)
+	}
+	if num := lsm.newFileNum(); num <= 7 {
+		t.Fatalf("file number %d is not after the orphan", num)
+	}
+}
@@ -11,13 +11,29 @@ type sortedMapEntity struct {
 	meta      keyMeta
 }
 
-// A sortedMap is a sorted map mapping key to sortedMapEntity.
+// A sortedMap is a sorted map mapping key to the versions of sortedMapEntity,
+// which are sorted from the newest to the oldest on seqNum.
 type sortedMap interface {
 	Num() int
 	Empty() bool
 	Get(key []byte) (entity *sortedMapEntity, ok bool)
 	Put(key []byte, entity *sortedMapEntity) error
 	Traverse(operation func(key []byte, entity *sortedMapEntity))
+	NewIterator() sortedMapIterator
+}
+
+// A sortedMapIterator iterates the versions in sortedMap forward.
+type sortedMapIterator interface {
+	Valid() bool
+	Key() []byte
+	Entity() *sortedMapEntity
+	Next()
+	// Seek moves to the first version of key whose seqNum <= seqNum, or the first version of the next key
+	Seek(key []byte, seqNum uint64)
+	// SeekLT moves to the last version of the keys < key
+	SeekLT(key []byte)
+	SeekToFirst()
+	SeekToLast()
 }
 
 type memTable struct {
@@ -26,10 +42,19 @@ type memTable struct {
 	nBytes int
 	less   func(s, t []byte) bool
 	sm     sortedMap
+
+	// range tombstones in the order of writes
+	rangeDels []rangeTombstone
+
+	// the age of oldest tomb in memTable, Unix seconds, 0 if there is no tomb
+	ageOldestTomb uint32
 }
 
 type immutableMemTable struct {
 	memTable
+
+	// the write-ahead log segments backing this memTable
+	logNums []uint64
 }
 
 func copyBytes(src []byte) []byte {
@@ -102,21 +127,56 @@ func (mt *memTable) resetIfNecessary(memTableSizeLimit int) (reset bool, imt *im
 		return false, nil
 	}
 
-	// immute
-	imt = &immutableMemTable{}
+	return true, mt.immute()
+}
+
+// resetIfTombExpired resets the memTable if it contains a tomb older than deadline, Unix seconds.
+// thread-safe
+func (mt *memTable) resetIfTombExpired(deadline uint32) (reset bool, imt *immutableMemTable) {
+	mt.Lock()
+	defer mt.Unlock()
+
+	if mt.ageOldestTomb == 0 || mt.ageOldestTomb >= deadline {
+		return false, nil
+	}
+
+	return true, mt.immute()
+}
+
+// resetIfNotEmpty resets the memTable if it contains any entry or range tombstone.
+// thread-safe
+func (mt *memTable) resetIfNotEmpty() (reset bool, imt *immutableMemTable) {
+	mt.Lock()
+	defer mt.Unlock()
+
+	if mt.sm.Empty() && len(mt.rangeDels) == 0 {
+		return false, nil
+	}
+
+	return true, mt.immute()
+}
+
+// immute moves the contents of memTable to a new immutableMemTable and resets the memTable.
+// require: mt is locked
+func (mt *memTable) immute() *immutableMemTable {
+	imt := &immutableMemTable{}
 
 	// just give the ownership of sortedMap to the new immutableMemTable
 	imt.nBytes = mt.nBytes
 	imt.less = mt.less
 	imt.sm = mt.sm
+	imt.rangeDels = mt.rangeDels
+	imt.ageOldestTomb = mt.ageOldestTomb
 
 	// reset this memTable
 	mt.nBytes = 0
 	mt.sm = newSkipList(mt.less)
+	mt.rangeDels = nil
+	mt.ageOldestTomb = 0
 
 	// log.Printf("reset current memTable [%d] -> [%d]\n", imt.nBytes, mt.nBytes)
 
-	return true, imt
+	return imt
 }
 
 // ---------------------------------------------------------------------------
@@ -139,13 +199,18 @@ func (mt *memTable) Empty() bool {
 	return mt.sm.Empty()
 }
 
-// Get returns the copy of value by key.
+// Get returns the copy of value of the newest version of key.
 // If the key is not found, it returns (false, nil, meta).
+// tombSeqNum is raised to the greatest seqNum of range tombstones covering key.
 // thread-safe
-func (mt *memTable) Get(key []byte) (found bool, value []byte, meta keyMeta) {
+func (mt *memTable) Get(key []byte, tombSeqNum *uint64) (found bool, value []byte, meta keyMeta) {
 	mt.Lock()
 	defer mt.Unlock()
 
+	if seqNum := maxCoveringSeqNum(mt.rangeDels, key, mt.less); seqNum > *tombSeqNum {
+		*tombSeqNum = seqNum
+	}
+
 	entity, found := mt.sm.Get(key)
 
 	// key is not found
@@ -158,11 +223,43 @@ func (mt *memTable) Get(key []byte) (found bool, value []byte, meta keyMeta) {
 }
 
 // Put inserts a kv entry into memTable.
+// A range tombstone is put as [key, value] of opRangeDel.
 // thread-safe
 func (mt *memTable) Put(key, value, deleteKey []byte, meta keyMeta) error {
 	mt.Lock()
 	defer mt.Unlock()
 
+	return mt.put(key, value, deleteKey, meta)
+}
+
+// Apply applies entries to memTable in order under one lock, so that a reader sees all or none of them.
+// A secondary range delete, i.e. [key, deleteKey] of opDelDeleteKeyRange, drops the entries applied before it.
+// It returns the number of entries dropped by secondary range deletes.
+// thread-safe
+func (mt *memTable) Apply(es []entry, dLess func(s, t []byte) bool) (numDropped int, err error) {
+	mt.Lock()
+	defer mt.Unlock()
+
+	for i := 0; i < len(es); i++ {
+		e := &es[i]
+
+		if e.meta.opType == opDelDeleteKeyRange {
+			numDropped += mt.dropDeleteKeyRangeLocked(e.key, e.deleteKey, dLess)
+			continue
+		}
+
+		if err := mt.put(e.key, e.value, e.deleteKey, e.meta); err != nil {
+			return numDropped, err
+		}
+	}
+
+	return numDropped, nil
+}
+
+// put inserts a kv entry into memTable.
+// require: mt is locked
+func (mt *memTable) put(key, value, deleteKey []byte, meta keyMeta) error {
+
 	mt.nBytes += persistFormatLen(&entry{
 		key:       key,
 		value:     value,
@@ -170,6 +267,25 @@ func (mt *memTable) Put(key, value, deleteKey []byte, meta keyMeta) error {
 		meta:      meta,
 	})
 
+	if meta.opType == opRangeDel {
+		rt := rangeTombstone{Start: key, End: value, SeqNum: meta.seqNum}
+		mt.rangeDels = append(mt.rangeDels, rt)
+
+		if mt.ageOldestTomb == 0 || rt.age() < mt.ageOldestTomb {
+			mt.ageOldestTomb = rt.age()
+		}
+
+		return nil
+	}
+
+	if meta.opType == opDel {
+		// parse age of entry from seqNum, the oldest is the least
+		age := uint32((meta.seqNum >> 32) & 0xFFFFFFFF)
+		if mt.ageOldestTomb == 0 || age < mt.ageOldestTomb {
+			mt.ageOldestTomb = age
+		}
+	}
+
 	entity := &sortedMapEntity{
 		value:     value,
 		deleteKey: deleteKey,
@@ -181,6 +297,90 @@ func (mt *memTable) Put(key, value, deleteKey []byte, meta keyMeta) error {
 	return mt.sm.Put(key, entity)
 }
 
+// dropDeleteKeyRange drops the entries whose delete key is in [lowDKey, highDKey] from memTable,
+// and returns the number of dropped entries.
+// A dropped entry is replaced by a tombstone of its key and seqNum, otherwise an older version of the key
+// out of the range would become visible again, and tombstones are kept for the same reason.
+// thread-safe
+func (mt *memTable) dropDeleteKeyRange(lowDKey, highDKey []byte, dLess func(s, t []byte) bool) int {
+	mt.Lock()
+	defer mt.Unlock()
+
+	return mt.dropDeleteKeyRangeLocked(lowDKey, highDKey, dLess)
+}
+
+// dropDeleteKeyRangeLocked is dropDeleteKeyRange with mt locked.
+// require: mt is locked
+func (mt *memTable) dropDeleteKeyRangeLocked(lowDKey, highDKey []byte, dLess func(s, t []byte) bool) int {
+
+	sm := newSkipList(mt.less)
+	nBytes := 0
+	numDropped := 0
+	ageOldestTomb := mt.ageOldestTomb
+
+	mt.sm.Traverse(func(key []byte, entity *sortedMapEntity) {
+
+		if entity.meta.opType != opDel && !dLess(entity.deleteKey, lowDKey) && !dLess(highDKey, entity.deleteKey) {
+			numDropped++
+
+			// the entity is shared with the old skiplist, so a new one is the tombstone
+			entity = &sortedMapEntity{meta: keyMeta{seqNum: entity.meta.seqNum, opType: opDel}}
+
+			age := uint32((entity.meta.seqNum >> 32) & 0xFFFFFFFF)
+			if ageOldestTomb == 0 || age < ageOldestTomb {
+				ageOldestTomb = age
+			}
+		}
+
+		nBytes += persistFormatLen(&entry{
+			key:       key,
+			value:     entity.value,
+			deleteKey: entity.deleteKey,
+			meta:      entity.meta,
+		})
+		sm.Put(key, entity)
+	})
+
+	for i := 0; i < len(mt.rangeDels); i++ {
+		rt := &mt.rangeDels[i]
+		nBytes += persistFormatLen(&entry{key: rt.Start, value: rt.End})
+	}
+
+	if numDropped > 0 {
+		mt.sm = sm
+		mt.nBytes = nBytes
+		mt.ageOldestTomb = ageOldestTomb
+	}
+
+	return numDropped
+}
+
+// RangeDels returns the range tombstones in memTable.
+// thread-safe
+func (mt *memTable) RangeDels() []rangeTombstone {
+	mt.Lock()
+	defer mt.Unlock()
+
+	return append([]rangeTombstone{}, mt.rangeDels...)
+}
+
+// memTableView is the sortedMap of a memTable taken by a view, which is read with the memTable locked.
+// The sortedMap is replaced instead of modified when the memTable is reset or its entries are dropped,
+// so the versions in it are kept for the view.
+type memTableView struct {
+	mt *memTable
+	sm sortedMap
+}
+
+// view returns the current sortedMap of memTable.
+// thread-safe
+func (mt *memTable) view() memTableView {
+	mt.Lock()
+	defer mt.Unlock()
+
+	return memTableView{mt: mt, sm: mt.sm}
+}
+
 // Traverse traverses the memTable in order defined by lessFunc
 // thread-safe
 func (mt *memTable) Traverse(operation func(key []byte, entity *sortedMapEntity)) {
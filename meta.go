@@ -3,6 +3,8 @@ package lethe
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"math/bits"
 	"sort"
 )
 
@@ -10,6 +12,13 @@ const (
 	opBase uint64 = 0                  // 0x0000000000000000
 	opPut  uint64 = opBase | (1 << 56) // 0x0100000000000000
 	opDel  uint64 = opBase | (2 << 56) // 0x0200000000000000, tombstone
+
+	// opRangeDel is the range tombstone [key, value] on the sort key.
+	opRangeDel uint64 = opBase | (4 << 56) // 0x0400000000000000
+
+	// opDelDeleteKeyRange is the secondary range delete [key, deleteKey] on the delete key,
+	// which is only written to write-ahead log.
+	opDelDeleteKeyRange uint64 = opBase | (3 << 56) // 0x0300000000000000
 )
 
 type keyMeta struct {
@@ -50,7 +59,11 @@ func entryEqual(e, e2 *entry) bool {
 // ------------------------------------------------------------------------------------
 // persist format
 // ------------------------------------------------------------------------------------
-// [ lenMeta(10) | seqNum(10) | opType(10) | key | value | deleteKey ]
+// [ shared | unshared | valueLen | deleteKeyLen | seqNum | opType | key[shared:] | value | deleteKey ]
+//
+// The headers are uvarints, and shared is the length of the prefix of key shared with the previous entry,
+// which is 0 at a restart point, i.e. every pageRestartInterval entries of a page and every entry of a log record.
+// opType only uses the highest 8 bits, which are rotated to the lowest ones so that it takes one byte.
 // ------------------------------------------------------------------------------------
 
 const (
@@ -69,97 +82,212 @@ const (
 
 const (
 	uint64EncodeLen = binary.MaxVarintLen64 // const 10
+
+	// the number of entries between restart points of a page
+	pageRestartInterval = 16
 )
 
-// persistFormatLen returns the length of persistent format.
+// errBadEntry is returned when an entry can not be decoded, e.g. it is truncated.
+var errBadEntry = errors.New("bad entry")
+
+func uvarintLen(x uint64) int {
+	n := 1
+	for x >= 0x80 {
+		x >>= 7
+		n++
+	}
+	return n
+}
+
+func encodeOpType(opType uint64) uint64 { return bits.RotateLeft64(opType, 8) }
+func decodeOpType(x uint64) uint64      { return bits.RotateLeft64(x, -8) }
+
+// persistFormatLen returns the length of persistent format of entry at a restart point,
+// which is an upper bound of its length in a page.
 // pure function
 func persistFormatLen(e *entry) int {
-	// 3*uint64EncodeLen means lenMeta(10), seqNum(10), opType(10)
-	return (3*uint64EncodeLen + len(e.key) + len(e.deleteKey) + len(e.value))
+	return uvarintLen(0) +
+		uvarintLen(uint64(len(e.key))) +
+		uvarintLen(uint64(len(e.value))) +
+		uvarintLen(uint64(len(e.deleteKey))) +
+		uvarintLen(e.meta.seqNum) +
+		uvarintLen(encodeOpType(e.meta.opType)) +
+		len(e.key) + len(e.value) + len(e.deleteKey)
+}
+
+// sharedPrefixLen returns the length of the common prefix of a and b.
+func sharedPrefixLen(a, b []byte) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
+
+// appendEntry appends the persistent format of entry to buf,
+// whose first shared bytes of key are shared with the previous entry.
+func appendEntry(buf []byte, e *entry, shared int) []byte {
+
+	var tmp [binary.MaxVarintLen64]byte
+	putUvarint := func(x uint64) {
+		n := binary.PutUvarint(tmp[:], x)
+		buf = append(buf, tmp[:n]...)
+	}
+
+	putUvarint(uint64(shared))
+	putUvarint(uint64(len(e.key) - shared))
+	putUvarint(uint64(len(e.value)))
+	putUvarint(uint64(len(e.deleteKey)))
+	putUvarint(e.meta.seqNum)
+	putUvarint(encodeOpType(e.meta.opType))
+
+	buf = append(buf, e.key[shared:]...)
+	buf = append(buf, e.value...)
+	buf = append(buf, e.deleteKey...)
+
+	return buf
 }
 
 // encodeEntry allocates a new byte buffer to save persistent format and encodes entry to the buffer.
 func encodeEntry(e *entry) (buf []byte, err error) {
+	return appendEntry(make([]byte, 0, persistFormatLen(e)), e, 0), nil
+}
+
+// entryHeader is the header of an entry in persistent format.
+type entryHeader struct {
+	shared       int
+	unshared     int
+	valueLen     int
+	deleteKeyLen int
+	seqNum       uint64
+	opType       uint64
+}
+
+// decodeEntryHeader decodes the header of entry from persistent format,
+// and returns the number of bytes of header, which are followed by the bytes of entry in buf.
+func decodeEntryHeader(buf []byte) (entryHeader, int, error) {
 
-	key := e.key
-	value := e.value
-	deleteKey := e.deleteKey
-	meta := e.meta
+	h := entryHeader{}
 
-	var lenMeta uint64 = 0
-	lenMeta |= uint64(len(key)) << sortKeyLenOff
-	lenMeta |= uint64(len(deleteKey)) << deleteKeyLenOff
-	lenMeta |= uint64(len(value)) << valueLenOff
+	var fields [6]uint64
+	off := 0
+	for i := 0; i < len(fields); i++ {
+		x, n := binary.Uvarint(buf[off:])
+		if n <= 0 {
+			return h, 0, errBadEntry
+		}
+		fields[i] = x
+		off += n
+	}
 
-	buf = make([]byte, persistFormatLen(e))
+	// the shared bytes are in the previous key
+	rest := uint64(len(buf) - off)
+	if fields[0] > uint64(maxSortKeyBytesLen) || fields[1] > rest || fields[2] > rest || fields[3] > rest || fields[1]+fields[2]+fields[3] > rest {
+		return h, 0, errBadEntry
+	}
 
-	binary.PutUvarint(buf[0*uint64EncodeLen:], lenMeta)
-	binary.PutUvarint(buf[1*uint64EncodeLen:], meta.seqNum)
-	binary.PutUvarint(buf[2*uint64EncodeLen:], meta.opType)
-	copy(buf[3*uint64EncodeLen:], key)
-	copy(buf[3*uint64EncodeLen+len(key):], value)
-	copy(buf[3*uint64EncodeLen+len(key)+len(value):], deleteKey)
+	h.shared = int(fields[0])
+	h.unshared = int(fields[1])
+	h.valueLen = int(fields[2])
+	h.deleteKeyLen = int(fields[3])
+	h.seqNum = fields[4]
+	h.opType = decodeOpType(fields[5])
 
-	return buf, nil
+	return h, off, nil
 }
 
-// decodeEntry decodes entry from persistent format.
-// Note that decodeEntrys will NOT allocate new buffers but occupy the input buf.
-func decodeEntry(buf []byte) (entry, error) {
+// decodeEntry decodes entry from persistent format following the entry of prevKey,
+// and returns the number of bytes decoded.
+// Note that decodeEntry will NOT allocate new buffers but occupy the input buf,
+// except for a key sharing its prefix with prevKey.
+func decodeEntry(buf []byte, prevKey []byte) (entry, int, error) {
 
 	e := entry{}
 
-	lenMeta, _ := binary.Uvarint(buf[0*uint64EncodeLen : 1*uint64EncodeLen])
-	seqNum, _ := binary.Uvarint(buf[1*uint64EncodeLen : 2*uint64EncodeLen])
-	opType, _ := binary.Uvarint(buf[2*uint64EncodeLen : 3*uint64EncodeLen])
+	h, off, err := decodeEntryHeader(buf)
+	if err != nil || h.shared > len(prevKey) {
+		return e, 0, errBadEntry
+	}
 
-	sortKeyLen := int((lenMeta & sortKeyLenMask) >> sortKeyLenOff)
-	valueLen := int((lenMeta & valueLenMask) >> valueLenOff)
-	deleteKeyLen := int((lenMeta & deleteKeyLenMask) >> deleteKeyLenOff)
+	e.key = buf[off : off+h.unshared]
+	off += h.unshared
+	if h.shared > 0 {
+		key := make([]byte, 0, h.shared+len(e.key))
+		key = append(key, prevKey[:h.shared]...)
+		e.key = append(key, e.key...)
+	}
 
-	e.key = buf[3*uint64EncodeLen : 3*uint64EncodeLen+sortKeyLen]
-	e.value = buf[3*uint64EncodeLen+sortKeyLen : 3*uint64EncodeLen+sortKeyLen+valueLen]
-	e.deleteKey = buf[3*uint64EncodeLen+sortKeyLen+valueLen : 3*uint64EncodeLen+sortKeyLen+valueLen+deleteKeyLen]
+	e.value = buf[off : off+h.valueLen]
+	off += h.valueLen
+	e.deleteKey = buf[off : off+h.deleteKeyLen]
+	off += h.deleteKeyLen
 
 	e.meta = keyMeta{
-		seqNum: seqNum,
-		opType: opType,
+		seqNum: h.seqNum,
+		opType: h.opType,
 	}
 
-	return e, nil
+	return e, off, nil
 }
 
+// encodeEntries encodes entries each at a restart point, e.g. a record of log.
 func encodeEntries(es []entry) (buf []byte, err error) {
 
-	buf = []byte{}
+	size := 0
+	for i := 0; i < len(es); i++ {
+		size += persistFormatLen(&es[i])
+	}
 
+	buf = make([]byte, 0, size)
 	for i := 0; i < len(es); i++ {
+		buf = appendEntry(buf, &es[i], 0)
+	}
 
-		b, err := encodeEntry(&es[i])
-		if err != nil {
-			return nil, err
-		}
+	return buf, nil
+}
 
-		buf = append(buf, b...)
+// encodePrefixEntries encodes the entries of a page sorted on sort key,
+// whose keys share their prefixes with the previous ones between restart points,
+// and returns the offsets of restart points.
+func encodePrefixEntries(es []entry) (buf []byte, restarts []uint32) {
+
+	size := 0
+	for i := 0; i < len(es); i++ {
+		size += persistFormatLen(&es[i])
 	}
 
-	return buf, nil
+	buf = make([]byte, 0, size)
+	for i := 0; i < len(es); i++ {
+		shared := 0
+		if i%pageRestartInterval != 0 {
+			shared = sharedPrefixLen(es[i-1].key, es[i].key)
+		} else {
+			restarts = append(restarts, uint32(len(buf)))
+		}
+		buf = appendEntry(buf, &es[i], shared)
+	}
+
+	return buf, restarts
 }
 
+// decodeEntries decodes entries encoded by encodeEntries or encodePrefixEntries.
 func decodeEntries(buf []byte) ([]entry, error) {
 
 	es := []entry{}
 
+	var prevKey []byte
+
 	start := 0
 	for start < len(buf) {
 
-		e, err := decodeEntry(buf[start:])
+		e, n, err := decodeEntry(buf[start:], prevKey)
 		if err != nil {
 			return nil, err
 		}
 
 		es = append(es, e)
-		start += persistFormatLen(&e)
+		prevKey = e.key
+		start += n
 	}
 
 	return es, nil
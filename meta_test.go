@@ -106,14 +106,21 @@ func TestEncodeEntry(t *testing.T) {
 		t.Fatal()
 	}
 
-	e2, err = decodeEntry(buf)
-	if err != nil {
+	e2, n, err := decodeEntry(buf, nil)
+	if err != nil || n != len(buf) {
 		t.Fatal()
 	}
 
 	if !entryEqual(&e, &e2) {
 		t.Fail()
 	}
+
+	// a 5-byte key with a 20-byte value
+	e = entry{key: []byte("key-1"), value: make([]byte, 20), meta: keyMeta{seqNum: 100, opType: opPut}}
+	fmt.Println("persist format len", persistFormatLen(&e))
+	if persistFormatLen(&e) != 6+5+20 {
+		t.Fatal(persistFormatLen(&e))
+	}
 }
 
 func TestEncodeEntries(t *testing.T) {
@@ -140,6 +147,45 @@ func TestEncodeEntries(t *testing.T) {
 	}
 }
 
+func TestEncodePageEntries(t *testing.T) {
+
+	es := make([]entry, 100)
+	for i := 0; i < len(es); i++ {
+		es[i] = entry{
+			key:   []byte(fmt.Sprintf("user-key-%05d", i)),
+			value: []byte("value"),
+			meta:  keyMeta{seqNum: uint64(i), opType: opPut},
+		}
+	}
+
+	standalone, err := encodeEntries(es)
+	if err != nil {
+		t.Fatal()
+	}
+	buf, restarts := encodePrefixEntries(es)
+	if len(restarts) != (len(es)+pageRestartInterval-1)/pageRestartInterval {
+		t.Fatal(restarts)
+	}
+	fmt.Println("page len", len(buf), "standalone len", len(standalone))
+
+	if len(buf) >= len(standalone) {
+		t.Fatal("keys are not prefix compressed")
+	}
+
+	es2, err := decodeEntries(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !testEntriesEqual(es, es2) {
+		t.Fail()
+	}
+
+	// truncated
+	if _, err := decodeEntries(buf[:len(buf)-1]); err != errBadEntry {
+		t.Fatal(err)
+	}
+}
+
 func TestSortEntriesOnSortKey(t *testing.T) {
 	sLess := DefaultCollectionOptions.SortKeyLess
 
@@ -0,0 +1,188 @@
+package lethe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"sort"
+)
+
+// The entries of a page are encoded in the format of page, which is recorded in the index block.
+//
+// pageFormatRestart: [ { entry } | { restart offset(4) } | numRestart(4) ]
+//
+// Pages are written in pageFormatRestart, whose keys share their prefixes between restart points.
+// A page in pageFormatRestart is ended with the offsets of its restart points, where keys are not shared,
+// so that a key is searched over the encoded bytes by binary search on the keys of restart points,
+// and then a scan of the entries from the restart point, which decodes only the entry found.
+
+const (
+	pageFormatRestart uint8 = 1
+
+	restartOffsetLen = 4
+)
+
+var (
+	// errUnknownPageFormat is returned when the format of page is written by a newer implementation.
+	errUnknownPageFormat = errors.New("unknown page format")
+
+	// errBadRestarts is returned when the restart offsets of page are out of its entries.
+	errBadRestarts = errors.New("bad restart offsets")
+)
+
+// encodePage encodes the entries of a page sorted on sort key in pageFormatRestart.
+func encodePage(es []entry) []byte {
+
+	buf, restarts := encodePrefixEntries(es)
+
+	var tmp [restartOffsetLen]byte
+	for _, off := range restarts {
+		binary.LittleEndian.PutUint32(tmp[:], off)
+		buf = append(buf, tmp[:]...)
+	}
+	binary.LittleEndian.PutUint32(tmp[:], uint32(len(restarts)))
+
+	return append(buf, tmp[:]...)
+}
+
+// -----------------------------------------------------------------------------
+
+// pageBlock is a page of SST-file decompressed, which is shared by readers through the block cache,
+// so neither its bytes nor its entries may be modified.
+type pageBlock struct {
+
+	// the encoded entries of a page in pageFormatRestart, and the offsets of its restart points
+	data     []byte
+	restarts []byte
+
+	// the number of bytes of the decompressed page, which is charged to the block cache
+	size int
+}
+
+// newPageBlock parses the decompressed page buf in format, the page block occupies buf.
+func newPageBlock(format uint8, buf []byte) (*pageBlock, error) {
+
+	switch format {
+	case pageFormatRestart:
+		if len(buf) < restartOffsetLen {
+			return nil, errBadRestarts
+		}
+
+		n := uint64(binary.LittleEndian.Uint32(buf[len(buf)-restartOffsetLen:]))
+		if n*restartOffsetLen > uint64(len(buf)-restartOffsetLen) {
+			return nil, errBadRestarts
+		}
+
+		dataLen := len(buf) - restartOffsetLen - int(n)*restartOffsetLen
+		b := &pageBlock{data: buf[:dataLen], restarts: buf[dataLen : len(buf)-restartOffsetLen], size: len(buf)}
+
+		// restart points are ascending in entries, and the first entry is a restart point
+		if (n == 0) != (dataLen == 0) {
+			return nil, errBadRestarts
+		}
+		for i := 0; i < b.numRestart(); i++ {
+			off := b.restart(i)
+			if off >= dataLen || (i == 0 && off != 0) || (i > 0 && off <= b.restart(i-1)) {
+				return nil, errBadRestarts
+			}
+		}
+
+		return b, nil
+	}
+
+	return nil, errUnknownPageFormat
+}
+
+func (b *pageBlock) numRestart() int { return len(b.restarts) / restartOffsetLen }
+
+// restart returns the offset of restart point i in data.
+func (b *pageBlock) restart(i int) int {
+	return int(binary.LittleEndian.Uint32(b.restarts[i*restartOffsetLen:]))
+}
+
+// restartKey returns the key of restart point i, which occupies data.
+func (b *pageBlock) restartKey(i int) ([]byte, error) {
+	off := b.restart(i)
+
+	h, n, err := decodeEntryHeader(b.data[off:])
+	if err != nil || h.shared != 0 {
+		return nil, errBadEntry
+	}
+
+	return b.data[off+n : off+n+h.unshared], nil
+}
+
+// seekRestart returns the offset of the last restart point whose key is not greater than key,
+// or the first restart point if there is none.
+func (b *pageBlock) seekRestart(key []byte, less func(s, t []byte) bool) (int, error) {
+
+	var err error
+
+	// binary search because entries within every page are sorted on sort key
+	i := sort.Search(b.numRestart(), func(i int) bool {
+		k, e := b.restartKey(i)
+		if e != nil {
+			err = e
+			return true
+		}
+		return less(key, k)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if i == 0 {
+		return 0, nil
+	}
+	return b.restart(i - 1), nil
+}
+
+// get returns the entry of key in page, which occupies the page.
+// Only the keys of entries are rebuilt from the restart point until key, and the entry found is decoded.
+func (b *pageBlock) get(key []byte, less func(s, t []byte) bool) (e entry, found bool, err error) {
+
+	off, err := b.seekRestart(key, less)
+	if err != nil {
+		return e, false, err
+	}
+
+	// the key of current entry, which shares its prefix with the previous key
+	var cur []byte
+
+	for off < len(b.data) {
+
+		h, n, err := decodeEntryHeader(b.data[off:])
+		if err != nil || h.shared > len(cur) {
+			return e, false, errBadEntry
+		}
+		cur = append(cur[:h.shared], b.data[off+n:off+n+h.unshared]...)
+
+		if bytes.Equal(cur, key) {
+			// cur holds the prefix shared by the entry found
+			e, _, err := decodeEntry(b.data[off:], cur)
+			return e, err == nil, err
+		}
+		if less(key, cur) {
+			break
+		}
+
+		off += n + h.unshared + h.valueLen + h.deleteKeyLen
+	}
+
+	return e, false, nil
+}
+
+// entriesFrom returns the entries of page from the restart point before key, all the entries if key is nil,
+// so that the entries before key are mostly not decoded.
+func (b *pageBlock) entriesFrom(key []byte, less func(s, t []byte) bool) ([]entry, error) {
+
+	off := 0
+	if key != nil {
+		var err error
+		if off, err = b.seekRestart(key, less); err != nil {
+			return nil, err
+		}
+	}
+
+	return decodeEntries(b.data[off:])
+}
@@ -0,0 +1,90 @@
+package lethe
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestPageBlock(t *testing.T) {
+
+	less := DefaultCollectionOptions.SortKeyLess
+
+	es := make([]entry, 100)
+	for i := 0; i < len(es); i++ {
+		es[i] = entry{
+			key:       []byte(fmt.Sprintf("key-%05d", i*2)),
+			value:     []byte(fmt.Sprintf("value-%d", i)),
+			deleteKey: []byte(fmt.Sprintf("delete-key-%d", i)),
+			meta:      keyMeta{seqNum: uint64(i), opType: opPut},
+		}
+	}
+
+	pages := map[uint8][]byte{
+		pageFormatRestart: encodePage(es),
+	}
+
+	for format, buf := range pages {
+
+		b, err := newPageBlock(format, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Println("page format", format, "len", len(buf), "restarts", b.numRestart())
+
+		// keys of even numbers are in page, the odd ones are not
+		for i := -1; i < 2*len(es)+1; i++ {
+			key := []byte(fmt.Sprintf("key-%05d", i))
+			if i < 0 {
+				key = []byte("a")
+			}
+
+			e, found, err := b.get(key, less)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if i < 0 || i%2 != 0 || i/2 >= len(es) {
+				if found {
+					t.Fatalf("format %d: key [%s] should not be found", format, string(key))
+				}
+				continue
+			}
+			if !found || !entryEqual(&e, &es[i/2]) {
+				t.Fatalf("format %d: key [%s] got [%s] %v", format, string(key), string(e.value), found)
+			}
+		}
+
+		// entries from the restart point before key
+		key := es[40].key
+		from, err := b.entriesFrom(key, less)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(from) == 0 || less(key, from[0].key) || !testEntriesEqual(from, es[len(es)-len(from):]) {
+			t.Fatalf("format %d: entries from [%s] start at [%s]", format, string(key), string(from[0].key))
+		}
+		if format == pageFormatRestart && len(from) != len(es)-40/pageRestartInterval*pageRestartInterval {
+			t.Fatalf("entries from [%s] are decoded from %d", string(key), len(es)-len(from))
+		}
+	}
+
+	// empty page
+	b, err := newPageBlock(pageFormatRestart, encodePage(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, found, err := b.get([]byte("key"), less); found || err != nil {
+		t.Fatal(found, err)
+	}
+
+	// restart offsets out of entries
+	bad := encodePage(es)
+	copy(bad[len(bad)-2*restartOffsetLen:], bytes.Repeat([]byte{0xff}, restartOffsetLen))
+	if _, err := newPageBlock(pageFormatRestart, bad); err != errBadRestarts {
+		t.Fatal(err)
+	}
+	if _, err := newPageBlock(2, bad); err != errUnknownPageFormat {
+		t.Fatal(err)
+	}
+}
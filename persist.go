@@ -1,18 +1,21 @@
 package lethe
 
 import (
-	"context"
-	"fmt"
+	"bytes"
 	"log"
 	"runtime"
 	"sync"
-
-	"github.com/google/uuid"
+	"sync/atomic"
+	"time"
 )
 
 type persistTask struct{}
 
 type immutableQueue struct {
+	// the number of immutable memTables, which is read without the lock held by persistence,
+	// the first field to be 64-bit aligned for atomic operations
+	num int64
+
 	sync.Mutex
 	imts []*immutableMemTable
 }
@@ -28,24 +31,32 @@ func (iq *immutableQueue) push(imt *immutableMemTable) {
 	defer iq.Unlock()
 
 	iq.imts = append(iq.imts, imt)
+	atomic.AddInt64(&iq.num, 1)
 }
 
-// size returns the number of immutable memTables in immutableQueue
-func (iq *immutableQueue) size() int {
-	iq.Lock()
-	defer iq.Unlock()
+// popLocked removes the oldest immutable memTable at the head of immutableQueue.
+// require: iq is locked
+func (iq *immutableQueue) popLocked() {
+	iq.imts = iq.imts[1:]
+	atomic.AddInt64(&iq.num, -1)
+}
 
-	return len(iq.imts)
+// size returns the number of immutable memTables in immutableQueue.
+// It does not wait for the lock, which is held by persistence while building a SST-file.
+func (iq *immutableQueue) size() int {
+	return int(atomic.LoadInt64(&iq.num))
 }
 
-func (iq *immutableQueue) Get(key []byte) (found bool, value []byte, meta keyMeta) {
+// Get gets value by key from immutable memTables.
+// tombSeqNum is raised to the greatest seqNum of range tombstones covering key.
+func (iq *immutableQueue) Get(key []byte, tombSeqNum *uint64) (found bool, value []byte, meta keyMeta) {
 	iq.Lock()
 	defer iq.Unlock()
 
 	// index i : greater(newer) <===> less(older)
 	for i := len(iq.imts) - 1; i >= 0; i-- {
 
-		if found, value, meta = iq.imts[i].Get(key); found {
+		if found, value, meta = iq.imts[i].Get(key, tombSeqNum); found {
 			return true, value, meta
 		}
 
@@ -55,23 +66,73 @@ func (iq *immutableQueue) Get(key []byte) (found bool, value []byte, meta keyMet
 	return false, nil, meta
 }
 
-func (lsm *collection) persistDaemon(ctx context.Context) {
-	for {
-		select {
-		case <-lsm.persistTrigger:
-			{
-				lsm.persistOne()
+// memTables returns the immutable memTables from the newest to the oldest.
+func (iq *immutableQueue) memTables() []*immutableMemTable {
+	iq.Lock()
+	defer iq.Unlock()
+
+	imts := make([]*immutableMemTable, 0, len(iq.imts))
+	for i := len(iq.imts) - 1; i >= 0; i-- {
+		imts = append(imts, iq.imts[i])
+	}
+	return imts
+}
+
+// persistMaxRetries is the number of retries of a failed persistence before it becomes the background error.
+const persistMaxRetries = 5
+
+// persistDaemon persists one immutable memTable per trigger,
+// until the trigger is closed by Close, so that the immutable memTables queued before are persisted.
+//
+// A failed persistence leaves the immutable memTable at the head of queue, so the same trigger retries it with backoff.
+// After persistMaxRetries, the error fails the later writes, and the queue is kept in the write-ahead log.
+func (lsm *collection) persistDaemon() {
+	defer close(lsm.persistDone)
+
+	for range lsm.persistTrigger {
+		if lsm.backgroundError() != nil {
+			continue
+		}
+
+		delay := lsm.options.persistRetryDelay
+		for i := 0; ; i++ {
+			err := lsm.persistOne()
+			if err == nil {
+				break
 			}
-		case <-ctx.Done():
-			{
-				log.Println("stop [persist daemon]")
-				return
+			if i == persistMaxRetries {
+				log.Printf("[persist] give up after %d retries: %v\n", i, err)
+				lsm.setBackgroundError(err)
+				break
 			}
+
+			time.Sleep(delay)
+			delay *= 2
 		}
 	}
+
+	log.Println("stop [persist daemon]")
+}
+
+// backgroundError returns the error of persistence failing after retries, nil if none.
+func (lsm *collection) backgroundError() error {
+	lsm.bgErrLock.Lock()
+	defer lsm.bgErrLock.Unlock()
+
+	return lsm.bgErr
+}
+
+// setBackgroundError records the error of persistence, and wakes up the writes stopped.
+func (lsm *collection) setBackgroundError(err error) {
+	lsm.bgErrLock.Lock()
+	lsm.bgErr = err
+	lsm.bgErrLock.Unlock()
+
+	lsm.signalWriteStall()
 }
 
 func (lsm *collection) persistOne() error {
+	defer lsm.signalWriteStall()
 
 	log.Printf("[persist] trigger, immutable queue len [%d]\n", lsm.immutableQ.size())
 
@@ -84,9 +145,12 @@ func (lsm *collection) persistOne() error {
 	// the head of queue is the oldest immutable memTable
 	imt := lsm.immutableQ.imts[0]
 
-	// take out entries sorted on sortKey from immutable memTable
+	// take out entries sorted on sortKey from immutable memTable, only the newest version of each key
 	es := make([]entry, 0, imt.Num())
 	imt.Traverse(func(key []byte, entity *sortedMapEntity) {
+		if len(es) > 0 && bytes.Equal(es[len(es)-1].key, key) {
+			return
+		}
 		es = append(es, entry{
 			key:       key,
 			value:     entity.value,
@@ -95,17 +159,66 @@ func (lsm *collection) persistOne() error {
 		})
 	})
 
-	sstFileName := fmt.Sprintf("%s", uuid.New())
-	sstFile, _ := lsm.buildSSTFile(sstFileName, es) // time cost heavily
+	// the entries deleted by range tombstones in the same memTable are not persisted
+	rts := imt.RangeDels()
+	es = dropCoveredEntries(es, rts, lsm.options.SortKeyLess)
+
+	// all the entries may be dropped by secondary range deletes
+	if len(es) == 0 && len(rts) == 0 {
+		lsm.immutableQ.popLocked()
+		lsm.immutableQ.Unlock()
+
+		if lsm.wal != nil {
+			if err := lsm.wal.retire(imt.logNums); err != nil {
+				log.Printf("[persist] retire log segments %v: %v\n", imt.logNums, err)
+			}
+		}
+
+		return nil
+	}
+
+	start := time.Now()
+
+	sstFileName := sstFileName(lsm.newFileNum())
+	sstFile, err := lsm.buildSSTFile(sstFileName, 0, es, rts) // time cost heavily
+	if err != nil {
+		// the immutable memTable stays at the head of queue
+		lsm.immutableQ.Unlock()
+		log.Printf("[persist] build SST-file [%s]: %v\n", sstFileName, err)
+		return err
+	}
+
+	// record the new sstFile before the log segments are retired
+	edit := &versionEdit{
+		Added: []fileEdit{{Level: 0, Name: sstFileName}},
+	}
+	if err := lsm.logEdit(edit); err != nil {
+		lsm.immutableQ.Unlock()
+		log.Printf("[persist] log edit of SST-file [%s]: %v\n", sstFileName, err)
+
+		// the file is not on any level
+		if err := lsm.removeSSTFileDesc(sstFile.fd); err != nil {
+			log.Printf("[persist] remove SST-file [%s]: %v\n", sstFileName, err)
+		}
+		return err
+	}
 
 	// add the new sstFile to the top peristed level
-	lsm.addFileToLevel(lsm.levels[0], sstFile)
+	lsm.addFileToLevel(0, sstFile)
+	lsm.stats.countFlush(start, sstFile.Size)
 
 	// when the persistence of head done, pop the head from queue
-	lsm.immutableQ.imts = lsm.immutableQ.imts[1:]
+	lsm.immutableQ.popLocked()
 
 	lsm.immutableQ.Unlock()
 
+	// the mutations of the immutable memTable are persisted, so its log segments are useless
+	if lsm.wal != nil {
+		if err := lsm.wal.retire(imt.logNums); err != nil {
+			log.Printf("[persist] retire log segments %v: %v\n", imt.logNums, err)
+		}
+	}
+
 	// force GC to release immutable memTable
 	runtime.GC()
 
@@ -124,43 +237,79 @@ type persistTile struct {
 	ppages []persistPage
 }
 
-// buildSSTFile builds a sstFile from entries
+// buildSSTFile builds a sstFile from entries and range tombstones, which is going to be added to the level of levelIndex.
 // sstFileName is the UNIQUE identifier of the sstFile
 // require: the input []entry is sorted on sortKey
-func (lsm *collection) buildSSTFile(sstFileName string, es []entry) (*sstFile, error) {
+func (lsm *collection) buildSSTFile(sstFileName string, levelIndex int, es []entry, rts []rangeTombstone) (*sstFile, error) {
 
 	file := &sstFile{}
+	file.Name = sstFileName
+	file.RangeDels = rts
+	file.compressors = lsm.compressors
 
 	// now es is sorted on sortKey
 	// note that `buildSSTFileMeta` will NOT change the order of es
 	lsm.buildSSTFileMeta(file, es)
+	file.NumInvalidated = lsm.estimateInvalidated(levelIndex, es, rts)
 
 	// now es is sorted on sortKey
 	// note that `splitToTiles` will change the order of es
-	pts := lsm.splitToTiles(es)
+	pts := []persistTile{}
+	if len(es) > 0 {
+		pts = lsm.splitToTiles(es)
+	}
 
-	// open fd via unique name
-	file.fd = openMemSSTFileDesc(sstFileName) // mock
+	// create fd via unique name
+	fd, err := lsm.createSSTFileDesc(sstFileName)
+	if err != nil {
+		return nil, err
+	}
+	file.fd = fd
 
 	// pack
-	lsm.packTilesIntoFile(file, pts)
+	if err := lsm.packTilesIntoFile(file, nil, pts, lsm.compressionOf(levelIndex)); err != nil {
+		lsm.removeSSTFileDesc(fd)
+		return nil, err
+	}
+
+	// the written file is synced and then read-only
+	if file.fd, err = lsm.finishSSTFileDesc(fd); err != nil {
+		lsm.removeSSTFileDesc(fd)
+		return nil, err
+	}
+	lsm.cacheFilters(file)
 
 	return file, nil
 }
 
+// buildSSTFileMeta builds the metadata of file from entries and the range tombstones of file.
+// require: es and file.RangeDels are not both empty
 func (lsm *collection) buildSSTFileMeta(file *sstFile, es []entry) {
 
 	var (
-		deleteKeyMin  []byte = es[0].deleteKey // init value
-		deleteKeyMax  []byte = es[0].deleteKey // init value
-		ageOldestTomb uint32 = 0               // init value
-		numDelete     int    = 0               // init value
-		numEntry      int    = len(es)         // finish value
+		sortKeyMin    []byte = nil                           // init value
+		sortKeyMax    []byte = nil                           // init value
+		deleteKeyMin  []byte = nil                           // init value
+		deleteKeyMax  []byte = nil                           // init value
+		ageOldestTomb uint32 = 0                             // init value
+		numDelete     int    = 0                             // init value
+		numEntry      int    = len(es) + len(file.RangeDels) // finish value
 	)
 
+	less := lsm.options.SortKeyLess
 	dLess := lsm.options.DeleteKeyLess
 
-	for i := 0; i < numEntry; i++ {
+	if len(es) > 0 {
+		sortKeyMin = es[0].key
+		sortKeyMax = es[len(es)-1].key
+		deleteKeyMin = es[0].deleteKey
+		deleteKeyMax = es[0].deleteKey
+	} else {
+		sortKeyMin = file.RangeDels[0].Start
+		sortKeyMax = file.RangeDels[0].End
+	}
+
+	for i := 0; i < len(es); i++ {
 
 		if dLess(es[i].deleteKey, deleteKeyMin) {
 			deleteKeyMin = es[i].deleteKey
@@ -174,17 +323,35 @@ func (lsm *collection) buildSSTFileMeta(file *sstFile, es []entry) {
 
 			numDelete++
 
-			// parse age of entry from seqNum
+			// parse age of entry from seqNum, the oldest is the least
 			age := uint32((es[i].meta.seqNum >> 32) & 0xFFFFFFFF)
-			if ageOldestTomb < age {
+			if ageOldestTomb == 0 || age < ageOldestTomb {
 				ageOldestTomb = age
 			}
 		}
 	}
 
+	// the fences of file cover its range tombstones
+	for i := 0; i < len(file.RangeDels); i++ {
+		rt := &file.RangeDels[i]
+
+		if less(rt.Start, sortKeyMin) {
+			sortKeyMin = rt.Start
+		}
+		if less(sortKeyMax, rt.End) {
+			sortKeyMax = rt.End
+		}
+
+		numDelete++
+
+		if ageOldestTomb == 0 || rt.age() < ageOldestTomb {
+			ageOldestTomb = rt.age()
+		}
+	}
+
 	// meta
-	file.SortKeyMin = es[0].key
-	file.SortKeyMax = es[numEntry-1].key
+	file.SortKeyMin = sortKeyMin
+	file.SortKeyMax = sortKeyMax
 	file.DeleteKeyMin = deleteKeyMin
 	file.DeleteKeyMax = deleteKeyMax
 	file.AgeOldestTomb = ageOldestTomb
@@ -192,6 +359,71 @@ func (lsm *collection) buildSSTFileMeta(file *sstFile, es []entry) {
 	file.NumEntry = numEntry
 }
 
+// estimateInvalidated estimates the number of older entries invalidated by the tombstones of es and rts,
+// which is denoted by b in paper 4.1.3 .
+// A point tombstone invalidates an entry if any level below may contain its key,
+// which is checked via fence pointers and bloom filters without reading data.
+// A range tombstone invalidates the entries of pages below within its range, and half of the pages overlapping with it.
+func (lsm *collection) estimateInvalidated(levelIndex int, es []entry, rts []rangeTombstone) int {
+	lsm.RLock()
+	defer lsm.RUnlock()
+
+	// files on the levels below
+	lowers := []*sstFile{}
+	for i := levelIndex + 1; i < len(lsm.levels); i++ {
+		lv := lsm.levels[i]
+		lv.Lock()
+		lowers = append(lowers, lv.Files...)
+		lv.Unlock()
+	}
+
+	numInvalidated := 0
+
+	for i := 0; i < len(es); i++ {
+		if es[i].meta.opType != opDel {
+			continue
+		}
+
+		for _, f := range lowers {
+			if lsm.mayContain(f, es[i].key) {
+				numInvalidated++
+				break
+			}
+		}
+	}
+
+	less := lsm.options.SortKeyLess
+
+	for i := 0; i < len(rts); i++ {
+		rt := &rts[i]
+
+		for _, f := range lowers {
+			if !isOverlapRange(less, rt.Start, rt.End, f.SortKeyMin, f.SortKeyMax) {
+				continue
+			}
+
+			for j := 0; j < len(f.Tiles); j++ {
+				dt := &f.Tiles[j]
+				if !isOverlapRange(less, rt.Start, rt.End, dt.SortKeyMin, dt.SortKeyMax) {
+					continue
+				}
+
+				for k := 0; k < len(dt.Pages); k++ {
+					p := &dt.Pages[k]
+					switch {
+					case rt.covers(p.SortKeyMin, less) && rt.covers(p.SortKeyMax, less):
+						numInvalidated += p.NumEntry
+					case isOverlapRange(less, rt.Start, rt.End, p.SortKeyMin, p.SortKeyMax):
+						numInvalidated += p.NumEntry / 2
+					}
+				}
+			}
+		}
+	}
+
+	return numInvalidated
+}
+
 // -------------------------------------------------------------------------------
 
 func divUp(dividend, divisor int) int {
@@ -243,6 +475,11 @@ func (lsm *collection) splitToPages(es []entry) []persistPage {
 				pp.p.SortKeyMin = esPage[0].key
 				pp.p.SortKeyMax = esPage[len(esPage)-1].key
 
+				// pages within a delete tile are not sorted on sort key,
+				// so the bloom filter saves reading the pages which fence pointers can not skip
+				pp.p.buildBloomFilter(esPage, lsm.options.BloomBitsPerKey)
+				pp.p.setStats(esPage)
+
 				// esPage should be sorted on sort key
 				// note that the order of entries in `esPage` can not be changed anymore
 				pp.es = esPage
@@ -299,7 +536,9 @@ func (lsm *collection) splitToTiles(es []entry) []persistTile {
 	return pts
 }
 
-func (lsm *collection) packTilesIntoFile(file *sstFile, pts []persistTile) error {
+// packTilesIntoFile writes the pages of delete tiles to file compressed with the codec c and followed by checksums,
+// a page without entries is copied from the file src as it is, with its own codec, after it is verified.
+func (lsm *collection) packTilesIntoFile(file *sstFile, src *sstFile, pts []persistTile, c Compression) error {
 
 	var (
 		off int64 = 0
@@ -315,18 +554,29 @@ func (lsm *collection) packTilesIntoFile(file *sstFile, pts []persistTile) error
 
 		for j := 0; j < len(pt.ppages); j++ {
 
-			// encode
-			buf, err := encodeEntries(pt.ppages[j].es)
+			var (
+				buf []byte
+				err error
+			)
+
+			if pt.ppages[j].es != nil {
+				// encode and compress
+				buf = encodePage(pt.ppages[j].es)
+				pt.ppages[j].p.Format = pageFormatRestart
+				buf, pt.ppages[j].p.Compression, err = lsm.compressors.compress(c, buf)
+				if err == nil {
+					buf = appendChecksum(buf)
+				}
+			} else {
+				// copy
+				buf, err = src.copyPage(&pt.ppages[j].p)
+			}
 			if err != nil {
 				return err
 			}
 
 			// write
-			n, err := file.fd.Write(buf)
-			if n != len(buf) {
-				return ErrPlaceholder
-			}
-			if err != nil {
+			if err := file.write(buf); err != nil {
 				return err
 			}
 
@@ -338,12 +588,17 @@ func (lsm *collection) packTilesIntoFile(file *sstFile, pts []persistTile) error
 			pt.tile.Pages[j] = pt.ppages[j].p
 
 			// update offset
-			off += int64(n)
+			off += int64(len(buf))
 		}
 
 		// the delelte-tile is assembled completely
 		file.Tiles[i] = pt.tile
 	}
 
-	return nil
+	if src != nil {
+		file.setMetaFromTiles(lsm.options.SortKeyLess, lsm.options.DeleteKeyLess)
+	}
+
+	// the file is self-describing via the blocks following data pages
+	return writeSSTFileMeta(file, off)
 }
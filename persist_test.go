@@ -3,7 +3,10 @@ package lethe
 import (
 	"bytes"
 	"fmt"
+	"os"
+	"path"
 	"testing"
+	"time"
 )
 
 func TestEntriesTotalSize(t *testing.T) {
@@ -21,24 +24,24 @@ func TestEntriesTotalSize(t *testing.T) {
 	_8B := sizedBytes(8)
 	_64B := sizedBytes(64)
 
-	e40 := entry{
-		// persist format 40B
+	e16 := entry{
+		// persist format 16B
 		key:       _4B,
 		value:     _4B,
 		deleteKey: _2B,
 		meta:      keyMeta{},
 	}
 
-	e50 := entry{
-		// persist format 50B
+	e26 := entry{
+		// persist format 26B
 		key:       _8B,
 		value:     _8B,
 		deleteKey: _4B,
 		meta:      keyMeta{},
 	}
 
-	e100 := entry{
-		// persist format 100B
+	e76 := entry{
+		// persist format 76B
 		key:       _64B,
 		value:     _4B,
 		deleteKey: _2B,
@@ -46,17 +49,68 @@ func TestEntriesTotalSize(t *testing.T) {
 	}
 
 	es := []entry{
-		e40,
-		e40,
-		e100,
-		e100,
-		e50,
-		e40,
+		e16,
+		e16,
+		e76,
+		e76,
+		e26,
+		e16,
 	}
 
 	tot := entriesTotalSize(es)
 	fmt.Println("total size", tot)
-	if tot != (40 + 40 + 100 + 100 + 50 + 40) {
+	if tot != (16 + 16 + 76 + 76 + 26 + 16) {
 		t.Fatal()
 	}
 }
+
+func TestPersistFailure(t *testing.T) {
+
+	options := DefaultCollectionOptions
+	options.DirPath = t.TempDir()
+	options.CreateIfMissing = true
+	options.persistRetryDelay = time.Millisecond
+
+	lsm, err := newCollection(&options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the edits of persistence fail to be logged
+	f, err := os.Create(path.Join(t.TempDir(), "closed"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	lsm.manifest.Lock()
+	lsm.manifest.f = f
+	lsm.manifest.Unlock()
+
+	if err := lsm.Put([]byte("key"), []byte("value"), nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsm.flushCurMemTable(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 1000 && lsm.backgroundError() == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	fmt.Println("background error:", lsm.backgroundError())
+	if lsm.backgroundError() == nil {
+		t.Fatal("persistence does not fail")
+	}
+
+	// the later writes fail, and no SST-file is left
+	if err := lsm.Put([]byte("key"), []byte("value"), nil, nil); err != lsm.backgroundError() {
+		t.Fatal(err)
+	}
+	nums, err := listFileNums(options.DirPath, sstFileSuffix)
+	if err != nil || len(nums) != 0 {
+		t.Fatal(nums, err)
+	}
+
+	if err := lsm.Close(); err == nil {
+		t.Fatal("Close does not report the failure")
+	}
+}
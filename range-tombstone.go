@@ -0,0 +1,52 @@
+package lethe
+
+// A range tombstone deletes the entries whose sort key is in [Start, End] and which are older than it.
+//
+// Range tombstones are kept in memTables and in the range-tombstone block of SST-files.
+// The fences of a SST-file cover its range tombstones, so a compaction merging a range tombstone
+// also merges the older entries on the next level which may be deleted by it.
+//
+// A point read goes through LSM from the newest to the oldest until the key is found,
+// the found entry is deleted if any range tombstone visited on the way covers it with a greater seqNum.
+type rangeTombstone struct {
+	Start  []byte
+	End    []byte
+	SeqNum uint64
+}
+
+// covers returns whether key is in the range of range tombstone.
+func (rt *rangeTombstone) covers(key []byte, less func(s, t []byte) bool) bool {
+	return !less(key, rt.Start) && !less(rt.End, key)
+}
+
+// age returns the age of range tombstone, Unix seconds.
+func (rt *rangeTombstone) age() uint32 {
+	return uint32((rt.SeqNum >> 32) & 0xFFFFFFFF)
+}
+
+// maxCoveringSeqNum returns the greatest seqNum of range tombstones covering key, 0 if none.
+func maxCoveringSeqNum(rts []rangeTombstone, key []byte, less func(s, t []byte) bool) uint64 {
+	var seqNum uint64 = 0
+	for i := 0; i < len(rts); i++ {
+		if rts[i].SeqNum > seqNum && rts[i].covers(key, less) {
+			seqNum = rts[i].SeqNum
+		}
+	}
+	return seqNum
+}
+
+// dropCoveredEntries removes the entries deleted by range tombstones from es in place.
+func dropCoveredEntries(es []entry, rts []rangeTombstone, less func(s, t []byte) bool) []entry {
+	if len(rts) == 0 {
+		return es
+	}
+
+	kept := es[:0]
+	for i := 0; i < len(es); i++ {
+		if maxCoveringSeqNum(rts, es[i].key, less) < es[i].meta.seqNum {
+			kept = append(kept, es[i])
+		}
+	}
+
+	return kept
+}
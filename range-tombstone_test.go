@@ -0,0 +1,152 @@
+package lethe
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDropCoveredEntries(t *testing.T) {
+	less := DefaultCollectionOptions.SortKeyLess
+
+	es := []entry{
+		{key: []byte("a"), meta: keyMeta{seqNum: 1}},
+		{key: []byte("b"), meta: keyMeta{seqNum: 1}},
+		{key: []byte("b"), meta: keyMeta{seqNum: 5}},
+		{key: []byte("c"), meta: keyMeta{seqNum: 2}},
+		{key: []byte("d"), meta: keyMeta{seqNum: 2}},
+	}
+	rts := []rangeTombstone{
+		{Start: []byte("b"), End: []byte("c"), SeqNum: 3},
+	}
+
+	kept := dropCoveredEntries(es, rts, less)
+
+	expected := []string{"a", "b", "d"}
+	if len(kept) != len(expected) {
+		t.Fatalf("got %d entries, expected %d", len(kept), len(expected))
+	}
+	for i := 0; i < len(kept); i++ {
+		if string(kept[i].key) != expected[i] {
+			t.Fatalf("got [%s], expected [%s]", string(kept[i].key), expected[i])
+		}
+	}
+	// the newer version is kept
+	if kept[1].meta.seqNum != 5 {
+		t.Fatal(kept[1].meta.seqNum)
+	}
+}
+
+func TestRangeDel(t *testing.T) {
+
+	var clockLock sync.Mutex
+	now := time.Now()
+
+	options := DefaultCollectionOptions
+	options.DirPath = t.TempDir()
+	options.CreateIfMissing = true
+	options.MemTableSizeLimit = 16 << 10 // 16KB
+	options.NumInitialLevel = 3
+	options.DeletePersistThreshold = time.Hour
+	options.clock = func() time.Time {
+		clockLock.Lock()
+		defer clockLock.Unlock()
+		return now
+	}
+
+	lsm, err := newCollection(&options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3000; i++ {
+		key := []byte(fmt.Sprintf("key-%05d", i))
+		if err := lsm.Put(key, key, key, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := lsm.RangeDel([]byte("key-01000"), []byte("key-01999"), nil); err != nil {
+		t.Fatal(err)
+	}
+	// newer than the range tombstone
+	if err := lsm.Put([]byte("key-01500"), []byte("key-01500"), []byte("key-01500"), nil); err != nil {
+		t.Fatal(err)
+	}
+	// entries and a range tombstone left in memTable
+	for i := 3000; i < 3300; i++ {
+		key := []byte(fmt.Sprintf("key-%05d", i))
+		if err := lsm.Put(key, key, key, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := lsm.RangeDel([]byte("key-03100"), []byte("key-03199"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func() {
+		for i := 0; i < 3300; i++ {
+			key := []byte(fmt.Sprintf("key-%05d", i))
+			value, err := lsm.Get(key, nil)
+
+			if (1000 <= i && i < 2000 && i != 1500) || (3100 <= i && i < 3200) {
+				if err != ErrKeyNotFound {
+					t.Fatalf("key [%s] expected deleted, got [%s] %v", string(key), string(value), err)
+				}
+				continue
+			}
+			if err != nil || !bytes.Equal(value, key) {
+				t.Fatalf("key [%s] got [%s] %v", string(key), string(value), err)
+			}
+		}
+	}
+
+	check()
+
+	testWaitCompacted(t, lsm)
+	fmt.Println("files on levels", testNumFiles(lsm))
+	check()
+
+	lsm.Close()
+
+	// range tombstones are replayed from write-ahead log and loaded from SST-files
+	options.CreateIfMissing = false
+	lsm, err = newCollection(&options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+
+	check()
+
+	// range tombstones are pushed to the last level by TTLs, and dropped there
+	step := 10 * time.Minute
+	for elapsed := step; elapsed <= options.DeletePersistThreshold+step; elapsed += step {
+
+		clockLock.Lock()
+		now = now.Add(step)
+		clockLock.Unlock()
+
+		testWaitTTL(t, lsm)
+	}
+
+	numRangeDel := 0
+	for _, lv := range lsm.levels {
+		lv.Lock()
+		for _, f := range lv.Files {
+			numRangeDel += len(f.RangeDels)
+		}
+		lv.Unlock()
+	}
+	lsm.curMemTable.Lock()
+	numRangeDel += len(lsm.curMemTable.rangeDels)
+	lsm.curMemTable.Unlock()
+
+	fmt.Println("files on levels", testNumFiles(lsm))
+	if numRangeDel != 0 {
+		t.Fatalf("%d range tombstones are left", numRangeDel)
+	}
+
+	check()
+}
@@ -0,0 +1,72 @@
+package lethe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+// A record is the unit written to the write-ahead log.
+// A record is either written completely or detected as torn when it is read back.
+
+// ------------------------------------------------------------------------------------
+// record format
+// ------------------------------------------------------------------------------------
+// [ checksum(4) | length(4) | payload(length) ]
+// checksum is the CRC32C of payload
+// ------------------------------------------------------------------------------------
+
+const (
+	recordHeaderLen = 8
+)
+
+var (
+	crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+	// errTornRecord is returned when the tail of a log is incomplete or corrupted.
+	errTornRecord = errors.New("torn-record")
+)
+
+// encodeRecord allocates a new byte buffer and frames payload as a record.
+func encodeRecord(payload []byte) []byte {
+	buf := make([]byte, recordHeaderLen+len(payload))
+
+	binary.LittleEndian.PutUint32(buf[0:4], crc32.Checksum(payload, crc32cTable))
+	binary.LittleEndian.PutUint32(buf[4:8], uint32(len(payload)))
+	copy(buf[recordHeaderLen:], payload)
+
+	return buf
+}
+
+// readRecord reads the next record from r and returns its payload.
+// It returns io.EOF if r is exhausted exactly at a record boundary,
+// and errTornRecord if the next record is incomplete or fails the checksum.
+func readRecord(r io.Reader) ([]byte, error) {
+
+	var header [recordHeaderLen]byte
+
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, errTornRecord
+	}
+
+	checksum := binary.LittleEndian.Uint32(header[0:4])
+	length := binary.LittleEndian.Uint32(header[4:8])
+
+	// copy in chunks so that a corrupted length can not allocate a huge buffer
+	var b bytes.Buffer
+	if _, err := io.CopyN(&b, r, int64(length)); err != nil {
+		return nil, errTornRecord
+	}
+	payload := b.Bytes()
+
+	if crc32.Checksum(payload, crc32cTable) != checksum {
+		return nil, errTornRecord
+	}
+
+	return payload, nil
+}
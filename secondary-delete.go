@@ -0,0 +1,406 @@
+package lethe
+
+import (
+	"log"
+	"sync/atomic"
+)
+
+// Secondary range delete drops the entries whose delete key is in a range [lowDKey, highDKey].
+//
+// Pages within a delete tile are sorted on delete key, so the delete-key fences of pages decide
+// - a page covered by the range is dropped without reading it, i.e. full drop
+// - a page overlapping with the range is rewritten without the dropped entries, i.e. partial drop
+// - the other pages are kept as they are
+// SST-files are immutable, so a file with dropped entries is rewritten to a new file which takes its place on the level.
+//
+// Tombstones are never dropped, because the older entries deleted by them would become visible again.
+// For the same reason, a dropped entry is replaced by a tombstone of its key and seqNum
+// if an older file may contain a version of its key, and then its page is never a full drop.
+
+// levelFile is a file on the level of levelIndex.
+type levelFile struct {
+	levelIndex int
+	file       *sstFile
+}
+
+// levelFiles returns all the files on persisted levels.
+func (lsm *collection) levelFiles() []levelFile {
+	lsm.RLock()
+	defer lsm.RUnlock()
+
+	lfs := []levelFile{}
+	for i, lv := range lsm.levels {
+		lv.Lock()
+		for _, f := range lv.Files {
+			lfs = append(lfs, levelFile{levelIndex: i, file: f})
+		}
+		lv.Unlock()
+	}
+
+	return lfs
+}
+
+// deleteKeyRange is the range [low, high] of a secondary range delete on delete key.
+type deleteKeyRange struct {
+	low  []byte
+	high []byte
+}
+
+// deleteKeyRangesOf returns the ranges of secondary range deletes in es.
+func deleteKeyRangesOf(es []entry) []deleteKeyRange {
+	drs := []deleteKeyRange{}
+	for i := 0; i < len(es); i++ {
+		if es[i].meta.opType == opDelDeleteKeyRange {
+			drs = append(drs, deleteKeyRange{low: es[i].key, high: es[i].deleteKey})
+		}
+	}
+	return drs
+}
+
+func (lsm *collection) delByDeleteKeyRange(lowDKey, highDKey []byte, wo *WriteOptions) error {
+
+	e := entry{
+		key:       lowDKey,
+		deleteKey: highDKey,
+		meta:      keyMeta{opType: opDelDeleteKeyRange},
+	}
+
+	return lsm.writeWithDeleteKeyRanges([]entry{e}, wo)
+}
+
+// writeWithDeleteKeyRanges writes entries including secondary range deletes,
+// and then drops the entries in the ranges from the files written before.
+// Readers are kept out until the entries are dropped from both memTables and files.
+func (lsm *collection) writeWithDeleteKeyRanges(es []entry, wo *WriteOptions) error {
+
+	// compactions are not blocked by the write stalled
+	if err := lsm.stallWrite(); err != nil {
+		return err
+	}
+
+	// files are not replaced by compactions meanwhile
+	lsm.compactLock.Lock()
+	defer lsm.compactLock.Unlock()
+
+	lsm.dropLock.Lock()
+	defer lsm.dropLock.Unlock()
+
+	lfs, err := lsm.apply(es, wo)
+	if err != nil {
+		return err
+	}
+
+	return lsm.dropDeleteKeyRangeInFiles(lfs, deleteKeyRangesOf(es))
+}
+
+// dropDeleteKeyRangeInFiles rewrites the files containing entries in the ranges,
+// a file left empty is removed from its level.
+func (lsm *collection) dropDeleteKeyRangeInFiles(lfs []levelFile, drs []deleteKeyRange) error {
+
+	for i, lf := range lfs {
+
+		newFile, changed, err := lsm.rewriteDeleteKeyRange(lf.levelIndex, lf.file, drs, olderOverlaps(lfs, i, lsm.options.SortKeyLess))
+		if err != nil {
+			return err
+		}
+		if !changed {
+			continue
+		}
+
+		if err := lsm.replaceFileOnLevel(lf.levelIndex, lf.file, newFile); err != nil {
+			if newFile != nil {
+				lsm.removeSSTFileDesc(newFile.fd)
+			}
+			return err
+		}
+
+		// no new reader can reach the replaced file now
+		if err := lsm.retireSSTFile(lf.file); err != nil {
+			log.Printf("[delete] remove SST-file [%s]: %v\n", lf.file.Name, err)
+		}
+
+		if newFile != nil {
+			atomic.AddInt64(&lsm.stats.compactionBytesWritten, newFile.Size)
+			log.Printf("[delete] rewrite SST-file [%s] to [%s], %d -> %d entries\n", lf.file.Name, newFile.Name, lf.file.NumEntry, newFile.NumEntry)
+		} else {
+			log.Printf("[delete] drop SST-file [%s], %d entries\n", lf.file.Name, lf.file.NumEntry)
+		}
+	}
+
+	return nil
+}
+
+// olderOverlaps returns whether a file older than lfs[i] overlaps with [sortKeyMin, sortKeyMax],
+// files on deeper levels and the files before it on the same level are older.
+func olderOverlaps(lfs []levelFile, i int, less func(s, t []byte) bool) func(sortKeyMin, sortKeyMax []byte) bool {
+	return func(sortKeyMin, sortKeyMax []byte) bool {
+		for j, lf := range lfs {
+			if lf.levelIndex < lfs[i].levelIndex || (lf.levelIndex == lfs[i].levelIndex && j >= i) {
+				continue
+			}
+			if !less(sortKeyMax, lf.file.SortKeyMin) && !less(lf.file.SortKeyMax, sortKeyMin) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// rewriteDeleteKeyRange builds a new file from file on the level of levelIndex without the entries in the ranges.
+// A dropped entry is replaced by a tombstone if olderOverlaps reports an older file overlapping with its page.
+// It returns changed false if no entry is dropped, and a nil file if all the entries are dropped.
+func (lsm *collection) rewriteDeleteKeyRange(levelIndex int, file *sstFile, drs []deleteKeyRange, olderOverlaps func(sortKeyMin, sortKeyMax []byte) bool) (newFile *sstFile, changed bool, err error) {
+
+	dLess := lsm.options.DeleteKeyLess
+
+	inRange := func(deleteKey []byte) bool {
+		for _, dr := range drs {
+			if !dLess(deleteKey, dr.low) && !dLess(dr.high, deleteKey) {
+				return true
+			}
+		}
+		return false
+	}
+	isOverlap := func(deleteKeyMin, deleteKeyMax []byte) bool {
+		for _, dr := range drs {
+			if !dLess(deleteKeyMax, dr.low) && !dLess(dr.high, deleteKeyMin) {
+				return true
+			}
+		}
+		return false
+	}
+	isCovered := func(deleteKeyMin, deleteKeyMax []byte) bool {
+		for _, dr := range drs {
+			if !dLess(deleteKeyMin, dr.low) && !dLess(dr.high, deleteKeyMax) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if !isOverlap(file.DeleteKeyMin, file.DeleteKeyMax) {
+		return nil, false, nil
+	}
+
+	// the pages kept are copied with their filters, and the pages read are not filled into the cache
+	r := pageReader{cache: lsm.cache, verifyChecksums: true}
+	filters := r.filters(file)
+
+	pts := []persistTile{}
+
+	for i := 0; i < len(file.Tiles); i++ {
+		dt := &file.Tiles[i]
+
+		// a page kept as it is has nil entries, which is copied when packing
+		pt := persistTile{}
+
+		for j := 0; j < len(dt.Pages); j++ {
+			p := dt.Pages[j]
+			p.bloom = bloomOf(file, filters, i, j)
+
+			// no entry in the ranges
+			if !isOverlap(dt.DeleteKeyMin, dt.DeleteKeyMax) || !isOverlap(p.DeleteKeyMin, p.DeleteKeyMax) {
+				pt.ppages = append(pt.ppages, persistPage{p: p})
+				continue
+			}
+
+			// dropped entries are replaced by tombstones if an older file may contain their keys
+			tombs := olderOverlaps(p.SortKeyMin, p.SortKeyMax)
+
+			// full drop
+			if !tombs && p.NumDelete == 0 && isCovered(p.DeleteKeyMin, p.DeleteKeyMax) {
+				changed = true
+				continue
+			}
+			// partial drop
+			es, err := r.loadEntries(file, &p)
+			if err != nil {
+				return nil, false, err
+			}
+
+			kept := make([]entry, 0, len(es))
+			numDropped := 0
+			for k := 0; k < len(es); k++ {
+				if es[k].meta.opType == opDel || !inRange(es[k].deleteKey) {
+					kept = append(kept, es[k])
+					continue
+				}
+
+				numDropped++
+				if tombs {
+					kept = append(kept, entry{key: es[k].key, meta: keyMeta{seqNum: es[k].meta.seqNum, opType: opDel}})
+				}
+			}
+
+			if numDropped == 0 {
+				pt.ppages = append(pt.ppages, persistPage{p: p})
+				continue
+			}
+
+			changed = true
+
+			if len(kept) > 0 {
+				pt.ppages = append(pt.ppages, lsm.newPersistPage(kept))
+			}
+		}
+
+		if len(pt.ppages) == 0 {
+			continue
+		}
+
+		p0 := &pt.ppages[0].p
+		pt.tile = deleteTile{
+			SortKeyMin:   p0.SortKeyMin,
+			SortKeyMax:   p0.SortKeyMax,
+			DeleteKeyMin: p0.DeleteKeyMin,
+			DeleteKeyMax: p0.DeleteKeyMax,
+		}
+		for j := 1; j < len(pt.ppages); j++ {
+			pt.tile.extendFences(&pt.ppages[j].p, lsm.options.SortKeyLess, dLess)
+		}
+
+		pts = append(pts, pt)
+	}
+
+	if !changed {
+		return nil, false, nil
+	}
+
+	// all the entries are dropped
+	if len(pts) == 0 && len(file.RangeDels) == 0 {
+		return nil, true, nil
+	}
+
+	newFile = &sstFile{}
+	newFile.Name = sstFileName(lsm.newFileNum())
+	newFile.RangeDels = file.RangeDels
+	newFile.compressors = lsm.compressors
+
+	// tombstones are kept, so is the estimate of invalidated entries
+	newFile.NumInvalidated = file.NumInvalidated
+
+	fd, err := lsm.createSSTFileDesc(newFile.Name)
+	if err != nil {
+		return nil, false, err
+	}
+	newFile.fd = fd
+
+	if err := lsm.packTilesIntoFile(newFile, file, pts, lsm.compressionOf(levelIndex)); err != nil {
+		lsm.removeSSTFileDesc(fd)
+		return nil, false, err
+	}
+
+	// the written file is synced and then read-only
+	if newFile.fd, err = lsm.finishSSTFileDesc(fd); err != nil {
+		lsm.removeSSTFileDesc(fd)
+		return nil, false, err
+	}
+	lsm.cacheFilters(newFile)
+
+	return newFile, true, nil
+}
+
+// newPersistPage builds a page from entries sorted on sort key.
+func (lsm *collection) newPersistPage(es []entry) persistPage {
+
+	dLess := lsm.options.DeleteKeyLess
+
+	var pp persistPage
+
+	pp.p.SortKeyMin = es[0].key
+	pp.p.SortKeyMax = es[len(es)-1].key
+	pp.p.DeleteKeyMin = es[0].deleteKey
+	pp.p.DeleteKeyMax = es[0].deleteKey
+
+	// a tight loop on the delete key, since entries within a page are sorted on sort key
+	for i := 1; i < len(es); i++ {
+		if dLess(es[i].deleteKey, pp.p.DeleteKeyMin) {
+			pp.p.DeleteKeyMin = es[i].deleteKey
+		}
+		if dLess(pp.p.DeleteKeyMax, es[i].deleteKey) {
+			pp.p.DeleteKeyMax = es[i].deleteKey
+		}
+	}
+
+	pp.p.buildBloomFilter(es, lsm.options.BloomBitsPerKey)
+	pp.p.setStats(es)
+
+	pp.es = es
+
+	return pp
+}
+
+// extendFences extends the fences of delete tile to cover page.
+func (dt *deleteTile) extendFences(p *page, less, dLess func(s, t []byte) bool) {
+
+	if less(p.SortKeyMin, dt.SortKeyMin) {
+		dt.SortKeyMin = p.SortKeyMin
+	}
+	if less(dt.SortKeyMax, p.SortKeyMax) {
+		dt.SortKeyMax = p.SortKeyMax
+	}
+	if dLess(p.DeleteKeyMin, dt.DeleteKeyMin) {
+		dt.DeleteKeyMin = p.DeleteKeyMin
+	}
+	if dLess(dt.DeleteKeyMax, p.DeleteKeyMax) {
+		dt.DeleteKeyMax = p.DeleteKeyMax
+	}
+}
+
+// setMetaFromTiles sets the fences and statistics of file from its delete tiles and range tombstones.
+// require: file.Tiles and file.RangeDels are not both empty
+func (file *sstFile) setMetaFromTiles(less, dLess func(s, t []byte) bool) {
+
+	file.NumEntry = len(file.RangeDels)
+	file.NumDelete = len(file.RangeDels)
+	file.AgeOldestTomb = 0
+
+	if len(file.Tiles) > 0 {
+		// delete tiles within a file are sorted on sort key
+		file.SortKeyMin = file.Tiles[0].SortKeyMin
+		file.SortKeyMax = file.Tiles[len(file.Tiles)-1].SortKeyMax
+		file.DeleteKeyMin = file.Tiles[0].DeleteKeyMin
+		file.DeleteKeyMax = file.Tiles[0].DeleteKeyMax
+	} else {
+		file.SortKeyMin = file.RangeDels[0].Start
+		file.SortKeyMax = file.RangeDels[0].End
+		file.DeleteKeyMin = nil
+		file.DeleteKeyMax = nil
+	}
+
+	// the fences of file cover its range tombstones
+	for i := 0; i < len(file.RangeDels); i++ {
+		rt := &file.RangeDels[i]
+
+		if less(rt.Start, file.SortKeyMin) {
+			file.SortKeyMin = rt.Start
+		}
+		if less(file.SortKeyMax, rt.End) {
+			file.SortKeyMax = rt.End
+		}
+		if olderTomb(rt.age(), file.AgeOldestTomb) {
+			file.AgeOldestTomb = rt.age()
+		}
+	}
+
+	for i := 0; i < len(file.Tiles); i++ {
+		dt := &file.Tiles[i]
+
+		if dLess(dt.DeleteKeyMin, file.DeleteKeyMin) {
+			file.DeleteKeyMin = dt.DeleteKeyMin
+		}
+		if dLess(file.DeleteKeyMax, dt.DeleteKeyMax) {
+			file.DeleteKeyMax = dt.DeleteKeyMax
+		}
+
+		for j := 0; j < len(dt.Pages); j++ {
+			p := &dt.Pages[j]
+
+			file.NumEntry += p.NumEntry
+			file.NumDelete += p.NumDelete
+			if olderTomb(p.AgeOldestTomb, file.AgeOldestTomb) {
+				file.AgeOldestTomb = p.AgeOldestTomb
+			}
+		}
+	}
+}
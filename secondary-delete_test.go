@@ -0,0 +1,256 @@
+package lethe
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+// readCountSSTFileDesc records the offsets read from a sstFileDesc.
+type readCountSSTFileDesc struct {
+	sstFileDesc
+	offsets map[int64]bool
+}
+
+func (fd *readCountSSTFileDesc) ReadAt(p []byte, off int64) (n int, err error) {
+	fd.offsets[off] = true
+	return fd.sstFileDesc.ReadAt(p, off)
+}
+
+// noOlder reports no older file overlapping with a page.
+func noOlder(sortKeyMin, sortKeyMax []byte) bool { return false }
+
+func TestRewriteDeleteKeyRange(t *testing.T) {
+
+	options := DefaultCollectionOptions
+	options.StandardPageSize = 256
+	options.NumPagePerDeleteTile = 4
+
+	lsm, err := newCollection(&options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+
+	// delete keys are not correlated with sort keys
+	es := []entry{}
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("key-%05d", i))
+		deleteKey := []byte(fmt.Sprintf("dkey-%05d", (i*7919)%1000))
+		es = append(es, entry{key: key, value: key, deleteKey: deleteKey, meta: keyMeta{seqNum: uint64(i), opType: opPut}})
+	}
+	file, err := lsm.buildSSTFile("file", 0, es, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	low := []byte("dkey-00200")
+	high := []byte("dkey-00599")
+
+	// the pages covered by the range
+	covered := map[int64]bool{}
+	for _, dt := range file.Tiles {
+		for _, p := range dt.Pages {
+			if bytes.Compare(p.DeleteKeyMin, low) >= 0 && bytes.Compare(p.DeleteKeyMax, high) <= 0 {
+				covered[p.Offset] = true
+			}
+		}
+	}
+	fmt.Println("pages covered by the range", len(covered))
+	if len(covered) == 0 {
+		t.Fatal("no page is covered by the range")
+	}
+
+	fd := &readCountSSTFileDesc{sstFileDesc: file.fd, offsets: map[int64]bool{}}
+	file.fd = fd
+
+	newFile, changed, err := lsm.rewriteDeleteKeyRange(0, file, []deleteKeyRange{{low: low, high: high}}, noOlder)
+	if err != nil || !changed || newFile == nil {
+		t.Fatal(newFile, changed, err)
+	}
+
+	// full drops without reading
+	for off := range covered {
+		if fd.offsets[off] {
+			t.Fatalf("page at offset %d is covered by the range but read", off)
+		}
+	}
+
+	if newFile.NumEntry != 600 {
+		t.Fatalf("%d entries are left, expected 600", newFile.NumEntry)
+	}
+
+	got, err := lsm.loadFileEntries(newFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []entry{}
+	for i := 0; i < len(es); i++ {
+		if d := string(es[i].deleteKey); d < string(low) || d > string(high) {
+			expected = append(expected, es[i])
+		}
+	}
+	sortEntriesOnSortKey(expected, options.SortKeyLess)
+
+	if len(got) != len(expected) {
+		t.Fatalf("got %d entries, expected %d", len(got), len(expected))
+	}
+	for i := 0; i < len(got); i++ {
+		if !entryEqual(&got[i], &expected[i]) {
+			t.Fatalf("got entry [%s], expected [%s]", string(got[i].key), string(expected[i].key))
+		}
+	}
+
+	// nothing left to drop
+	if _, changed, err := lsm.rewriteDeleteKeyRange(0, newFile, []deleteKeyRange{{low: low, high: high}}, noOlder); changed || err != nil {
+		t.Fatal(changed, err)
+	}
+
+	// drop all
+	if newFile, changed, err := lsm.rewriteDeleteKeyRange(0, file, []deleteKeyRange{{low: []byte("dkey-00000"), high: []byte("dkey-00999")}}, noOlder); newFile != nil || !changed || err != nil {
+		t.Fatal(newFile, changed, err)
+	}
+}
+
+func TestDelByDeleteKeyRange(t *testing.T) {
+
+	options := DefaultCollectionOptions
+	options.DirPath = t.TempDir()
+	options.CreateIfMissing = true
+	options.MemTableSizeLimit = 16 << 10 // 16KB
+	options.StandardPageSize = 512
+	options.NumInitialLevel = 3
+
+	lsm, err := newCollection(&options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deleteKey := func(i int) []byte {
+		return []byte(fmt.Sprintf("dkey-%05d", (i*7919)%3000))
+	}
+
+	for i := 0; i < 3000; i++ {
+		key := []byte(fmt.Sprintf("key-%05d", i))
+		if err := lsm.Put(key, key, deleteKey(i), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// tombstones are kept
+	for i := 0; i < 3000; i += 10 {
+		if err := lsm.Del([]byte(fmt.Sprintf("key-%05d", i)), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// entries left in memTable
+	for i := 3000; i < 3300; i++ {
+		key := []byte(fmt.Sprintf("key-%05d", i))
+		if err := lsm.Put(key, key, deleteKey(i), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testWaitPersisted(t, lsm)
+	fmt.Println("files on levels", testNumFiles(lsm))
+
+	low := []byte("dkey-01000")
+	high := []byte("dkey-01999")
+
+	if err := lsm.DelByDeleteKeyRange(low, high, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func() {
+		for i := 0; i < 3300; i++ {
+			key := []byte(fmt.Sprintf("key-%05d", i))
+			value, err := lsm.Get(key, nil)
+
+			d := string(deleteKey(i))
+			if (i < 3000 && i%10 == 0) || (string(low) <= d && d <= string(high)) {
+				if err != ErrKeyNotFound {
+					t.Fatalf("key [%s] of delete key [%s] expected deleted, got [%s] %v", string(key), d, string(value), err)
+				}
+				continue
+			}
+			if err != nil || !bytes.Equal(value, key) {
+				t.Fatalf("key [%s] got [%s] %v", string(key), string(value), err)
+			}
+		}
+	}
+
+	check()
+
+	lsm.Close()
+
+	// the rewritten files are recorded by MANIFEST,
+	// and the secondary range delete of memTable is replayed from write-ahead log
+	options.CreateIfMissing = false
+	lsm, err = newCollection(&options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+
+	check()
+}
+
+func TestDelByDeleteKeyRangeOlderVersion(t *testing.T) {
+
+	options := DefaultCollectionOptions
+	options.DirPath = t.TempDir()
+	options.CreateIfMissing = true
+
+	lsm, err := newCollection(&options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+
+	key := []byte("key")
+	low := []byte("dkey-a-000")
+	high := []byte("dkey-a-010")
+
+	check := func() {
+		if value, err := lsm.Get(key, nil); err != ErrKeyNotFound {
+			t.Fatalf("key [%s] expected deleted, got [%s] %v", string(key), string(value), err)
+		}
+	}
+
+	// the older version out of the range is in a file, the newer one in the range is in memTable
+	if err := lsm.Put(key, []byte("old"), []byte("dkey-z-100"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsm.flushCurMemTable(); err != nil {
+		t.Fatal(err)
+	}
+	testWaitPersisted(t, lsm)
+
+	if err := lsm.Put(key, []byte("new"), []byte("dkey-a-005"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsm.DelByDeleteKeyRange(low, high, nil); err != nil {
+		t.Fatal(err)
+	}
+	check()
+
+	// both versions are in files
+	if err := lsm.Put(key, []byte("old"), []byte("dkey-z-100"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsm.flushCurMemTable(); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsm.Put(key, []byte("new"), []byte("dkey-a-005"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsm.flushCurMemTable(); err != nil {
+		t.Fatal(err)
+	}
+	testWaitPersisted(t, lsm)
+	fmt.Println("files on levels", testNumFiles(lsm))
+
+	if err := lsm.DelByDeleteKeyRange(low, high, nil); err != nil {
+		t.Fatal(err)
+	}
+	check()
+}
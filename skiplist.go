@@ -10,6 +10,9 @@ import (
 
 // skipList is an ordered key-value map which was proposed by the paper below:
 // https://www.epaperpress.com/sortsearch/download/skipList.pdf
+//
+// The versions of a key are kept, which are sorted from the newest to the oldest on seqNum,
+// and a version of the same key and seqNum is overwritten.
 
 const (
 	defaultSkipListMaxLevel    int     = 32
@@ -101,7 +104,15 @@ func (sl *skipList) Empty() bool {
 	return sl.Num() == 0
 }
 
-// Get returns the copy of value by key.
+// before returns whether node x is before the version of key and seqNum.
+func (sl *skipList) before(x *skipListNode, key []byte, seqNum uint64) bool {
+	if sl.less(x.key, key) {
+		return true
+	}
+	return !sl.less(key, x.key) && x.entity.meta.seqNum > seqNum
+}
+
+// Get returns the newest version of key.
 // If the key is not found, it returns (nil, false).
 func (sl *skipList) Get(key []byte) (entity *sortedMapEntity, ok bool) {
 
@@ -131,7 +142,7 @@ func (sl *skipList) Put(key []byte, entity *sortedMapEntity) error {
 	x := sl.head
 
 	for i := sl.maxLevel - 1; i >= 0; i-- {
-		for x.forwards[i] != nil && sl.less(x.forwards[i].key, key) {
+		for x.forwards[i] != nil && sl.before(x.forwards[i], key, entity.meta.seqNum) {
 			x = x.forwards[i] // skip
 		}
 		update[i] = x
@@ -141,8 +152,8 @@ func (sl *skipList) Put(key []byte, entity *sortedMapEntity) error {
 
 	// fmt.Println("search done")
 
-	// replace existing old value with the new value, then return
-	if x != nil && bytes.Equal(x.key, key) {
+	// replace existing old value of the same version with the new value, then return
+	if x != nil && bytes.Equal(x.key, key) && x.entity.meta.seqNum == entity.meta.seqNum {
 		x.entity = copySortedMapEntity(entity) // overwrite
 		return nil                             // insert succeeded
 	}
@@ -161,7 +172,7 @@ func (sl *skipList) Put(key []byte, entity *sortedMapEntity) error {
 	return nil // insert succeeded
 }
 
-// Del the kv entry by key
+// Del the newest version of key
 // Del is in-place delete that is not needed in LSM.
 func (sl *skipList) Del(key []byte) error {
 	if sl.Empty() {
@@ -202,6 +213,59 @@ func (sl *skipList) Traverse(operation func(key []byte, entity *sortedMapEntity)
 	}
 }
 
+// NewIterator returns an iterator over the versions in skipList, which is not positioned.
+func (sl *skipList) NewIterator() sortedMapIterator {
+	return &skipListIterator{sl: sl}
+}
+
+// skipListIterator iterates the nodes of skipList on level-0.
+type skipListIterator struct {
+	sl *skipList
+	x  *skipListNode
+}
+
+func (it *skipListIterator) Valid() bool              { return it.x != nil }
+func (it *skipListIterator) Key() []byte              { return it.x.key }
+func (it *skipListIterator) Entity() *sortedMapEntity { return it.x.entity }
+func (it *skipListIterator) Next()                    { it.x = it.x.forwards[0] }
+func (it *skipListIterator) SeekToFirst()             { it.x = it.sl.head.forwards[0] }
+
+func (it *skipListIterator) Seek(key []byte, seqNum uint64) {
+	x := it.sl.head
+	for i := it.sl.maxLevel - 1; i >= 0; i-- {
+		for x.forwards[i] != nil && it.sl.before(x.forwards[i], key, seqNum) {
+			x = x.forwards[i] // skip
+		}
+	}
+	it.x = x.forwards[0]
+}
+
+func (it *skipListIterator) SeekLT(key []byte) {
+	x := it.sl.head
+	for i := it.sl.maxLevel - 1; i >= 0; i-- {
+		for x.forwards[i] != nil && it.sl.less(x.forwards[i].key, key) {
+			x = x.forwards[i] // skip
+		}
+	}
+	it.x = x
+	if x == it.sl.head {
+		it.x = nil
+	}
+}
+
+func (it *skipListIterator) SeekToLast() {
+	x := it.sl.head
+	for i := it.sl.maxLevel - 1; i >= 0; i-- {
+		for x.forwards[i] != nil {
+			x = x.forwards[i] // skip
+		}
+	}
+	it.x = x
+	if x == it.sl.head {
+		it.x = nil
+	}
+}
+
 func reverseStrings(ss []string) []string {
 	i := 0
 	j := len(ss) - 1
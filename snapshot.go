@@ -0,0 +1,204 @@
+package lethe
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+)
+
+// A view is a point-in-time set of the components of LSM as of seqNum.
+//
+// It is taken with writers excluded, so it contains exactly the entries whose seqNum <= seqNum.
+// The sortedMaps of memTables are taken without copying, which keep the versions of keys,
+// and the versions written after seqNum are skipped on reads.
+// The files on levels are pinned, because SST-files are immutable.
+// So a compaction replaces files freely while the versions visible to a view are kept in the replaced files,
+// which are removed after the view is released.
+
+type view struct {
+	lsm *collection
+
+	seqNum uint64
+
+	// sortedMaps of memTables, from the newest to the oldest
+	memTables []memTableView
+	// range tombstones of memTables as of seqNum
+	rangeDels []rangeTombstone
+
+	// files on each level, the newest file is at the back
+	levels [][]*sstFile
+}
+
+// newView takes a view of the current components of LSM and pins its files.
+func (lsm *collection) newView() *view {
+
+	// no secondary range delete is half done
+	lsm.dropLock.RLock()
+	defer lsm.dropLock.RUnlock()
+
+	// no mutation is applied meanwhile, nor is a file of newer entries added
+	lsm.writeLock.Lock()
+	defer lsm.writeLock.Unlock()
+
+	v := &view{lsm: lsm}
+	v.seqNum = lsm.currentSeqNum()
+
+	addRangeDels := func(rts []rangeTombstone) {
+		for _, rt := range rts {
+			if rt.SeqNum <= v.seqNum {
+				v.rangeDels = append(v.rangeDels, rt)
+			}
+		}
+	}
+
+	v.memTables = append(v.memTables, lsm.curMemTable.view())
+	addRangeDels(lsm.curMemTable.RangeDels())
+
+	// An immutable memTable is popped after its file is added to `Level 1`,
+	// so it is either in the queue or in the files taken below.
+	for _, imt := range lsm.immutableQ.memTables() {
+		v.memTables = append(v.memTables, imt.view())
+		addRangeDels(imt.RangeDels())
+	}
+
+	lsm.RLock()
+	defer lsm.RUnlock()
+
+	for _, lv := range lsm.levels {
+		lv.Lock()
+		files := append([]*sstFile{}, lv.Files...)
+		lv.Unlock()
+
+		lsm.pinFiles(files)
+		v.levels = append(v.levels, files)
+	}
+
+	return v
+}
+
+// release unpins the files of view.
+func (v *view) release() {
+	for _, files := range v.levels {
+		v.lsm.unpinFiles(files)
+	}
+	v.levels = nil
+}
+
+// get retrieves a value by key from view, in the same way as collection.Get, the pages are read via r.
+func (v *view) get(key []byte, r pageReader) ([]byte, error) {
+
+	less := v.lsm.options.SortKeyLess
+
+	var (
+		found bool
+		value []byte
+		meta  keyMeta
+
+		tombSeqNum = maxCoveringSeqNum(v.rangeDels, key, less)
+	)
+
+	// memTables, seeked to the newest version as of seqNum
+	b := newIterBounds(nil, less)
+	for _, mv := range v.memTables {
+		it := newMemTableIterator(mv, v.seqNum, b)
+		if it.seek(key); it.valid() && bytes.Equal(it.entry().key, key) {
+			found, value, meta = true, copyBytes(it.entry().value), it.entry().meta
+			break
+		}
+	}
+
+	// persisted levels
+	for i := 0; !found && i < len(v.levels); i++ {
+		files := v.levels[i]
+		for j := len(files) - 1; j >= 0; j-- {
+			var err error
+			if found, value, meta, err = v.lsm.getFromSSTFile(files[j], key, &tombSeqNum, r); err != nil {
+				return nil, err
+			}
+			if found {
+				break
+			}
+		}
+	}
+
+	if !found || meta.opType == opDel || meta.seqNum < tombSeqNum {
+		return nil, ErrKeyNotFound
+	}
+
+	return value, nil
+}
+
+// -----------------------------------------------------------------------------
+// snapshot
+// -----------------------------------------------------------------------------
+
+// snapshot implements the Snapshot interface.
+type snapshot struct {
+	sync.Mutex
+
+	v      *view
+	closed bool
+}
+
+// Snapshot returns a stable read-only Snapshot of the key-val entries.
+func (lsm *collection) Snapshot() (Snapshot, error) {
+	if err := lsm.enter(); err != nil {
+		return nil, err
+	}
+	defer lsm.leave()
+
+	return &snapshot{v: lsm.newView()}, nil
+}
+
+// Get retrieves a value by key from the Snapshot.
+func (s *snapshot) Get(key []byte, readOptions *ReadOptions) ([]byte, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.closed {
+		return nil, ErrClosed
+	}
+	if err := s.v.lsm.enter(); err != nil {
+		return nil, err
+	}
+	defer s.v.lsm.leave()
+	if len(key) > maxSortKeyBytesLen {
+		return nil, ErrSortKeyTooLarge
+	}
+
+	atomic.AddInt64(&s.v.lsm.stats.numGet, 1)
+
+	return s.v.get(key, s.v.lsm.pageReader(readOptions))
+}
+
+// NewIterator returns an Iterator over the key-val entries of the Snapshot,
+// which is still valid after the Snapshot is closed.
+func (s *snapshot) NewIterator(readOptions *ReadOptions) (Iterator, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.closed {
+		return nil, ErrClosed
+	}
+	if err := s.v.lsm.enter(); err != nil {
+		return nil, err
+	}
+	defer s.v.lsm.leave()
+
+	return s.v.newIterator(readOptions), nil
+}
+
+// Close releases the files of the Snapshot.
+func (s *snapshot) Close() error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+
+	s.v.release()
+
+	return nil
+}
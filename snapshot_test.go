@@ -0,0 +1,185 @@
+package lethe
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+
+	options := DefaultCollectionOptions
+	options.DirPath = t.TempDir()
+	options.CreateIfMissing = true
+	options.MemTableSizeLimit = 16 << 10 // 16KB
+	options.LevelSizeRatio = 4
+	options.NumInitialLevel = 3
+
+	lsm, err := newCollection(&options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+
+	for i := 0; i < 3000; i++ {
+		key := []byte(fmt.Sprintf("key-%05d", i))
+		if err := lsm.Put(key, []byte("old"), key, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	testWaitCompacted(t, lsm)
+
+	// entries left in memTable
+	for i := 3000; i < 3100; i++ {
+		key := []byte(fmt.Sprintf("key-%05d", i))
+		if err := lsm.Put(key, []byte("old"), key, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	snap, err := lsm.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// overwrite, delete and range delete after the snapshot,
+	// and then compact the files read by the snapshot
+	for i := 0; i < 3100; i++ {
+		key := []byte(fmt.Sprintf("key-%05d", i))
+		if err := lsm.Put(key, []byte("new"), key, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 3100; i += 3 {
+		if err := lsm.Del([]byte(fmt.Sprintf("key-%05d", i)), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := lsm.RangeDel([]byte("key-01000"), []byte("key-01999"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsm.Put([]byte("key-09999"), []byte("new"), nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	testWaitCompacted(t, lsm)
+	fmt.Println("files on levels", testNumFiles(lsm))
+
+	for i := 0; i < 3100; i++ {
+		key := []byte(fmt.Sprintf("key-%05d", i))
+		value, err := snap.Get(key, nil)
+		if err != nil || string(value) != "old" {
+			t.Fatalf("snapshot key [%s] got [%s] %v", string(key), string(value), err)
+		}
+	}
+	if _, err := snap.Get([]byte("key-09999"), nil); err != ErrKeyNotFound {
+		t.Fatal("key written after snapshot is seen", err)
+	}
+
+	// the collection sees the new values meanwhile
+	if value, err := lsm.Get([]byte("key-00001"), nil); err != nil || string(value) != "new" {
+		t.Fatalf("got [%s] %v", string(value), err)
+	}
+	if _, err := lsm.Get([]byte("key-00003"), nil); err != ErrKeyNotFound {
+		t.Fatal(err)
+	}
+
+	it, err := snap.NewIterator(&ReadOptions{LowerBound: []byte("key-01000")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := snap.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := snap.Get([]byte("key-00001"), nil); err != ErrClosed {
+		t.Fatal(err)
+	}
+
+	// the iterator outlives the snapshot
+	n := 0
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		if expected := fmt.Sprintf("key-%05d", 1000+n); string(it.Key()) != expected || string(it.Value()) != "old" {
+			t.Fatalf("expected [%s], got [%s]:[%s]", expected, string(it.Key()), string(it.Value()))
+		}
+		n++
+	}
+	if n != 2100 || it.Err() != nil {
+		t.Fatal(n, it.Err())
+	}
+	it.Close()
+
+	// the files replaced meanwhile are removed once released
+	numFiles := 0
+	for _, n := range testNumFiles(lsm) {
+		numFiles += n
+	}
+	dirEntries, err := os.ReadDir(options.DirPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	numSSTFiles := 0
+	for _, de := range dirEntries {
+		if path.Ext(de.Name()) == sstFileSuffix {
+			numSSTFiles++
+		}
+	}
+	if numSSTFiles != numFiles {
+		t.Fatalf("%d SST-files under DirPath, %d files on levels", numSSTFiles, numFiles)
+	}
+}
+
+func TestSnapshotMemTableVersions(t *testing.T) {
+
+	options := DefaultCollectionOptions
+
+	lsm, err := newCollection(&options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+
+	key := []byte("key")
+	if err := lsm.Put(key, []byte("v1"), []byte("dkey-1"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	snap, err := lsm.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap.Close()
+
+	// the versions written after the snapshot stay in the same memTable
+	if err := lsm.Put(key, []byte("v2"), []byte("dkey-2"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsm.Put([]byte("key-new"), []byte("v2"), nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsm.DelByDeleteKeyRange([]byte("dkey-1"), []byte("dkey-2"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lsm.Get(key, nil); err != ErrKeyNotFound {
+		t.Fatal(err)
+	}
+
+	if value, err := snap.Get(key, nil); err != nil || string(value) != "v1" {
+		t.Fatalf("snapshot got [%s] %v", string(value), err)
+	}
+
+	it, err := snap.NewIterator(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+
+	got := []string{}
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		got = append(got, fmt.Sprintf("%s:%s", string(it.Key()), string(it.Value())))
+	}
+	fmt.Println(got)
+	if len(got) != 1 || got[0] != "key:v1" {
+		t.Fatal(got)
+	}
+}
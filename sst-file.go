@@ -1,23 +1,35 @@
 package lethe
 
 import (
-	"bytes"
-	"encoding/json"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
 	"lethe/bloomfilter"
+	"sort"
+	"sync/atomic"
 )
 
 type page struct {
-	SortKeyMin   []byte `json:"si"`
-	SortKeyMax   []byte `json:"sa"`
-	DeleteKeyMin []byte `json:"di"`
-	DeleteKeyMax []byte `json:"da"`
+	SortKeyMin   []byte
+	SortKeyMax   []byte
+	DeleteKeyMin []byte
+	DeleteKeyMax []byte
 
 	Offset int64
 	Size   int64
 
-	// TODO
-	// Range Secondary Deletes in a page: in place operation, just shrink size
-	// Range Secondary Deletes in a file: full drop, partial drop
+	// the codec of page, and Size is the number of bytes compressed
+	Compression Compression
+
+	// the encoding of entries in page, see pageFormatRestart
+	Format uint8
+
+	// A secondary range delete drops a page covered by the range without reading it,
+	// so the statistics of file are maintained at the granularity of page.
+	NumEntry      int
+	NumDelete     int
+	AgeOldestTomb uint32
 
 	// ---------------------------------------------
 	// fields below are not persisted and exported
@@ -28,159 +40,847 @@ type page struct {
 }
 
 type deleteTile struct {
-	SortKeyMin   []byte `json:"si"`
-	SortKeyMax   []byte `json:"sa"`
-	DeleteKeyMin []byte `json:"di"`
-	DeleteKeyMax []byte `json:"da"`
+	SortKeyMin   []byte
+	SortKeyMax   []byte
+	DeleteKeyMin []byte
+	DeleteKeyMax []byte
 
 	Pages []page
 }
 
+const (
+	sstFileSuffix = ".sst"
+)
+
+func sstFileName(num uint64) string {
+	return fmt.Sprintf("%06d%s", num, sstFileSuffix)
+}
+
 // sstFile is the in-memory format of SST-file.
 type sstFile struct {
 	Name string
 
-	SortKeyMin   []byte `json:"si"`
-	SortKeyMax   []byte `json:"sa"`
-	DeleteKeyMin []byte `json:"di"`
-	DeleteKeyMax []byte `json:"da"`
+	SortKeyMin   []byte
+	SortKeyMax   []byte
+	DeleteKeyMin []byte
+	DeleteKeyMax []byte
 
-	// the age of oldest tomb in file, Unix seconds
+	// the age of oldest tomb in file, Unix seconds, 0 if there is no tomb
 	AgeOldestTomb uint32
 	// the number of entries in file
 	NumEntry int
 	// the number of point delete in file
 	NumDelete int
+	// the estimated number of older entries invalidated by the tombstones in file
+	NumInvalidated int
+
+	// the number of bytes of file
+	Size int64
 
 	Tiles []deleteTile
 
+	// range tombstones in file, which are covered by the fences of file
+	RangeDels []rangeTombstone
+
 	// ---------------------------------------------
 	// fields below are not persisted and exported
 	// ---------------------------------------------
 
 	fd sstFileDesc
+
+	// the filter block in file, whose bloom filters are read through the block cache if filterCached,
+	// otherwise they are kept in pages
+	filterBlock  blockHandle
+	filterCached bool
+
+	// the codecs decoding pages, the builtin ones if nil
+	compressors compressors
+}
+
+// -----------------------------------------------------------------------------
+// SST-file format
+// -----------------------------------------------------------------------------
+// [ data pages | index block | filter block | properties block | range-tombstone block | footer ]
+//
+// index block:           numTile, { tile fences, numPage, { page fences, offset, size, numEntry, numDelete, ageOldestTomb, compression, format } }
+// filter block:          numPage, { bloom filter on sort keys of page }, in the order of index block
+// properties block:      numProperty, { name, value }
+// range-tombstone block: numRangeTombstone, { start, end, seqNum }
+// footer:                [ { block handle(16) } | version(4) | magic(8) ], one handle for each block
+//
+// A block handle is the fixed-length [ offset(8) | size(8) ] of a block in file.
+// Every page and block is followed by its CRC32C, see checksum.go.
+// The entries of page are encoded in its format, see page-block.go.
+// -----------------------------------------------------------------------------
+
+const (
+	blockHandleLen = 16
+
+	// the tail of footer, i.e. [ version(4) | magic(8) ]
+	sstFooterTailLen = 4 + 8
+
+	// sstMagic is "LETHESST" in big-endian
+	sstMagic uint64 = 0x4c45544845535354
+
+	// sstFormatVersion is the format version written and read by this implementation
+	sstFormatVersion uint32 = 1
+
+	// sstFilterBlockIndex is the index of filter block among metadata blocks
+	sstFilterBlockIndex = 1
+)
+
+// names of properties
+const (
+	propSortKeyMin    = "sort-key-min"
+	propSortKeyMax    = "sort-key-max"
+	propDeleteKeyMin  = "delete-key-min"
+	propDeleteKeyMax  = "delete-key-max"
+	propAgeOldestTomb = "age-oldest-tomb"
+	propNumEntry      = "num-entry"
+	propNumDelete     = "num-delete"
+
+	propNumInvalidated = "num-invalidated"
+)
+
+type blockHandle struct {
+	offset int64
+	size   int64
+}
+
+func (h blockHandle) encodeTo(buf []byte) {
+	binary.LittleEndian.PutUint64(buf[0:8], uint64(h.offset))
+	binary.LittleEndian.PutUint64(buf[8:16], uint64(h.size))
+}
+
+func decodeBlockHandle(buf []byte) blockHandle {
+	return blockHandle{
+		offset: int64(binary.LittleEndian.Uint64(buf[0:8])),
+		size:   int64(binary.LittleEndian.Uint64(buf[8:16])),
+	}
+}
+
+// blockWriter appends varints and length-prefixed bytes to a block.
+type blockWriter struct {
+	buf []byte
+}
+
+func (w *blockWriter) putUvarint(x uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], x)
+	w.buf = append(w.buf, tmp[:n]...)
+}
+
+func (w *blockWriter) putBytes(p []byte) {
+	w.putUvarint(uint64(len(p)))
+	w.buf = append(w.buf, p...)
+}
+
+// blockReader reads what blockWriter appends.
+// The first error is sticky, so that a caller checks err only once at the end.
+type blockReader struct {
+	buf []byte
+	err error
+}
+
+var errBadBlock = errors.New("bad-block")
+
+func (r *blockReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	x, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		r.err = errBadBlock
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return x
+}
+
+// count returns the number of items followed, each of which takes at least one byte of the block,
+// so that a bad count fails instead of a huge allocation.
+func (r *blockReader) count() int {
+	n := r.uvarint()
+	if r.err != nil {
+		return 0
+	}
+	if uint64(len(r.buf)) < n {
+		r.err = errBadBlock
+		return 0
+	}
+	return int(n)
+}
+
+// bytes returns a slice of the block, which is NOT copied.
+func (r *blockReader) bytes() []byte {
+	n := r.uvarint()
+	if r.err != nil {
+		return nil
+	}
+	if uint64(len(r.buf)) < n {
+		r.err = errBadBlock
+		return nil
+	}
+	p := r.buf[:n:n]
+	r.buf = r.buf[n:]
+	return p
 }
 
 // -----------------------------------------------------------------------------
 // encode & decode sstFile
 // -----------------------------------------------------------------------------
 
-func encodeSSTFile(file *sstFile) (buf []byte, err error) {
+func encodeIndexBlock(file *sstFile) []byte {
+	w := &blockWriter{}
+
+	w.putUvarint(uint64(len(file.Tiles)))
+	for i := 0; i < len(file.Tiles); i++ {
+		dt := &file.Tiles[i]
+
+		w.putBytes(dt.SortKeyMin)
+		w.putBytes(dt.SortKeyMax)
+		w.putBytes(dt.DeleteKeyMin)
+		w.putBytes(dt.DeleteKeyMax)
+
+		w.putUvarint(uint64(len(dt.Pages)))
+		for j := 0; j < len(dt.Pages); j++ {
+			p := &dt.Pages[j]
+
+			w.putBytes(p.SortKeyMin)
+			w.putBytes(p.SortKeyMax)
+			w.putBytes(p.DeleteKeyMin)
+			w.putBytes(p.DeleteKeyMax)
+			w.putUvarint(uint64(p.Offset))
+			w.putUvarint(uint64(p.Size))
+			w.putUvarint(uint64(p.NumEntry))
+			w.putUvarint(uint64(p.NumDelete))
+			w.putUvarint(uint64(p.AgeOldestTomb))
+			w.putUvarint(uint64(p.Compression))
+			w.putUvarint(uint64(p.Format))
+		}
+	}
+
+	return w.buf
+}
+
+func decodeIndexBlock(file *sstFile, buf []byte) error {
+	r := &blockReader{buf: buf}
+
+	file.Tiles = make([]deleteTile, r.count())
+	for i := 0; i < len(file.Tiles) && r.err == nil; i++ {
+		dt := &file.Tiles[i]
+
+		dt.SortKeyMin = r.bytes()
+		dt.SortKeyMax = r.bytes()
+		dt.DeleteKeyMin = r.bytes()
+		dt.DeleteKeyMax = r.bytes()
+
+		dt.Pages = make([]page, r.count())
+		for j := 0; j < len(dt.Pages) && r.err == nil; j++ {
+			p := &dt.Pages[j]
+
+			p.SortKeyMin = r.bytes()
+			p.SortKeyMax = r.bytes()
+			p.DeleteKeyMin = r.bytes()
+			p.DeleteKeyMax = r.bytes()
+			p.Offset = int64(r.uvarint())
+			p.Size = int64(r.uvarint())
+			p.NumEntry = int(r.uvarint())
+			p.NumDelete = int(r.uvarint())
+			p.AgeOldestTomb = uint32(r.uvarint())
+			p.Compression = Compression(r.uvarint())
+			p.Format = uint8(r.uvarint())
+
+			// a page is read as a whole, so it must be within file
+			if r.err == nil && (p.Offset < 0 || p.Size < 0 || p.Offset+p.Size > file.Size) {
+				r.err = errBadBlock
+			}
+		}
+	}
+
+	return r.err
+}
+
+func encodeFilterBlock(file *sstFile) []byte {
+	w := &blockWriter{}
+
+	numPage := 0
+	for i := 0; i < len(file.Tiles); i++ {
+		numPage += len(file.Tiles[i].Pages)
+	}
+
+	// a page without bloom filter is encoded as empty bytes
+	w.putUvarint(uint64(numPage))
+	for i := 0; i < len(file.Tiles); i++ {
+		for j := 0; j < len(file.Tiles[i].Pages); j++ {
+			if bloom := file.Tiles[i].Pages[j].bloom; bloom != nil {
+				w.putBytes(bloom.Bytes())
+			} else {
+				w.putBytes(nil)
+			}
+		}
+	}
+
+	return w.buf
+}
+
+func decodeFilterBlock(file *sstFile, buf []byte) error {
+	filters, err := decodeFilters(file, buf)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < len(file.Tiles); i++ {
+		for j := 0; j < len(file.Tiles[i].Pages); j++ {
+			file.Tiles[i].Pages[j].bloom = filters[i][j]
+		}
+	}
+
+	return nil
+}
+
+// decodeFilters decodes the bloom filters of pages of file, [i][j] for page j of tile i.
+func decodeFilters(file *sstFile, buf []byte) ([][]*bloomfilter.BloomFilter, error) {
+	r := &blockReader{buf: buf}
+
+	filters := make([][]*bloomfilter.BloomFilter, len(file.Tiles))
+
+	numPage := int(r.uvarint())
+	for i := 0; i < len(file.Tiles) && r.err == nil; i++ {
+		filters[i] = make([]*bloomfilter.BloomFilter, len(file.Tiles[i].Pages))
+
+		for j := 0; j < len(file.Tiles[i].Pages) && r.err == nil; j++ {
+			numPage--
+
+			buf := r.bytes()
+			if len(buf) == 0 {
+				continue
+			}
+
+			bloom, err := bloomfilter.Decode(buf)
+			if err != nil {
+				return nil, err
+			}
+			filters[i][j] = bloom
+		}
+	}
+
+	if r.err == nil && numPage != 0 {
+		return nil, errBadBlock
+	}
+
+	return filters, r.err
+}
+
+// loadFilters reads and decodes the filter block of file.
+func loadFilters(file *sstFile) ([][]*bloomfilter.BloomFilter, error) {
+	buf, err := file.readBlock(file.filterBlock)
+	if err != nil {
+		return nil, err
+	}
+
+	filters, err := decodeFilters(file, buf)
+	if err != nil {
+		return nil, file.corruption(file.filterBlock.offset, err.Error())
+	}
+
+	return filters, nil
+}
+
+func encodePropertiesBlock(file *sstFile) []byte {
+	w := &blockWriter{}
+
+	putUvarint := func(x uint64) []byte {
+		var tmp [binary.MaxVarintLen64]byte
+		n := binary.PutUvarint(tmp[:], x)
+		return tmp[:n]
+	}
+
+	props := []struct {
+		name  string
+		value []byte
+	}{
+		{propSortKeyMin, file.SortKeyMin},
+		{propSortKeyMax, file.SortKeyMax},
+		{propDeleteKeyMin, file.DeleteKeyMin},
+		{propDeleteKeyMax, file.DeleteKeyMax},
+		{propAgeOldestTomb, putUvarint(uint64(file.AgeOldestTomb))},
+		{propNumEntry, putUvarint(uint64(file.NumEntry))},
+		{propNumDelete, putUvarint(uint64(file.NumDelete))},
+		{propNumInvalidated, putUvarint(uint64(file.NumInvalidated))},
+	}
+
+	w.putUvarint(uint64(len(props)))
+	for _, prop := range props {
+		w.putBytes([]byte(prop.name))
+		w.putBytes(prop.value)
+	}
+
+	return w.buf
+}
+
+func decodePropertiesBlock(file *sstFile, buf []byte) error {
+	r := &blockReader{buf: buf}
+
+	uvarint := func(value []byte) uint64 {
+		x, n := binary.Uvarint(value)
+		if n <= 0 {
+			r.err = errBadBlock
+		}
+		return x
+	}
+
+	numProp := int(r.uvarint())
+	for i := 0; i < numProp && r.err == nil; i++ {
+		name := string(r.bytes())
+		value := r.bytes()
+
+		// unknown properties are skipped
+		switch name {
+		case propSortKeyMin:
+			file.SortKeyMin = value
+		case propSortKeyMax:
+			file.SortKeyMax = value
+		case propDeleteKeyMin:
+			file.DeleteKeyMin = value
+		case propDeleteKeyMax:
+			file.DeleteKeyMax = value
+		case propAgeOldestTomb:
+			file.AgeOldestTomb = uint32(uvarint(value))
+		case propNumEntry:
+			file.NumEntry = int(uvarint(value))
+		case propNumDelete:
+			file.NumDelete = int(uvarint(value))
+		case propNumInvalidated:
+			file.NumInvalidated = int(uvarint(value))
+		}
+	}
+
+	return r.err
+}
+
+func encodeRangeTombstoneBlock(file *sstFile) []byte {
+	w := &blockWriter{}
+
+	w.putUvarint(uint64(len(file.RangeDels)))
+	for i := 0; i < len(file.RangeDels); i++ {
+		rt := &file.RangeDels[i]
+
+		w.putBytes(rt.Start)
+		w.putBytes(rt.End)
+		w.putUvarint(rt.SeqNum)
+	}
+
+	return w.buf
+}
+
+func decodeRangeTombstoneBlock(file *sstFile, buf []byte) error {
+	r := &blockReader{buf: buf}
+
+	file.RangeDels = make([]rangeTombstone, r.count())
+	for i := 0; i < len(file.RangeDels) && r.err == nil; i++ {
+		rt := &file.RangeDels[i]
+
+		rt.Start = r.bytes()
+		rt.End = r.bytes()
+		rt.SeqNum = r.uvarint()
+	}
+
+	if len(file.RangeDels) == 0 {
+		file.RangeDels = nil
+	}
+
+	return r.err
+}
+
+// writeSSTFileMeta appends the metadata blocks and footer to the data pages of file, whose size is off.
+func writeSSTFileMeta(file *sstFile, off int64) error {
+
+	blocks := [][]byte{
+		encodeIndexBlock(file),
+		encodeFilterBlock(file),
+		encodePropertiesBlock(file),
+		encodeRangeTombstoneBlock(file),
+	}
+
+	footerLen := len(blocks)*blockHandleLen + sstFooterTailLen
+	footer := make([]byte, footerLen)
+
+	for i, block := range blocks {
+		block = appendChecksum(block)
+		if err := file.write(block); err != nil {
+			return err
+		}
+
+		h := blockHandle{offset: off, size: int64(len(block))}
+		h.encodeTo(footer[i*blockHandleLen:])
+		if i == sstFilterBlockIndex {
+			file.filterBlock = h
+		}
+		off += int64(len(block))
+	}
+
+	binary.LittleEndian.PutUint32(footer[footerLen-sstFooterTailLen:], sstFormatVersion)
+	binary.LittleEndian.PutUint64(footer[footerLen-8:], sstMagic)
+
+	if err := file.write(footer); err != nil {
+		return err
+	}
+
+	file.Size = off + int64(footerLen)
 
-	js, err := json.Marshal(file)
+	return nil
+}
+
+// loadSSTFile reconstructs sstFile from the footer of a SST-file.
+// The metadata blocks are always verified against their checksums.
+func loadSSTFile(fd sstFileDesc) (*sstFile, error) {
+
+	size, err := fd.Size()
 	if err != nil {
 		return nil, err
 	}
 
-	return js, nil
+	file := &sstFile{}
+	file.Name = fd.Name()
+	file.Size = size
+	file.fd = fd
+
+	if size < sstFooterTailLen {
+		return nil, file.corruption(0, "too short")
+	}
+
+	tail := make([]byte, sstFooterTailLen)
+	if err := file.readAt(tail, size-sstFooterTailLen); err != nil {
+		return nil, err
+	}
+
+	if binary.LittleEndian.Uint64(tail[4:]) != sstMagic {
+		return nil, file.corruption(size-8, "bad magic number")
+	}
+	version := binary.LittleEndian.Uint32(tail)
+	if version != sstFormatVersion {
+		return nil, file.corruption(size-sstFooterTailLen, fmt.Sprintf("unsupported format version %d", version))
+	}
+
+	decoders := []func(file *sstFile, buf []byte) error{
+		decodeIndexBlock,
+		decodeFilterBlock,
+		decodePropertiesBlock,
+		decodeRangeTombstoneBlock,
+	}
+
+	footerLen := int64(len(decoders)*blockHandleLen + sstFooterTailLen)
+	if size < footerLen {
+		return nil, file.corruption(0, "too short")
+	}
+
+	footer := make([]byte, footerLen)
+	if err := file.readAt(footer, size-footerLen); err != nil {
+		return nil, err
+	}
+
+	for i, decode := range decoders {
+		h := decodeBlockHandle(footer[i*blockHandleLen:])
+		if h.offset < 0 || h.size < 0 || h.offset+h.size > size-footerLen {
+			return nil, file.corruption(size-footerLen+int64(i*blockHandleLen), "bad block handle")
+		}
+
+		if i == sstFilterBlockIndex {
+			file.filterBlock = h
+		}
+
+		buf, err := file.readBlock(h)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := decode(file, buf); err != nil {
+			return nil, file.corruption(h.offset, err.Error())
+		}
+	}
+
+	return file, nil
 }
 
-func decodeSSTFile(buf []byte) (*sstFile, error) {
+// readAt reads len(buf) bytes at off of file, and a short read is a corruption, e.g. the file is truncated.
+func (file *sstFile) readAt(buf []byte, off int64) error {
+	n, err := file.fd.ReadAt(buf, off)
+	if n == len(buf) {
+		return nil
+	}
+	if err == nil || err == io.EOF {
+		return file.corruption(off, "truncated")
+	}
+	return err
+}
 
-	var file sstFile
-	if err := json.Unmarshal(buf, &file); err != nil {
+// write appends buf to file, and a short write is io.ErrShortWrite.
+func (file *sstFile) write(buf []byte) error {
+	n, err := file.fd.Write(buf)
+	if err != nil {
+		return err
+	}
+	if n != len(buf) {
+		return io.ErrShortWrite
+	}
+	return nil
+}
+
+// readBlock reads the metadata block of h, and verifies it against its checksum.
+func (file *sstFile) readBlock(h blockHandle) ([]byte, error) {
+	buf := make([]byte, h.size)
+	if err := file.readAt(buf, h.offset); err != nil {
 		return nil, err
 	}
 
-	return &file, nil
+	buf, ok := splitChecksum(buf)
+	if !ok {
+		return nil, file.corruption(h.offset, "checksum mismatch")
+	}
+	return buf, nil
+}
+
+// setStats sets the statistics of page from its entries.
+func (p *page) setStats(es []entry) {
+	p.NumEntry = len(es)
+	p.NumDelete = 0
+	p.AgeOldestTomb = 0
+
+	for i := 0; i < len(es); i++ {
+		if es[i].meta.opType != opDel {
+			continue
+		}
+
+		p.NumDelete++
+
+		// parse age of entry from seqNum, the oldest is the least
+		age := uint32((es[i].meta.seqNum >> 32) & 0xFFFFFFFF)
+		if p.AgeOldestTomb == 0 || age < p.AgeOldestTomb {
+			p.AgeOldestTomb = age
+		}
+	}
 }
 
 // -----------------------------------------------------------------------------
 // bloom filter
 // -----------------------------------------------------------------------------
 
-func (p *page) buildBloomFilter() error {
-	// TODO
-	return nil
+// buildBloomFilter builds the bloom filter on the sort keys of entries in this page.
+// If bitsPerKey is not positive, the page has no bloom filter.
+func (p *page) buildBloomFilter(es []entry, bitsPerKey int) {
+
+	if bitsPerKey <= 0 {
+		p.bloom = nil
+		return
+	}
+
+	p.bloom = bloomfilter.New(len(es), bitsPerKey)
+	for i := 0; i < len(es); i++ {
+		p.bloom.Add(es[i].key)
+	}
 }
 
 // bloomFilterExists returns false if the key is exactly not in this page
 func (p *page) bloomFilterExists(key []byte) bool {
-	// TODO
-	return true
+	if p.bloom == nil {
+		return true
+	}
+	return p.bloom.MayContain(key)
 }
 
 // -----------------------------------------------------------------------------
 // load data
 // -----------------------------------------------------------------------------
 
-func loadEntries(file *sstFile, p *page) ([]entry, error) {
+// loadPage reads page p of file, which is verified against the checksum of page if verify.
+// A page which can not be decoded is a corruption, even if it is not verified.
+func loadPage(file *sstFile, p *page, verify bool) (*pageBlock, error) {
 	buf := make([]byte, p.Size)
 
-	if _, err := file.fd.ReadAt(buf, p.Offset); err != nil {
+	if err := file.readAt(buf, p.Offset); err != nil {
 		return nil, err
 	}
 
-	return decodeEntries(buf)
+	data, ok := splitChecksum(buf)
+	if len(buf) < checksumLen || (verify && !ok) {
+		return nil, file.corruption(p.Offset, "checksum mismatch")
+	}
+
+	buf, err := file.compressors.decompress(p.Compression, data)
+	if err == ErrUnknownCompression {
+		return nil, err
+	}
+	if err != nil {
+		return nil, file.corruption(p.Offset, err.Error())
+	}
+
+	b, err := newPageBlock(p.Format, buf)
+	if err != nil {
+		return nil, file.corruption(p.Offset, err.Error())
+	}
+
+	return b, nil
+}
+
+// loadEntries reads the entries of page p of file, which are verified against the checksum of page if verify.
+func loadEntries(file *sstFile, p *page, verify bool) ([]entry, error) {
+	b, err := loadPage(file, p, verify)
+	if err != nil {
+		return nil, err
+	}
+
+	es, err := b.entriesFrom(nil, nil)
+	if err != nil {
+		return nil, file.corruption(p.Offset, err.Error())
+	}
+
+	return es, nil
+}
+
+// loadFileEntries loads all the entries of file sorted on sort key.
+// The pages cached are used, but the pages read are not filled into the cache, e.g. by compactions,
+// and they are verified so that a corruption is not spread.
+func (lsm *collection) loadFileEntries(file *sstFile) ([]entry, error) {
+
+	r := pageReader{cache: lsm.cache, verifyChecksums: true}
+
+	es := make([]entry, 0, file.NumEntry)
+
+	// delete tiles within a sstFile are sorted on sort key
+	for i := 0; i < len(file.Tiles); i++ {
+
+		start := len(es)
+
+		for j := 0; j < len(file.Tiles[i].Pages); j++ {
+			pes, err := r.loadEntries(file, &file.Tiles[i].Pages[j])
+			if err != nil {
+				return nil, err
+			}
+			es = append(es, pes...)
+		}
+
+		// pages within a delete tile are sorted on delete key but not sort key
+		sortEntriesOnSortKey(es[start:], lsm.options.SortKeyLess)
+	}
+
+	return es, nil
+}
+
+// mayContain returns false if the key is exactly not in file,
+// which is checked via fence pointers and bloom filters without reading data.
+func (lsm *collection) mayContain(file *sstFile, key []byte) bool {
+
+	less := lsm.options.SortKeyLess
+
+	if less(key, file.SortKeyMin) || less(file.SortKeyMax, key) {
+		return false
+	}
+
+	// binary search because delete tiles within a sstfile are sorted on sort key
+	i := sort.Search(len(file.Tiles), func(i int) bool {
+		return !less(file.Tiles[i].SortKeyMax, key)
+	})
+	if i == len(file.Tiles) || less(key, file.Tiles[i].SortKeyMin) {
+		return false
+	}
+
+	filters := lsm.pageReader(nil).filters(file)
+
+	for j := 0; j < len(file.Tiles[i].Pages); j++ {
+		p := &file.Tiles[i].Pages[j]
+		if less(key, p.SortKeyMin) || less(p.SortKeyMax, key) {
+			continue
+		}
+		if bloom := bloomOf(file, filters, i, j); bloom == nil || bloom.MayContain(key) {
+			return true
+		}
+	}
+
+	return false
 }
 
 // -----------------------------------------------------------------------------
 // get
 // -----------------------------------------------------------------------------
 
-func (lsm *collection) getFromSSTFile(file *sstFile, key []byte) (found bool, value []byte, meta keyMeta) {
+// getFromSSTFile gets value by key from a SST-file.
+// tombSeqNum is raised to the greatest seqNum of range tombstones covering key.
+// The pages and filters are read via r, and the value returned is copied from the page.
+// An error is returned if a page fails to load, e.g. ErrCorruption.
+func (lsm *collection) getFromSSTFile(file *sstFile, key []byte, tombSeqNum *uint64, r pageReader) (found bool, value []byte, meta keyMeta, err error) {
 
 	// Note that there are no duplicate keys in a SST-File, i.e. each key is the SST-File is unique.
 
 	less := lsm.options.SortKeyLess
 
-	// get from a page
-	pageGet := func(p *page) (found bool, value []byte, meta keyMeta) {
+	if seqNum := maxCoveringSeqNum(file.RangeDels, key, less); seqNum > *tombSeqNum {
+		*tombSeqNum = seqNum
+	}
+
+	// the cached filters of file, loaded once a tile may contain key
+	var filters [][]*bloomfilter.BloomFilter
+
+	// get from page j of tile i
+	pageGet := func(i, j int) (found bool, value []byte, meta keyMeta, err error) {
+
+		p := &file.Tiles[i].Pages[j]
 
 		// page fence pointer check (i.e. SortKeyMin <= key <= SortKeyMax)
 		if less(key, p.SortKeyMin) || less(p.SortKeyMax, key) {
-			return false, nil, meta
+			return false, nil, meta, nil
 		}
 
 		// check key existence via page-granularity bloom filter
-		if p.bloomFilterExists(key) == false {
-			return false, nil, meta
+		if bloom := bloomOf(file, filters, i, j); bloom != nil && !bloom.MayContain(key) {
+			return false, nil, meta, nil
 		}
 
-		// load data form disk...
-		es, _ := loadEntries(file, p)
+		// load data form cache or disk...
+		b, err := r.loadPage(file, p)
+		if err != nil {
+			return false, nil, meta, err
+		}
+		atomic.AddInt64(&lsm.stats.pagesRead, 1)
 
-		// binary search because entries within every page are sorted on sort key
-		left := 0
-		right := len(es) - 1
-		for left <= right {
-			mid := (left + right) / 2
-			if bytes.Equal(es[mid].key, key) {
-				return true, es[mid].value, es[mid].meta
-			}
-			if less(key, es[mid].key) {
-				right = mid - 1
-			} else {
-				left = mid + 1
-			}
+		// search over the encoded entries via the restart points of page
+		e, found, err := b.get(key, less)
+		if err != nil {
+			return false, nil, meta, file.corruption(p.Offset, err.Error())
+		}
+		if !found {
+			// key is not found in this page
+			return false, nil, meta, nil
 		}
 
-		// key is not found in this page
-		return false, nil, meta
+		// the cached page is shared
+		return true, copyBytes(e.value), e.meta, nil
 	}
 
 	// get from a delete-tile
-	tileGet := func(dt *deleteTile) (found bool, value []byte, meta keyMeta) {
+	tileGet := func(i int) (found bool, value []byte, meta keyMeta, err error) {
+
+		filters = r.filters(file)
 
 		// linear search because pages within a delete-tile are sorted on delete key but not sort key
-		for i := 0; i < len(dt.Pages); i++ {
+		for j := 0; j < len(file.Tiles[i].Pages); j++ {
 
-			if found, value, meta = pageGet(&dt.Pages[i]); found {
-				return true, value, meta
+			if found, value, meta, err = pageGet(i, j); found || err != nil {
+				return found, value, meta, err
 			}
 
 			// If key is not found and not deleted, keep searching in next pages
 		}
 
 		// key is not found in this delete-tile
-		return false, nil, meta
+		return false, nil, meta, nil
 	}
 
 	// -------------------------------------------------------------------------
 
 	// sstFile fence pointer check (i.e. SortKeyMin <= key <= SortKeyMax)
 	if less(key, file.SortKeyMin) || less(file.SortKeyMax, key) {
-		return false, nil, meta
+		return false, nil, meta, nil
 	}
 
 	// binary search because delete tiles within a sstfile are sorted on sort key
@@ -200,12 +900,9 @@ func (lsm *collection) getFromSSTFile(file *sstFile, key []byte) (found bool, va
 		}
 
 		// SortKeyMin <= key <= SortKeyMax
-		if found, value, meta = tileGet(&file.Tiles[mid]); found {
-			return true, value, meta
-		}
-		return false, nil, meta
+		return tileGet(mid)
 	}
 
 	// key is not found in this SST-file
-	return false, nil, meta
+	return false, nil, meta, nil
 }
@@ -2,7 +2,6 @@ package lethe
 
 import (
 	"bytes"
-	"encoding/json"
 	"fmt"
 	"reflect"
 	"testing"
@@ -35,58 +34,139 @@ var exampleSSTFile *sstFile = &sstFile{
 			DeleteKeyMax: paddingBytes,
 			Pages: []page{
 				{
-					SortKeyMin:   paddingBytes,
-					SortKeyMax:   paddingBytes,
-					DeleteKeyMin: paddingBytes,
-					DeleteKeyMax: paddingBytes,
-					Offset:       233,
-					Size:         233,
+					SortKeyMin:    paddingBytes,
+					SortKeyMax:    paddingBytes,
+					DeleteKeyMin:  paddingBytes,
+					DeleteKeyMax:  paddingBytes,
+					Offset:        233,
+					Size:          233,
+					NumEntry:      12,
+					NumDelete:     3,
+					AgeOldestTomb: 123,
 				},
 				{
-					SortKeyMin:   paddingBytes,
-					SortKeyMax:   paddingBytes,
-					DeleteKeyMin: paddingBytes,
-					DeleteKeyMax: paddingBytes,
-					Offset:       233,
-					Size:         233,
+					SortKeyMin:    paddingBytes,
+					SortKeyMax:    paddingBytes,
+					DeleteKeyMin:  paddingBytes,
+					DeleteKeyMax:  paddingBytes,
+					Offset:        233,
+					Size:          233,
+					NumEntry:      12,
+					NumDelete:     3,
+					AgeOldestTomb: 123,
 				},
 			},
 		},
 	},
+	RangeDels: []rangeTombstone{
+		{Start: paddingBytes, End: paddingBytes, SeqNum: 123},
+	},
 }
 
-func TestEncodeSSTFile(t *testing.T) {
+func TestLoadSSTFile(t *testing.T) {
 
 	var (
-		buf            []byte
-		err            error
-		decodedSSTFile *sstFile
+		err           error
+		loadedSSTFile *sstFile
 	)
 
-	if buf, err = encodeSSTFile(exampleSSTFile); err != nil {
+	file := *exampleSSTFile
+	file.fd = openMemSSTFileDesc(file.Name)
+
+	// data pages
+	paddingBuf := make([]byte, 1024)
+	if n, err := file.fd.Write(paddingBuf); err != nil || n != len(paddingBuf) {
+		t.Fatal()
+	}
+
+	if err = writeSSTFileMeta(&file, int64(len(paddingBuf))); err != nil {
 		t.Log(err)
 		t.Fatal()
 	}
 
-	if decodedSSTFile, err = decodeSSTFile(buf); err != nil {
+	if loadedSSTFile, err = loadSSTFile(file.fd); err != nil {
 		t.Log(err)
 		t.Fatal()
 	}
-	if !reflect.DeepEqual(exampleSSTFile, decodedSSTFile) {
+	if !reflect.DeepEqual(&file, loadedSSTFile) {
 		t.Fatal()
 	}
 
-	fmt.Println(decodedSSTFile.SortKeyMax)
+	fmt.Println(loadedSSTFile.SortKeyMax)
 	fmt.Println(exampleSSTFile.SortKeyMax)
-	if !bytes.Equal(exampleSSTFile.SortKeyMax, decodedSSTFile.SortKeyMax) {
+	if !bytes.Equal(exampleSSTFile.SortKeyMax, loadedSSTFile.SortKeyMax) {
+		t.Fatal()
+	}
+
+	fmt.Println("SST-file size", loadedSSTFile.Size)
+}
+
+func TestLoadSSTFileBloomFilter(t *testing.T) {
+
+	es := []entry{exampleEntry1, exampleEntry2}
+
+	file := &sstFile{Name: "bloom"}
+	file.fd = openMemSSTFileDesc(file.Name)
+	file.Tiles = []deleteTile{{Pages: []page{{}}}}
+	file.Tiles[0].Pages[0].buildBloomFilter(es, 10)
+
+	if err := writeSSTFileMeta(file, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := loadSSTFile(file.fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &loaded.Tiles[0].Pages[0]
+	for i := 0; i < len(es); i++ {
+		if !p.bloomFilterExists(es[i].key) {
+			t.Fatalf("false negative on key [%s]", string(es[i].key))
+		}
+	}
+}
+
+func TestLoadSSTFileBadMagic(t *testing.T) {
+
+	fd := openMemSSTFileDesc("bad")
+	fd.Write(make([]byte, 256))
+
+	if _, err := loadSSTFile(fd); err == nil {
 		t.Fatal()
 	}
+}
+
+func TestDecodeIndexBlockBadCount(t *testing.T) {
+
+	file := &sstFile{Size: 1 << 10}
 
-	fmt.Println("encoded json len", len(buf))
-	var out bytes.Buffer
-	json.Indent(&out, buf, "", "\t")
-	fmt.Println(string(out.Bytes()))
+	// counts beyond the block
+	w := &blockWriter{}
+	w.putUvarint(1 << 40)
+	if err := decodeIndexBlock(file, w.buf); err != errBadBlock {
+		t.Fatal(err)
+	}
+	if err := decodeRangeTombstoneBlock(file, w.buf); err != errBadBlock {
+		t.Fatal(err)
+	}
 
+	// a page out of file
+	w = &blockWriter{}
+	w.putUvarint(1)
+	for i := 0; i < 4; i++ {
+		w.putBytes([]byte("key"))
+	}
+	w.putUvarint(1)
+	for i := 0; i < 4; i++ {
+		w.putBytes([]byte("key"))
+	}
+	for _, x := range []uint64{0, 1 << 20, 1, 0, 0, 0, uint64(pageFormatRestart)} {
+		w.putUvarint(x)
+	}
+	if err := decodeIndexBlock(file, w.buf); err != errBadBlock {
+		t.Fatal(err)
+	}
 }
 
 func TestLoadEntries(t *testing.T) {
@@ -106,10 +186,10 @@ func TestLoadEntries(t *testing.T) {
 	file.fd = openMemSSTFileDesc("")
 
 	es = testRandEntries(256)
-	buf, err = encodeEntries(es)
-	if err != nil {
-		t.Fatal()
-	}
+	sortEntriesOnSortKey(es, DefaultCollectionOptions.SortKeyLess)
+
+	// a page in the restart format
+	buf = appendChecksum(encodePage(es))
 
 	paddingBuf := make([]byte, off)
 	if n, err := file.fd.Write(paddingBuf); err != nil || n != len(paddingBuf) {
@@ -125,14 +205,15 @@ func TestLoadEntries(t *testing.T) {
 	p = &page{
 		Offset: off,
 		Size:   int64(len(buf)),
+		Format: pageFormatRestart,
 	}
 
-	es2, err = loadEntries(file, p)
+	es2, err = loadEntries(file, p, true)
 	if err != nil {
-		t.Fatal()
+		t.Fatal(err)
 	}
 
 	if !testEntriesEqual(es, es2) {
-		t.Fail()
+		t.Fatal("entries of page in the restart format")
 	}
 }
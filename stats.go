@@ -0,0 +1,182 @@
+package lethe
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// collectionStats are the counters of collection, which are updated atomically.
+type collectionStats struct {
+	numPut                 int64
+	numGet                 int64
+	numDel                 int64
+	numRangeDel            int64
+	numDelByDeleteKeyRange int64
+	bytesWritten           int64
+
+	// pages read from SST-files by Get
+	pagesRead int64
+
+	numFlush   int64
+	flushNanos int64
+	flushBytes int64
+
+	numCompaction          int64
+	numDDCompaction        int64
+	compactionNanos        int64
+	compactionBytesRead    int64
+	compactionBytesWritten int64
+
+	numWriteSlowdown int64
+	numWriteStop     int64
+	writeStallNanos  int64
+}
+
+// countWrite counts the mutations applied.
+func (cs *collectionStats) countWrite(es []entry) {
+
+	var nBytes int64 = 0
+
+	for i := 0; i < len(es); i++ {
+		switch es[i].meta.opType {
+		case opPut:
+			atomic.AddInt64(&cs.numPut, 1)
+		case opDel:
+			atomic.AddInt64(&cs.numDel, 1)
+		case opRangeDel:
+			atomic.AddInt64(&cs.numRangeDel, 1)
+		case opDelDeleteKeyRange:
+			atomic.AddInt64(&cs.numDelByDeleteKeyRange, 1)
+		}
+		nBytes += int64(len(es[i].key) + len(es[i].value) + len(es[i].deleteKey))
+	}
+
+	atomic.AddInt64(&cs.bytesWritten, nBytes)
+}
+
+// countFlush counts a flush which writes nBytes since start.
+func (cs *collectionStats) countFlush(start time.Time, nBytes int64) {
+	atomic.AddInt64(&cs.numFlush, 1)
+	atomic.AddInt64(&cs.flushNanos, int64(time.Since(start)))
+	atomic.AddInt64(&cs.flushBytes, nBytes)
+}
+
+// countCompaction counts a compaction which reads and writes the files since start.
+func (cs *collectionStats) countCompaction(task compactTask, start time.Time, inputs, outputs []*sstFile) {
+	atomic.AddInt64(&cs.numCompaction, 1)
+	if task.compactType == enumCompactTypeDD {
+		atomic.AddInt64(&cs.numDDCompaction, 1)
+	}
+	atomic.AddInt64(&cs.compactionNanos, int64(time.Since(start)))
+	atomic.AddInt64(&cs.compactionBytesRead, filesSize(inputs))
+	atomic.AddInt64(&cs.compactionBytesWritten, filesSize(outputs))
+}
+
+func filesSize(files []*sstFile) int64 {
+	var sum int64 = 0
+	for _, f := range files {
+		sum += f.Size
+	}
+	return sum
+}
+
+// Stats returns stats for this collection.
+func (lsm *collection) Stats() (*CollectionStats, error) {
+
+	if err := lsm.enter(); err != nil {
+		return nil, err
+	}
+	defer lsm.leave()
+
+	cs := &CollectionStats{}
+
+	cs.NumPut = atomic.LoadInt64(&lsm.stats.numPut)
+	cs.NumGet = atomic.LoadInt64(&lsm.stats.numGet)
+	cs.NumDel = atomic.LoadInt64(&lsm.stats.numDel)
+	cs.NumRangeDel = atomic.LoadInt64(&lsm.stats.numRangeDel)
+	cs.NumDelByDeleteKeyRange = atomic.LoadInt64(&lsm.stats.numDelByDeleteKeyRange)
+	cs.BytesWritten = atomic.LoadInt64(&lsm.stats.bytesWritten)
+
+	cs.NumFlush = atomic.LoadInt64(&lsm.stats.numFlush)
+	cs.FlushDuration = time.Duration(atomic.LoadInt64(&lsm.stats.flushNanos))
+	cs.FlushBytes = atomic.LoadInt64(&lsm.stats.flushBytes)
+
+	cs.NumCompaction = atomic.LoadInt64(&lsm.stats.numCompaction)
+	cs.NumDeleteDrivenCompaction = atomic.LoadInt64(&lsm.stats.numDDCompaction)
+	cs.CompactionDuration = time.Duration(atomic.LoadInt64(&lsm.stats.compactionNanos))
+	cs.CompactionBytesRead = atomic.LoadInt64(&lsm.stats.compactionBytesRead)
+	cs.CompactionBytesWritten = atomic.LoadInt64(&lsm.stats.compactionBytesWritten)
+
+	cs.NumWriteSlowdown = atomic.LoadInt64(&lsm.stats.numWriteSlowdown)
+	cs.NumWriteStop = atomic.LoadInt64(&lsm.stats.numWriteStop)
+	cs.WriteStallDuration = time.Duration(atomic.LoadInt64(&lsm.stats.writeStallNanos))
+	if stall, reason := lsm.writeStallCondition(); stall == writeStallSlowdown {
+		cs.WriteStallReason = "slowdown: " + reason
+	} else if stall == writeStallStop {
+		cs.WriteStallReason = "stop: " + reason
+	}
+	cs.PendingCompactionBytes = atomic.LoadInt64(&lsm.pendingCompactionBytes)
+
+	if lsm.cache != nil {
+		cs.BlockCacheHit = atomic.LoadInt64(&lsm.cache.hits)
+		cs.BlockCacheMiss = atomic.LoadInt64(&lsm.cache.misses)
+		cs.BlockCacheUsage = lsm.cache.usage()
+		cs.BlockCacheCapacity = lsm.options.BlockCacheSize
+	}
+
+	// in-memory
+	lsm.curMemTable.Lock()
+	cs.MemTableSize = lsm.curMemTable.nBytes
+	lsm.curMemTable.Unlock()
+	cs.NumImmutableMemTable = lsm.immutableQ.size()
+
+	// persisted levels
+	now := uint32(lsm.now().Unix())
+
+	lsm.RLock()
+	for _, lv := range lsm.levels {
+		ls := LevelStats{TTL: time.Duration(atomic.LoadInt64(&lv.ttl))}
+
+		lv.Lock()
+		ls.NumFile = len(lv.Files)
+		ls.SizeLimit = lv.SizeLimit
+		var oldest uint32 = 0
+		for _, f := range lv.Files {
+			ls.Size += f.Size
+			ls.NumEntry += f.NumEntry
+			ls.NumDelete += f.NumDelete
+			ls.NumRangeDel += len(f.RangeDels)
+			if olderTomb(f.AgeOldestTomb, oldest) {
+				oldest = f.AgeOldestTomb
+			}
+		}
+		lv.Unlock()
+
+		if oldest != 0 && oldest < now {
+			ls.AgeOldestTomb = time.Duration(now-oldest) * time.Second
+		}
+
+		cs.Levels = append(cs.Levels, ls)
+	}
+	lsm.RUnlock()
+
+	// amplifications
+	if cs.BytesWritten > 0 {
+		cs.WriteAmplification = float64(cs.FlushBytes+cs.CompactionBytesWritten) / float64(cs.BytesWritten)
+	}
+	if cs.NumGet > 0 {
+		cs.ReadAmplification = float64(atomic.LoadInt64(&lsm.stats.pagesRead)) / float64(cs.NumGet)
+	}
+	var total int64 = 0
+	for _, ls := range cs.Levels {
+		total += ls.Size
+	}
+	for i := len(cs.Levels) - 1; i >= 0; i-- {
+		if cs.Levels[i].Size > 0 {
+			cs.SpaceAmplification = float64(total) / float64(cs.Levels[i].Size)
+			break
+		}
+	}
+
+	return cs, nil
+}
@@ -0,0 +1,115 @@
+package lethe
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+
+	var clockLock sync.Mutex
+	now := time.Now()
+
+	options := DefaultCollectionOptions
+	options.MemTableSizeLimit = 16 << 10 // 16KB
+	options.LevelSizeRatio = 4
+	options.NumInitialLevel = 4
+	options.clock = func() time.Time {
+		clockLock.Lock()
+		defer clockLock.Unlock()
+		return now
+	}
+
+	lsm, err := newCollection(&options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+
+	// tombstones are interleaved with puts, so that they are persisted
+	for i := 0; i < 3000; i++ {
+		key := []byte(fmt.Sprintf("key-%05d", i))
+		if err := lsm.Put(key, key, key, nil); err != nil {
+			t.Fatal(err)
+		}
+		if i%10 == 0 {
+			if err := lsm.Del(key, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := lsm.RangeDel([]byte("key-00100"), []byte("key-00199"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsm.DelByDeleteKeyRange([]byte("key-00200"), []byte("key-00299"), nil); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 500; i++ {
+		lsm.Get([]byte(fmt.Sprintf("key-%05d", i*6)), nil)
+	}
+	testWaitCompacted(t, lsm)
+
+	clockLock.Lock()
+	now = now.Add(time.Hour)
+	clockLock.Unlock()
+
+	cs, err := lsm.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Printf("%+v\n", *cs)
+
+	if cs.NumPut != 3000 || cs.NumDel != 300 || cs.NumRangeDel != 1 || cs.NumDelByDeleteKeyRange != 1 || cs.NumGet != 500 {
+		t.Fatal("wrong numbers of operations")
+	}
+	if cs.BytesWritten < 3000*3*9 {
+		t.Fatal(cs.BytesWritten)
+	}
+	if cs.NumFlush == 0 || cs.FlushBytes == 0 || cs.FlushDuration == 0 {
+		t.Fatal("flushes are not counted")
+	}
+	if cs.NumCompaction == 0 || cs.CompactionBytesRead == 0 || cs.CompactionBytesWritten == 0 || cs.CompactionDuration == 0 {
+		t.Fatal("compactions are not counted")
+	}
+	if cs.WriteAmplification <= 1 || cs.ReadAmplification <= 0 || cs.SpaceAmplification < 1 {
+		t.Fatal("wrong amplifications")
+	}
+
+	numFiles := testNumFiles(lsm)
+	numFile, numEntry, numDelete := 0, 0, 0
+	var oldest time.Duration
+	for i, ls := range cs.Levels {
+		if ls.NumFile != numFiles[i] || ls.Size != lsm.levels[i].size() {
+			t.Fatalf("wrong stats of level-%d", i+1)
+		}
+		if ls.TTL <= 0 {
+			t.Fatalf("no TTL of level-%d", i+1)
+		}
+		numFile += ls.NumFile
+		numEntry += ls.NumEntry
+		numDelete += ls.NumDelete
+		if ls.AgeOldestTomb > oldest {
+			oldest = ls.AgeOldestTomb
+		}
+	}
+	if numFile == 0 || numEntry == 0 || numDelete == 0 {
+		t.Fatal("levels are empty")
+	}
+	if oldest < time.Hour {
+		t.Fatalf("the oldest tombstone is %v old, expected at least an hour", oldest)
+	}
+
+	// tombstones expire against TTLs of levels
+	clockLock.Lock()
+	now = now.Add(options.DeletePersistThreshold)
+	clockLock.Unlock()
+
+	testWaitTTL(t, lsm)
+
+	cs, _ = lsm.Stats()
+	if cs.NumDeleteDrivenCompaction == 0 {
+		t.Fatal("delete-driven compactions are not counted")
+	}
+}
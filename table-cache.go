@@ -0,0 +1,196 @@
+package lethe
+
+import (
+	"container/list"
+	"sync"
+)
+
+// The table cache bounds the number of SST-files kept open on disk.
+//
+// A persisted SST-file is read through a tableSSTFileDesc, which opens the file by name on demand,
+// and the least recently used descriptors are closed beyond MaxOpenFiles.
+// The metadata of SST-file, i.e. the index, filters and properties, is parsed once when the file is
+// written or opened and kept with the sstFile, so a file reopened by the table cache is not parsed again.
+//
+// A descriptor evicted while being read is closed once the reads finish,
+// so the number of open files may exceed MaxOpenFiles by the concurrent reads.
+
+// tableHandle is an open SST-file in the table cache.
+type tableHandle struct {
+	name string
+	fd   sstFileDesc
+
+	// reads on fd
+	refs int
+	// evicted from the cache, fd is closed once refs drop to zero
+	evicted bool
+}
+
+type tableCache struct {
+	sync.Mutex
+
+	dirPath string
+
+	// the maximum number of open files, unlimited if not positive
+	capacity int
+
+	// the most recently used handle is at the front
+	lru     *list.List
+	handles map[string]*list.Element
+
+	// no file is opened after the collection is closed
+	closed bool
+}
+
+func newTableCache(dirPath string, capacity int) *tableCache {
+	return &tableCache{
+		dirPath:  dirPath,
+		capacity: capacity,
+		lru:      list.New(),
+		handles:  map[string]*list.Element{},
+	}
+}
+
+// acquire returns the handle of SST-file name, which is opened if it is not in the cache.
+// The handle must be released after reading.
+func (c *tableCache) acquire(name string) (*tableHandle, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if elem, ok := c.handles[name]; ok {
+		c.lru.MoveToFront(elem)
+		h := elem.Value.(*tableHandle)
+		h.refs++
+		return h, nil
+	}
+
+	if c.closed {
+		return nil, ErrClosed
+	}
+
+	fd, err := openDiskSSTFileDesc(c.dirPath, name)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &tableHandle{name: name, fd: fd, refs: 1}
+	c.handles[name] = c.lru.PushFront(h)
+
+	for c.capacity > 0 && c.lru.Len() > c.capacity {
+		c.removeLocked(c.lru.Back())
+	}
+
+	return h, nil
+}
+
+// release finishes a read on handle h.
+func (c *tableCache) release(h *tableHandle) {
+	c.Lock()
+	defer c.Unlock()
+
+	h.refs--
+	if h.refs == 0 && h.evicted {
+		h.fd.Close()
+	}
+}
+
+// evict closes SST-file name if it is open, e.g. before it is removed.
+func (c *tableCache) evict(name string) error {
+	c.Lock()
+	defer c.Unlock()
+
+	elem, ok := c.handles[name]
+	if !ok {
+		return nil
+	}
+
+	return c.removeLocked(elem)
+}
+
+// removeLocked removes the handle of elem from the cache, and closes it if no read is on it.
+func (c *tableCache) removeLocked(elem *list.Element) error {
+	h := c.lru.Remove(elem).(*tableHandle)
+	delete(c.handles, h.name)
+
+	h.evicted = true
+	if h.refs > 0 {
+		return nil
+	}
+	return h.fd.Close()
+}
+
+// close closes all the open SST-files, and rejects later reads.
+func (c *tableCache) close() error {
+	c.Lock()
+	defer c.Unlock()
+
+	c.closed = true
+
+	var firstErr error
+	for c.lru.Len() > 0 {
+		if err := c.removeLocked(c.lru.Back()); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// numOpen returns the number of open SST-files in the cache.
+func (c *tableCache) numOpen() int {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.lru.Len()
+}
+
+// -----------------------------------------------------------------------------
+// tableSSTFileDesc
+// -----------------------------------------------------------------------------
+
+// tableSSTFileDesc is a read-only SST-file on disk opened on demand through the table cache.
+type tableSSTFileDesc struct {
+	name string
+	size int64
+
+	tables *tableCache
+}
+
+// openTableSSTFileDesc returns the descriptor of SST-file name of size bytes, without opening it.
+func (c *tableCache) openTableSSTFileDesc(name string, size int64) sstFileDesc {
+	return &tableSSTFileDesc{name: name, size: size, tables: c}
+}
+
+func (fd *tableSSTFileDesc) Name() string {
+	return fd.name
+}
+
+// ReadAt is an io.ReaderAt interface.
+func (fd *tableSSTFileDesc) ReadAt(p []byte, off int64) (n int, err error) {
+	h, err := fd.tables.acquire(fd.name)
+	if err != nil {
+		return 0, err
+	}
+	defer fd.tables.release(h)
+
+	return h.fd.ReadAt(p, off)
+}
+
+// Write is an io.Writer interface, which always fails on a read-only SST-file.
+func (fd *tableSSTFileDesc) Write(p []byte) (n int, err error) {
+	return 0, errReadOnlySSTFileDesc
+}
+
+// Close is an io.Closer interface, which closes the file if it is open in the table cache.
+func (fd *tableSSTFileDesc) Close() error {
+	return fd.tables.evict(fd.name)
+}
+
+// Sync does nothing because the SST-file is read-only.
+func (fd *tableSSTFileDesc) Sync() error {
+	return nil
+}
+
+func (fd *tableSSTFileDesc) Size() (int64, error) {
+	return fd.size, nil
+}
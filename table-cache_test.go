@@ -0,0 +1,72 @@
+package lethe
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestTableCache(t *testing.T) {
+
+	options := DefaultCollectionOptions
+	options.DirPath = t.TempDir()
+	options.CreateIfMissing = true
+	options.MemTableSizeLimit = 16 << 10 // 16KB
+	options.BlockCacheSize = 0
+	options.MaxOpenFiles = 2
+
+	lsm, err := newCollection(&options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 5000; i++ {
+		key := []byte(fmt.Sprintf("key-%05d", i))
+		if err := lsm.Put(key, key, key, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	testWaitPersisted(t, lsm)
+	testWaitCompacted(t, lsm)
+
+	check := func() {
+		for i := 0; i < 5000; i += 7 {
+			key := []byte(fmt.Sprintf("key-%05d", i))
+			value, err := lsm.Get(key, nil)
+			if err != nil || !bytes.Equal(value, key) {
+				t.Fatalf("key [%s] got [%s] %v", string(key), string(value), err)
+			}
+		}
+		if n := lsm.tables.numOpen(); n > options.MaxOpenFiles {
+			t.Fatalf("%d SST-files are open, at most %d", n, options.MaxOpenFiles)
+		}
+	}
+
+	numFile := 0
+	for _, n := range testNumFiles(lsm) {
+		numFile += n
+	}
+	fmt.Println("files on levels", testNumFiles(lsm))
+	if numFile <= options.MaxOpenFiles {
+		t.Fatalf("%d SST-files, expected more than %d", numFile, options.MaxOpenFiles)
+	}
+
+	check()
+
+	if err := lsm.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := lsm.tables.numOpen(); n != 0 {
+		t.Fatalf("%d SST-files are open after Close", n)
+	}
+
+	// the SST-files are opened on demand after recovery
+	options.CreateIfMissing = false
+	lsm, err = newCollection(&options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+
+	check()
+}
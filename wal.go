@@ -0,0 +1,391 @@
+package lethe
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// writeAheadLog records every mutation before it is applied to the memTable.
+//
+// The log is split into segments under the directory of the collection.
+// The live segments back the current memTable. When the current memTable turns immutable,
+// the log rotates to a new segment and the old segments are handed over to the immutable memTable.
+// They are retired once the immutable memTable has been persisted as a SST-file.
+//
+// A record appended is in the page cache of OS, so it survives a crash of the process but not of the machine.
+// It is durable once the segment is synced, either by a write with Sync or by the sync daemon periodically,
+// and a segment is synced before it is closed.
+type writeAheadLog struct {
+	sync.Mutex
+
+	dirPath string
+
+	// wraps the file of each segment, nil for *os.File
+	wrap func(f *os.File) logFile
+
+	// the segment being appended
+	curNum  uint64
+	curFile logFile
+	// records are appended to the current segment since it is synced
+	dirty bool
+
+	// the segments backing the current memTable, i.e. the replayed segments and the current segment
+	liveNums []uint64
+}
+
+const (
+	logFileSuffix = ".log"
+
+	// logMagic is the payload of the header record of segment, followed by logFormatVersion.
+	logMagic = "LETHEWAL"
+
+	logFormatVersion byte = 1
+)
+
+func logFileName(num uint64) string {
+	return fmt.Sprintf("%06d%s", num, logFileSuffix)
+}
+
+// listFileNums returns the sorted numbers of files named like `%06d<suffix>` under dirPath.
+func listFileNums(dirPath string, suffix string) ([]uint64, error) {
+
+	infos, err := ioutil.ReadDir(dirPath)
+	if err != nil {
+		return nil, err
+	}
+
+	nums := []uint64{}
+
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || !strings.HasSuffix(name, suffix) {
+			continue
+		}
+
+		num, err := strconv.ParseUint(strings.TrimSuffix(name, suffix), 10, 64)
+		if err != nil {
+			continue // not a file of collection
+		}
+
+		nums = append(nums, num)
+	}
+
+	sort.Slice(nums, func(i, j int) bool { return nums[i] < nums[j] })
+
+	return nums, nil
+}
+
+// -----------------------------------------------------------------------------
+
+// logFile is the file of a log segment, i.e. *os.File, which is wrapped in tests to simulate crashes.
+type logFile interface {
+	io.Writer
+
+	// Sync commits the content written to disk.
+	Sync() error
+
+	Close() error
+}
+
+func (w *writeAheadLog) createLogSegment(num uint64) (logFile, error) {
+
+	f, err := os.OpenFile(path.Join(w.dirPath, logFileName(num)), os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	var lf logFile = f
+	if w.wrap != nil {
+		lf = w.wrap(f)
+	}
+
+	// the header is synced along with the first records
+	if _, err := lf.Write(encodeRecord(append([]byte(logMagic), logFormatVersion))); err != nil {
+		lf.Close()
+		return nil, err
+	}
+
+	// make the new segment durable before any record synced into it is acknowledged
+	if err := syncDir(w.dirPath); err != nil {
+		lf.Close()
+		return nil, err
+	}
+
+	return lf, nil
+}
+
+// openWriteAheadLog starts a new log segment numbered num.
+// The replayed segments keep backing the current memTable until it is persisted.
+func openWriteAheadLog(dirPath string, num uint64, replayed []uint64, wrap func(f *os.File) logFile) (*writeAheadLog, error) {
+
+	w := &writeAheadLog{}
+
+	w.dirPath = dirPath
+	w.wrap = wrap
+
+	f, err := w.createLogSegment(num)
+	if err != nil {
+		return nil, err
+	}
+
+	w.curNum = num
+	w.curFile = f
+	w.liveNums = append(append([]uint64{}, replayed...), num)
+
+	return w, nil
+}
+
+// append writes entries as one record to the current segment,
+// and syncs the segment if sync is true, so that the record is durable before append returns.
+// The entries of one record are replayed all or none.
+// thread-safe
+func (w *writeAheadLog) append(es []entry, sync bool) error {
+
+	payload, err := encodeEntries(es)
+	if err != nil {
+		return err
+	}
+
+	buf := encodeRecord(payload)
+
+	w.Lock()
+	defer w.Unlock()
+
+	if _, err := w.curFile.Write(buf); err != nil {
+		return err
+	}
+	w.dirty = true
+
+	if sync {
+		return w.syncLocked()
+	}
+
+	return nil
+}
+
+// sync commits the records appended to the current segment to disk.
+// thread-safe
+func (w *writeAheadLog) sync() error {
+	w.Lock()
+	defer w.Unlock()
+
+	return w.syncLocked()
+}
+
+// syncLocked must be called with the lock held.
+func (w *writeAheadLog) syncLocked() error {
+
+	if !w.dirty {
+		return nil
+	}
+
+	if err := w.curFile.Sync(); err != nil {
+		return err
+	}
+	w.dirty = false
+
+	return nil
+}
+
+// rotate closes the current segment and starts a new segment numbered num.
+// It returns the segments which backed the current memTable.
+// thread-safe
+func (w *writeAheadLog) rotate(num uint64) (retired []uint64, err error) {
+
+	f, err := w.createLogSegment(num)
+	if err != nil {
+		return nil, err
+	}
+
+	w.Lock()
+	defer w.Unlock()
+
+	// the retired segments back the immutable memTable until it is persisted
+	if err := w.syncLocked(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := w.curFile.Close(); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	retired = w.liveNums
+
+	w.curNum = num
+	w.curFile = f
+	w.dirty = false
+	w.liveNums = []uint64{num}
+
+	return retired, nil
+}
+
+// retire removes the segments whose mutations have been persisted.
+func (w *writeAheadLog) retire(nums []uint64) error {
+
+	for _, num := range nums {
+		if err := os.Remove(path.Join(w.dirPath, logFileName(num))); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// close syncs and closes the current segment.
+// thread-safe
+func (w *writeAheadLog) close() error {
+	w.Lock()
+	defer w.Unlock()
+
+	if err := w.syncLocked(); err != nil {
+		w.curFile.Close()
+		return err
+	}
+
+	return w.curFile.Close()
+}
+
+// walSyncDaemon syncs the write-ahead log every WALSyncInterval,
+// so the writes without Sync in an interval are committed to disk by one sync.
+func (lsm *collection) walSyncDaemon(ctx context.Context) {
+
+	ticker := time.NewTicker(lsm.options.WALSyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			{
+				if err := lsm.wal.sync(); err != nil {
+					log.Printf("[wal] sync: %v\n", err)
+				}
+			}
+		case <-ctx.Done():
+			{
+				log.Println("stop [WAL sync daemon]")
+				return
+			}
+		}
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+// replayLogSegment applies the entries of every complete record in a segment.
+// A torn record at the tail, which is left by a crash during append, ends the segment.
+func replayLogSegment(dirPath string, num uint64, apply func(e *entry) error) error {
+
+	f, err := os.Open(path.Join(dirPath, logFileName(num)))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+
+	for first := true; ; first = false {
+		payload, err := readRecord(r)
+
+		if err == io.EOF {
+			return nil
+		}
+		if err == errTornRecord {
+			log.Printf("[wal] torn record at the tail of log segment [%s]\n", logFileName(num))
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		// the first record is the header
+		if first {
+			if len(payload) != len(logMagic)+1 || string(payload[:len(logMagic)]) != logMagic {
+				return fmt.Errorf("log segment [%s] without header", logFileName(num))
+			}
+			if payload[len(logMagic)] != logFormatVersion {
+				return fmt.Errorf("log segment [%s] of unknown format version %d", logFileName(num), payload[len(logMagic)])
+			}
+			continue
+		}
+
+		es, err := decodeEntries(payload)
+		if err != nil {
+			return err
+		}
+
+		for i := 0; i < len(es); i++ {
+			if err := apply(&es[i]); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// recoverWAL replays every log segment left under DirPath into the current memTable
+// and then starts a new segment.
+func (lsm *collection) recoverWAL() error {
+
+	dirPath := lsm.options.DirPath
+
+	nums, err := listFileNums(dirPath, logFileSuffix)
+	if err != nil {
+		return err
+	}
+
+	// file numbers are never reused
+	for _, num := range nums {
+		if num >= lsm.nextFileNum {
+			lsm.nextFileNum = num + 1
+		}
+	}
+
+	var maxSeqNum uint64 = 0
+
+	for _, num := range nums {
+
+		err := replayLogSegment(dirPath, num, func(e *entry) error {
+			if maxSeqNum < e.meta.seqNum {
+				maxSeqNum = e.meta.seqNum
+			}
+
+			// The files may not be rewritten before crash.
+			// All the entries in files are older than the log, so dropping them again is safe.
+			if e.meta.opType == opDelDeleteKeyRange {
+				lsm.curMemTable.dropDeleteKeyRange(e.key, e.deleteKey, lsm.options.DeleteKeyLess)
+				return lsm.dropDeleteKeyRangeInFiles(lsm.levelFiles(), []deleteKeyRange{{low: e.key, high: e.deleteKey}})
+			}
+
+			return lsm.curMemTable.Put(e.key, e.value, e.deleteKey, e.meta)
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(nums) > 0 {
+		log.Printf("[wal] replay %d log segments, %d entries\n", len(nums), lsm.curMemTable.Num())
+	}
+
+	// new sequence numbers must be greater than the replayed ones
+	lsm.advanceSeqNum(maxSeqNum)
+
+	lsm.wal, err = openWriteAheadLog(dirPath, lsm.newFileNum(), nums, lsm.options.wrapLogFile)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,308 @@
+package lethe
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReadRecordTorn(t *testing.T) {
+
+	var b bytes.Buffer
+
+	b.Write(encodeRecord([]byte("record-1")))
+	b.Write(encodeRecord([]byte("record-2")))
+
+	// a crash during append leaves half a record
+	torn := encodeRecord([]byte("record-3"))
+	b.Write(torn[:len(torn)/2])
+
+	r := bytes.NewReader(b.Bytes())
+
+	for _, expected := range []string{"record-1", "record-2"} {
+		payload, err := readRecord(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(payload) != expected {
+			t.Fatalf("got %s, expected %s", string(payload), expected)
+		}
+	}
+
+	if _, err := readRecord(r); err != errTornRecord {
+		t.Fatalf("expected %v, got %v", errTornRecord, err)
+	}
+}
+
+func TestWALReplay(t *testing.T) {
+
+	dirPath := t.TempDir()
+
+	options := DefaultCollectionOptions
+	options.DirPath = dirPath
+	options.CreateIfMissing = true
+
+	lsm, err := newCollection(&options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	num := 1000
+	for i := 0; i < num; i++ {
+		key := []byte(fmt.Sprintf("key-%d", i))
+		if err := lsm.Put(key, key, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < num; i += 2 {
+		key := []byte(fmt.Sprintf("key-%d", i))
+		if err := lsm.Del(key, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := lsm.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// reopen on the same directory
+	lsm, err = newCollection(&options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+
+	for i := 0; i < num; i++ {
+		key := []byte(fmt.Sprintf("key-%d", i))
+		value, err := lsm.Get(key, nil)
+
+		if i%2 == 0 {
+			if err != ErrKeyNotFound {
+				t.Fatalf("key [%s] expected deleted, got %v", string(key), err)
+			}
+			continue
+		}
+
+		if err != nil || !bytes.Equal(value, key) {
+			t.Fatalf("key [%s] got [%s] %v", string(key), string(value), err)
+		}
+	}
+
+	// the replayed segment is kept until the memTable is persisted
+	if _, err := os.Stat(path.Join(dirPath, logFileName(0))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWALReplayWithoutHeader(t *testing.T) {
+
+	dirPath := t.TempDir()
+
+	// a segment whose first record is not the header
+	buf, err := encodeEntries(testRandEntries(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(dirPath, logFileName(1)), encodeRecord(buf), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	err = replayLogSegment(dirPath, 1, func(e *entry) error { return nil })
+	fmt.Println(err)
+	if err == nil {
+		t.Fatal("log segment without header is replayed")
+	}
+}
+
+// crashLogFile keeps the content written in memory until it is synced, as the page cache of OS does,
+// so the content not synced is lost by a simulated crash of the file layer.
+type crashLogFile struct {
+	sync.Mutex
+
+	f       *os.File
+	pending bytes.Buffer
+	crashed *bool
+}
+
+func (cf *crashLogFile) Write(p []byte) (int, error) {
+	cf.Lock()
+	defer cf.Unlock()
+
+	if *cf.crashed {
+		return len(p), nil
+	}
+	return cf.pending.Write(p)
+}
+
+func (cf *crashLogFile) Sync() error {
+	cf.Lock()
+	defer cf.Unlock()
+
+	if *cf.crashed {
+		return nil
+	}
+	if _, err := cf.f.Write(cf.pending.Bytes()); err != nil {
+		return err
+	}
+	cf.pending.Reset()
+	return cf.f.Sync()
+}
+
+func (cf *crashLogFile) Close() error {
+	cf.Lock()
+	defer cf.Unlock()
+
+	// the content not synced is written back eventually unless crashed
+	if !*cf.crashed {
+		cf.f.Write(cf.pending.Bytes())
+	}
+	return cf.f.Close()
+}
+
+// testCrashCollection opens a collection whose log segments lose the content not synced once crash is called.
+func testCrashCollection(t *testing.T, options *CollectionOptions) (lsm *collection, crash func()) {
+
+	var (
+		lock    sync.Mutex
+		crashed bool
+		files   []*crashLogFile
+	)
+
+	options.wrapLogFile = func(f *os.File) logFile {
+		lock.Lock()
+		defer lock.Unlock()
+
+		cf := &crashLogFile{f: f, crashed: &crashed}
+		files = append(files, cf)
+		return cf
+	}
+
+	lsm, err := newCollection(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	crash = func() {
+		lock.Lock()
+		for _, cf := range files {
+			cf.Lock()
+		}
+		crashed = true
+		for _, cf := range files {
+			cf.Unlock()
+		}
+		lock.Unlock()
+
+		// nothing is written by Close after crash
+		lsm.Close()
+		options.wrapLogFile = nil
+	}
+
+	return lsm, crash
+}
+
+func TestWALSync(t *testing.T) {
+
+	options := DefaultCollectionOptions
+	options.DirPath = t.TempDir()
+	options.CreateIfMissing = true
+
+	lsm, crash := testCrashCollection(t, &options)
+
+	put := func(prefix string, n int, wo *WriteOptions) {
+		for i := 0; i < n; i++ {
+			key := []byte(fmt.Sprintf("%s-%d", prefix, i))
+			if err := lsm.Put(key, key, nil, wo); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// a write with Sync commits the writes before it as well
+	put("before", 100, nil)
+	put("nodurability", 100, &WriteOptions{NoDurability: true})
+	put("sync", 100, &WriteOptions{Sync: true})
+	put("after", 100, nil)
+
+	b, _ := lsm.WriteBatch()
+	b.Put([]byte("batch-0"), []byte("batch-0"), nil)
+	b.Put([]byte("batch-1"), []byte("batch-1"), nil)
+	if err := lsm.ExecuteWriteBatch(b, &WriteOptions{Sync: true}); err != nil {
+		t.Fatal(err)
+	}
+	put("lost", 100, nil)
+
+	crash()
+
+	options.CreateIfMissing = false
+	lsm, err := newCollection(&options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+
+	check := func(prefix string, n int, survived bool) {
+		for i := 0; i < n; i++ {
+			key := []byte(fmt.Sprintf("%s-%d", prefix, i))
+			value, err := lsm.Get(key, nil)
+
+			if !survived {
+				if err != ErrKeyNotFound {
+					t.Fatalf("key [%s] is not synced but survives a crash", string(key))
+				}
+				continue
+			}
+			if err != nil || !bytes.Equal(value, key) {
+				t.Fatalf("key [%s] got [%s] %v", string(key), string(value), err)
+			}
+		}
+	}
+
+	check("before", 100, true)
+	check("nodurability", 100, false)
+	check("sync", 100, true)
+	check("after", 100, true)
+	check("batch", 2, true)
+	check("lost", 100, false)
+}
+
+func TestWALSyncInterval(t *testing.T) {
+
+	options := DefaultCollectionOptions
+	options.DirPath = t.TempDir()
+	options.CreateIfMissing = true
+	options.WALSyncInterval = 10 * time.Millisecond
+
+	lsm, crash := testCrashCollection(t, &options)
+
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key-%d", i))
+		if err := lsm.Put(key, key, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// synced by the daemon
+	time.Sleep(100 * time.Millisecond)
+
+	crash()
+
+	options.CreateIfMissing = false
+	lsm, err := newCollection(&options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key-%d", i))
+		if value, err := lsm.Get(key, nil); err != nil || !bytes.Equal(value, key) {
+			t.Fatalf("key [%s] got [%s] %v", string(key), string(value), err)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package lethe
+
+// A writeBatch collects mutations which are applied to the collection atomically
+// with one contiguous range of sequence numbers, see collection.apply.
+//
+// Every mutation is validated when it is added, so that a batch is either applied fully
+// or rejected without partial effects.
+// The secondary range deletes of a batch drop the entries from memTables atomically with the batch,
+// and from files after the batch is applied, as DelByDeleteKeyRange does,
+// while readers are kept out until both are done, so that no reader sees half of the batch.
+
+// writeBatch implements the Batch interface.
+type writeBatch struct {
+	lsm *collection
+
+	es []entry
+
+	closed bool
+}
+
+// WriteBatch returns a new WriteBatch instance.
+func (lsm *collection) WriteBatch() (Batch, error) {
+	if err := lsm.enter(); err != nil {
+		return nil, err
+	}
+	defer lsm.leave()
+
+	return &writeBatch{lsm: lsm}, nil
+}
+
+// validateEntry checks the lengths of keys and value of a mutation.
+func validateEntry(e *entry) error {
+	switch e.meta.opType {
+	case opPut:
+		if len(e.key) > maxSortKeyBytesLen {
+			return ErrSortKeyTooLarge
+		}
+		if len(e.deleteKey) > maxDeleteKeyBytesLen {
+			return ErrDeleteKeyTooLarge
+		}
+		if len(e.value) > maxValueBytesLen {
+			return ErrValueTooLarge
+		}
+	case opDel:
+		if len(e.key) > maxSortKeyBytesLen {
+			return ErrSortKeyTooLarge
+		}
+	case opRangeDel:
+		if len(e.key) > maxSortKeyBytesLen || len(e.value) > maxSortKeyBytesLen {
+			return ErrSortKeyTooLarge
+		}
+	case opDelDeleteKeyRange:
+		if len(e.key) > maxDeleteKeyBytesLen || len(e.deleteKey) > maxDeleteKeyBytesLen {
+			return ErrDeleteKeyTooLarge
+		}
+	default:
+		return ErrInvalidBatch
+	}
+	return nil
+}
+
+// add validates and copies a mutation into the batch.
+func (wb *writeBatch) add(e entry) error {
+	if wb.closed {
+		return ErrClosed
+	}
+	if err := validateEntry(&e); err != nil {
+		return err
+	}
+
+	e.key = copyBytes(e.key)
+	e.value = copyBytes(e.value)
+	e.deleteKey = copyBytes(e.deleteKey)
+
+	wb.es = append(wb.es, e)
+
+	return nil
+}
+
+// Put adds a Put of key-val entry with delete key to the batch.
+func (wb *writeBatch) Put(key, value, deleteKey []byte) error {
+	return wb.add(entry{key: key, value: value, deleteKey: deleteKey, meta: keyMeta{opType: opPut}})
+}
+
+// Del adds a Del of key to the batch.
+func (wb *writeBatch) Del(key []byte) error {
+	return wb.add(entry{key: key, meta: keyMeta{opType: opDel}})
+}
+
+// RangeDel adds a range delete of [lowKey, highKey] on sort key to the batch.
+func (wb *writeBatch) RangeDel(lowKey, highKey []byte) error {
+	e := entry{key: lowKey, value: highKey, meta: keyMeta{opType: opRangeDel}}
+	if err := validateEntry(&e); err != nil {
+		return err
+	}
+
+	// empty range
+	if wb.lsm.options.SortKeyLess(highKey, lowKey) {
+		return nil
+	}
+
+	return wb.add(e)
+}
+
+// DelByDeleteKeyRange adds a secondary range delete of [lowDKey, highDKey] on delete key to the batch.
+func (wb *writeBatch) DelByDeleteKeyRange(lowDKey, highDKey []byte) error {
+	e := entry{key: lowDKey, deleteKey: highDKey, meta: keyMeta{opType: opDelDeleteKeyRange}}
+	if err := validateEntry(&e); err != nil {
+		return err
+	}
+
+	// empty range
+	if wb.lsm.options.DeleteKeyLess(highDKey, lowDKey) {
+		return nil
+	}
+
+	return wb.add(e)
+}
+
+// Len returns the number of mutations in the batch.
+func (wb *writeBatch) Len() int {
+	return len(wb.es)
+}
+
+// Close releases the mutations of the batch.
+func (wb *writeBatch) Close() error {
+	wb.closed = true
+	wb.es = nil
+	return nil
+}
+
+// ExecuteWriteBatch atomically incorporates the provided Batch into the Collection.
+func (lsm *collection) ExecuteWriteBatch(b Batch, writeOptions *WriteOptions) error {
+
+	if err := lsm.enter(); err != nil {
+		return err
+	}
+	defer lsm.leave()
+
+	wb, ok := b.(*writeBatch)
+	if !ok || wb.lsm != lsm {
+		return ErrInvalidBatch
+	}
+	if wb.closed {
+		return ErrClosed
+	}
+
+	if len(wb.es) == 0 {
+		return nil
+	}
+
+	// sequence numbers are assigned to the copy, so the batch can be executed again
+	es := append([]entry{}, wb.es...)
+
+	if len(deleteKeyRangesOf(es)) > 0 {
+		return lsm.writeWithDeleteKeyRanges(es, writeOptions)
+	}
+
+	return lsm.write(es, writeOptions)
+}
@@ -0,0 +1,153 @@
+package lethe
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestWriteBatch(t *testing.T) {
+
+	options := DefaultCollectionOptions
+	options.DirPath = t.TempDir()
+	options.CreateIfMissing = true
+	options.MemTableSizeLimit = 16 << 10 // 16KB
+
+	lsm, err := newCollection(&options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("key-%05d", i))
+		if err := lsm.Put(key, key, []byte(fmt.Sprintf("dkey-%05d", i)), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	testWaitPersisted(t, lsm)
+
+	b, err := lsm.WriteBatch()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b.Put([]byte("key-00001"), []byte("batch"), []byte("dkey-00001"))
+	b.Del([]byte("key-00002"))
+	b.RangeDel([]byte("key-00100"), []byte("key-00199"))
+	b.DelByDeleteKeyRange([]byte("dkey-00500"), []byte("dkey-00599"))
+	// applied in order, so a later Put in the range survives
+	b.Put([]byte("key-00550"), []byte("batch"), []byte("dkey-00550"))
+
+	// invalid mutations are rejected and not added
+	if err := b.Put(make([]byte, maxSortKeyBytesLen+1), nil, nil); err != ErrSortKeyTooLarge {
+		t.Fatal(err)
+	}
+	if err := b.DelByDeleteKeyRange(make([]byte, maxDeleteKeyBytesLen+1), nil); err != ErrDeleteKeyTooLarge {
+		t.Fatal(err)
+	}
+	if b.Len() != 5 {
+		t.Fatal(b.Len())
+	}
+
+	seqNum := lsm.currentSeqNum()
+
+	if err := lsm.ExecuteWriteBatch(b, nil); err != nil {
+		t.Fatal(err)
+	}
+	b.Close()
+
+	// one contiguous range of sequence numbers
+	if n := lsm.currentSeqNum() - seqNum; n != 5 {
+		t.Fatalf("%d sequence numbers are assigned, expected 5", n)
+	}
+
+	check := func() {
+		for i := 0; i < 1000; i++ {
+			key := []byte(fmt.Sprintf("key-%05d", i))
+			value, err := lsm.Get(key, nil)
+
+			switch {
+			case i == 1 || i == 550:
+				if err != nil || string(value) != "batch" {
+					t.Fatalf("key [%s] got [%s] %v", string(key), string(value), err)
+				}
+			case i == 2 || (100 <= i && i < 200) || (500 <= i && i < 600):
+				if err != ErrKeyNotFound {
+					t.Fatalf("key [%s] expected deleted, got [%s] %v", string(key), string(value), err)
+				}
+			default:
+				if err != nil || !bytes.Equal(value, key) {
+					t.Fatalf("key [%s] got [%s] %v", string(key), string(value), err)
+				}
+			}
+		}
+	}
+
+	check()
+
+	if err := lsm.ExecuteWriteBatch(b, nil); err != ErrClosed {
+		t.Fatal(err)
+	}
+
+	lsm.Close()
+
+	// the batch is replayed from write-ahead log
+	options.CreateIfMissing = false
+	lsm, err = newCollection(&options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+
+	check()
+}
+
+func TestWriteBatchAtomic(t *testing.T) {
+
+	options := DefaultCollectionOptions
+	options.MemTableSizeLimit = 4 << 10 // 4KB
+
+	lsm, err := newCollection(&options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	// every batch sets both keys to the same value
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 2000; i++ {
+			b, _ := lsm.WriteBatch()
+			v := []byte(strconv.Itoa(i))
+			b.Put([]byte("a"), v, nil)
+			b.Put([]byte("b"), v, nil)
+			if err := lsm.ExecuteWriteBatch(b, nil); err != nil {
+				t.Error(err)
+				return
+			}
+			b.Close()
+		}
+	}()
+
+	for i := 0; i < 200; i++ {
+		snap, err := lsm.Snapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		a, errA := snap.Get([]byte("a"), nil)
+		b, errB := snap.Get([]byte("b"), nil)
+		if errA != errB || !bytes.Equal(a, b) {
+			t.Fatalf("partial batch is seen, a [%s] %v, b [%s] %v", string(a), errA, string(b), errB)
+		}
+
+		snap.Close()
+	}
+
+	wg.Wait()
+}
@@ -0,0 +1,136 @@
+package lethe
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// Writes are stalled when persistence or compaction falls behind them,
+// so that the memory of immutable memTables and the debt of compactions are bounded.
+// - a slowdown delays each write by writeSlowdownDelay
+// - a stop blocks writes until persistence or compaction makes progress
+
+type writeStall int
+
+const (
+	writeStallNone writeStall = iota
+	writeStallSlowdown
+	writeStallStop
+)
+
+// writeStallCondition returns how writes are stalled and the reason.
+func (lsm *collection) writeStallCondition() (writeStall, string) {
+
+	opts := lsm.options
+
+	numImmutable := lsm.immutableQ.size()
+	numLevel1File := int(atomic.LoadInt64(&lsm.numLevel1File))
+	pendingBytes := atomic.LoadInt64(&lsm.pendingCompactionBytes)
+
+	switch {
+	case opts.MaxImmutableMemTables > 0 && numImmutable >= opts.MaxImmutableMemTables:
+		return writeStallStop, fmt.Sprintf("%d immutable memTables wait to be persisted", numImmutable)
+
+	case opts.Level1StopWritesTrigger > 0 && numLevel1File >= opts.Level1StopWritesTrigger:
+		return writeStallStop, fmt.Sprintf("%d files on level-1", numLevel1File)
+
+	case opts.HardPendingCompactionBytesLimit > 0 && pendingBytes >= opts.HardPendingCompactionBytesLimit:
+		return writeStallStop, fmt.Sprintf("%s pending compaction bytes", beautifulNumByte(int(pendingBytes)))
+
+	case opts.Level1SlowdownWritesTrigger > 0 && numLevel1File >= opts.Level1SlowdownWritesTrigger:
+		return writeStallSlowdown, fmt.Sprintf("%d files on level-1", numLevel1File)
+
+	case opts.SoftPendingCompactionBytesLimit > 0 && pendingBytes >= opts.SoftPendingCompactionBytesLimit:
+		return writeStallSlowdown, fmt.Sprintf("%s pending compaction bytes", beautifulNumByte(int(pendingBytes)))
+	}
+
+	return writeStallNone, ""
+}
+
+// updateWriteStallCounters recounts the files on level-1 and the pending compaction bytes after files on levels change,
+// so that writes check the write stall condition without taking the lock of collection.
+// The pending compaction bytes estimate the number of bytes to be compacted until no level is saturated,
+// i.e. the sum of the bytes of levels beyond their capacities.
+// It is called with the lock of collection held, but no lock of level.
+func (lsm *collection) updateWriteStallCounters() {
+
+	var numLevel1File int64 = 0
+	var pendingBytes int64 = 0
+
+	for i, lv := range lsm.levels {
+		lv.Lock()
+		if i == 0 {
+			numLevel1File = int64(len(lv.Files))
+		}
+		var size int64 = 0
+		for _, f := range lv.Files {
+			size += f.Size
+		}
+		lv.Unlock()
+
+		if size > lv.SizeLimit {
+			pendingBytes += size - lv.SizeLimit
+		}
+	}
+
+	atomic.StoreInt64(&lsm.numLevel1File, numLevel1File)
+	atomic.StoreInt64(&lsm.pendingCompactionBytes, pendingBytes)
+}
+
+// stallWrite delays or blocks a write according to the write stall condition.
+// It is called before writeLock is taken, so that readers taking views are not blocked meanwhile.
+// A write stopped returns the background error once persistence fails, since the stall never ends,
+// or ErrClosed once the collection is closing, since Close waits for it.
+func (lsm *collection) stallWrite() error {
+
+	stall, reason := lsm.writeStallCondition()
+	if stall == writeStallNone {
+		return nil
+	}
+
+	var err error
+
+	start := time.Now()
+
+	if stall == writeStallSlowdown {
+		atomic.AddInt64(&lsm.stats.numWriteSlowdown, 1)
+		time.Sleep(lsm.options.writeSlowdownDelay)
+	} else {
+		atomic.AddInt64(&lsm.stats.numWriteStop, 1)
+		log.Printf("[stall] stop writes: %s\n", reason)
+
+		// the condition is checked with stallLock held, and progress is signaled with stallLock held,
+		// so no signal is missed between the check and Wait.
+		lsm.stallLock.Lock()
+		for {
+			if err = lsm.backgroundError(); err != nil {
+				break
+			}
+			if atomic.LoadInt32(&lsm.closing) == 1 {
+				err = ErrClosed
+				break
+			}
+			if stall, _ = lsm.writeStallCondition(); stall != writeStallStop {
+				break
+			}
+			lsm.stallCond.Wait()
+		}
+		lsm.stallLock.Unlock()
+
+		log.Printf("[stall] resume writes after %v\n", time.Since(start))
+	}
+
+	atomic.AddInt64(&lsm.stats.writeStallNanos, int64(time.Since(start)))
+
+	return err
+}
+
+// signalWriteStall wakes up the writes stopped, after persistence or compaction makes progress,
+// or the collection is closing.
+func (lsm *collection) signalWriteStall() {
+	lsm.stallLock.Lock()
+	lsm.stallCond.Broadcast()
+	lsm.stallLock.Unlock()
+}
@@ -0,0 +1,137 @@
+package lethe
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteStall(t *testing.T) {
+
+	options := DefaultCollectionOptions
+	options.MemTableSizeLimit = 4 << 10 // 4KB
+	options.Level1SlowdownWritesTrigger = 2
+	options.Level1StopWritesTrigger = 4
+
+	lsm, err := newCollection(&options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+
+	// compactions fall behind
+	lsm.compactLock.Lock()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 3000; i++ {
+			key := []byte(fmt.Sprintf("key-%05d", i))
+			if err := lsm.Put(key, key, nil, nil); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	stopped := false
+	for i := 0; i < 1000 && !stopped; i++ {
+		cs, err := lsm.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		stopped = strings.HasPrefix(cs.WriteStallReason, "stop")
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !stopped {
+		t.Fatal("writes are not stopped")
+	}
+
+	select {
+	case <-done:
+		t.Fatal("writes are not blocked")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	cs, _ := lsm.Stats()
+	fmt.Println("stall:", cs.WriteStallReason)
+	if n := cs.Levels[0].NumFile; n < options.Level1StopWritesTrigger {
+		t.Fatalf("%d files on level-1, expected at least %d", n, options.Level1StopWritesTrigger)
+	}
+
+	// writes are resumed once compactions make progress
+	lsm.compactLock.Unlock()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("writes are not resumed")
+	}
+
+	cs, _ = lsm.Stats()
+	if cs.NumWriteSlowdown == 0 || cs.NumWriteStop == 0 || cs.WriteStallDuration == 0 {
+		t.Fatal("write stalls are not counted")
+	}
+}
+
+func TestWriteStallClose(t *testing.T) {
+
+	options := DefaultCollectionOptions
+	options.MemTableSizeLimit = 4 << 10 // 4KB
+	options.Level1StopWritesTrigger = 2
+
+	lsm, err := newCollection(&options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// compactions make no progress
+	lsm.compactLock.Lock()
+
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < 3000; i++ {
+			key := []byte(fmt.Sprintf("key-%05d", i))
+			if err := lsm.Put(key, key, nil, nil); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	stopped := false
+	for i := 0; i < 1000 && !stopped; i++ {
+		stall, _ := lsm.writeStallCondition()
+		stopped = stall == writeStallStop
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !stopped {
+		t.Fatal("writes are not stopped")
+	}
+
+	closed := make(chan error, 1)
+	go func() { closed <- lsm.Close() }()
+
+	// the write stopped leaves before compactions make progress
+	select {
+	case err := <-done:
+		if err != ErrClosed {
+			t.Fatalf("write stopped returns %v, expected %v", err, ErrClosed)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("write stopped is not released by Close")
+	}
+
+	lsm.compactLock.Unlock()
+
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Close is blocked")
+	}
+}